@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ipochi/konnscen/pkg/config"
+	"github.com/ipochi/konnscen/pkg/devenv"
+	"github.com/spf13/cobra"
+)
+
+var (
+	devEnvConfigFile string
+
+	// devEnvCmd represents the dev-env command
+	devEnvCmd = &cobra.Command{
+		Use:   "dev-env",
+		Short: "Run a fake cluster with Konnectivity to develop scenarios against.",
+		Long: `Run a fake kube-apiserver serving the pods, nodes and Deployments the
+scenarios use, with pods/log, pods/exec, pods/attach and pods/portforward
+relayed to stand-in kubelets through an in-process CONNECT relay injecting
+the faults of the dev_env config. Scenarios run against it with the
+printed KUBECONFIG. Only the SPDY transport is served.`,
+		Run: runDevEnv,
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(devEnvCmd)
+
+	devEnvCmd.Flags().StringVarP(&devEnvConfigFile, "config-file", "c", "config.yaml", "Config file for the dev-env")
+}
+
+func runDevEnv(cmd *cobra.Command, args []string) {
+	env, err := devenv.Start(config.LoadConfig(devEnvConfigFile).DevEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer env.Close()
+
+	fmt.Printf("export KUBECONFIG=%s\n", env.Kubeconfig)
+	fmt.Printf("relay listening on %s\n", env.RelaySocket)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+}
@@ -1,8 +1,23 @@
 package cmd
 
 import (
+	aggregatedapi "github.com/ipochi/konnscen/pkg/scenarios/aggregated-api"
+	attachsessions "github.com/ipochi/konnscen/pkg/scenarios/attach-sessions"
+	backenddeletion "github.com/ipochi/konnscen/pkg/scenarios/backend-deletion"
 	concon "github.com/ipochi/konnscen/pkg/scenarios/concurrent-connections"
 	conportforwards "github.com/ipochi/konnscen/pkg/scenarios/concurrent-portforwards"
+	debugsessions "github.com/ipochi/konnscen/pkg/scenarios/debug-sessions"
+	dialstorm "github.com/ipochi/konnscen/pkg/scenarios/dial-storm"
+	filecopy "github.com/ipochi/konnscen/pkg/scenarios/file-copy"
+	httpconnect "github.com/ipochi/konnscen/pkg/scenarios/http-connect"
+	idletunnels "github.com/ipochi/konnscen/pkg/scenarios/idle-tunnels"
+	nodedrain "github.com/ipochi/konnscen/pkg/scenarios/node-drain"
+	nodeproxy "github.com/ipochi/konnscen/pkg/scenarios/node-proxy"
+	podproxy "github.com/ipochi/konnscen/pkg/scenarios/pod-proxy"
+	serviceproxy "github.com/ipochi/konnscen/pkg/scenarios/service-proxy"
+	ttyexec "github.com/ipochi/konnscen/pkg/scenarios/tty-exec"
+	tunnelchurn "github.com/ipochi/konnscen/pkg/scenarios/tunnel-churn"
+	webhookadmission "github.com/ipochi/konnscen/pkg/scenarios/webhook-admission"
 	"github.com/spf13/cobra"
 )
 
@@ -16,6 +31,21 @@ func AvailableScenarios() map[string]string {
 	s := map[string]string{}
 	s[concon.Name] = concon.Name
 	s[conportforwards.Name] = conportforwards.Name
+	s[tunnelchurn.Name] = tunnelchurn.Name
+	s[dialstorm.Name] = dialstorm.Name
+	s[idletunnels.Name] = idletunnels.Name
+	s[backenddeletion.Name] = backenddeletion.Name
+	s[nodedrain.Name] = nodedrain.Name
+	s[serviceproxy.Name] = serviceproxy.Name
+	s[podproxy.Name] = podproxy.Name
+	s[nodeproxy.Name] = nodeproxy.Name
+	s[aggregatedapi.Name] = aggregatedapi.Name
+	s[webhookadmission.Name] = webhookadmission.Name
+	s[debugsessions.Name] = debugsessions.Name
+	s[attachsessions.Name] = attachsessions.Name
+	s[filecopy.Name] = filecopy.Name
+	s[httpconnect.Name] = httpconnect.Name
+	s[ttyexec.Name] = ttyexec.Name
 
 	return s
 }
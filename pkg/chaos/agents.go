@@ -0,0 +1,147 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipochi/konnscen/pkg/konnectivity"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	agentIntervalSeconds   = 60
+	agentsPerRound         = 1
+	recoveryTimeoutSeconds = 120
+
+	groupAgentsReconnected = "agents-reconnected"
+)
+
+// AgentChaos deletes Konnectivity Agent pods while a scenario is running and
+// measures how long it takes to recover from it.
+type AgentChaos struct {
+	Enabled bool `yaml:"enabled"`
+	// IntervalSeconds between rounds of deletions. With Random the interval
+	// is picked at random, averaging IntervalSeconds.
+	IntervalSeconds        int                 `yaml:"interval_seconds"`
+	Random                 bool                `yaml:"random"`
+	PodsPerRound           int                 `yaml:"pods_per_round"`
+	GracePeriodSeconds     int64               `yaml:"grace_period_seconds"`
+	RecoveryTimeoutSeconds int                 `yaml:"recovery_timeout_seconds"`
+	Konnectivity           konnectivity.Config `yaml:"konnectivity"`
+}
+
+func NewAgentChaos() *AgentChaos {
+	return &AgentChaos{
+		IntervalSeconds:        agentIntervalSeconds,
+		PodsPerRound:           agentsPerRound,
+		RecoveryTimeoutSeconds: recoveryTimeoutSeconds,
+		Konnectivity:           konnectivity.NewConfig(),
+	}
+}
+
+func (a *AgentChaos) validate() error {
+	if a.IntervalSeconds <= 0 {
+		return fmt.Errorf("agents chaos: interval_seconds must be positive")
+	}
+
+	return nil
+}
+
+func (a *AgentChaos) run(cs kubernetes.Interface, rec *metrics.Recorder, stopCh <-chan struct{}) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for schedule(time.Duration(a.IntervalSeconds)*time.Second, a.Random, stopCh) {
+		if err := a.round(cs, rec, &wg); err != nil {
+			fmt.Printf("Agent chaos: %v\n", err)
+		}
+	}
+}
+
+// cleanup has nothing to revert, deleted agents are recreated by their
+// DaemonSet or Deployment.
+func (a *AgentChaos) cleanup(cs kubernetes.Interface) error {
+	return nil
+}
+
+func (a *AgentChaos) round(cs kubernetes.Interface, rec *metrics.Recorder, wg *sync.WaitGroup) error {
+	agents, err := a.Konnectivity.AgentPods(cs)
+	if err != nil {
+		return err
+	}
+
+	b, err := takeBaseline(cs, a.Konnectivity)
+	if err != nil {
+		return err
+	}
+
+	victims := pickPods(agents, a.PodsPerRound)
+	if len(victims) == 0 {
+		return fmt.Errorf("no running agent pods found with %q", a.Konnectivity.AgentSelector)
+	}
+
+	exclude := map[string]bool{}
+	for _, victim := range victims {
+		exclude[victim.Name] = true
+	}
+
+	var canaries []*canary
+	var targets []*corev1.Pod
+	for _, victim := range victims {
+		target, err := targetPod(cs, victim.Spec.NodeName, exclude)
+		if err != nil {
+			fmt.Printf("Agent chaos: not probing requests: %v\n", err)
+			continue
+		}
+		targets = append(targets, target)
+
+		c, err := openCanary(cs, target)
+		if err != nil {
+			fmt.Printf("Agent chaos: not watching in-flight stream: %v\n", err)
+			continue
+		}
+		canaries = append(canaries, c)
+	}
+
+	chaosAt := time.Now()
+	for _, victim := range victims {
+		if err := cs.CoreV1().Pods(victim.Namespace).Delete(context.TODO(), victim.Name, metav1.DeleteOptions{
+			GracePeriodSeconds: &a.GracePeriodSeconds,
+		}); err != nil {
+			fmt.Printf("Agent chaos: deleting %s: %v\n", victim.Name, err)
+			continue
+		}
+
+		fmt.Printf("Agent chaos: deleted %s on node %s\n", victim.Name, victim.Spec.NodeName)
+	}
+
+	timeout := time.Duration(a.RecoveryTimeoutSeconds) * time.Second
+	for _, c := range canaries {
+		wg.Add(1)
+		go func(c *canary) {
+			defer wg.Done()
+			c.watch(rec, chaosAt, timeout)
+		}(c)
+	}
+
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target *corev1.Pod) {
+			defer wg.Done()
+			waitForRequests(cs, rec, target, chaosAt, timeout)
+		}(target)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.waitFor(cs, rec, groupAgentsReconnected, chaosAt, timeout)
+	}()
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package chaos
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ipochi/konnscen/pkg/konnectivity"
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	"k8s.io/client-go/kubernetes"
+)
+
+const readyBackendsMetric = "konnectivity_network_proxy_server_ready_backend_connections"
+
+// baseline is the state of Konnectivity before the chaos.
+type baseline struct {
+	konnectivity konnectivity.Config
+	servers      int
+	agents       int
+	// backends is the sum of agent connections over the servers, -1 if the
+	// server metrics could not be scraped.
+	backends float64
+}
+
+func takeBaseline(cs kubernetes.Interface, k konnectivity.Config) (*baseline, error) {
+	servers, err := k.ServerPods(cs)
+	if err != nil {
+		return nil, err
+	}
+
+	agents, err := k.AgentPods(cs)
+	if err != nil {
+		return nil, err
+	}
+
+	backends, err := k.ServerMetric(cs, readyBackendsMetric)
+	if err != nil {
+		fmt.Printf("Not checking server backends, getting baseline: %v\n", err)
+		backends = -1
+	}
+
+	return &baseline{
+		konnectivity: k,
+		servers:      k8s.ReadyPods(servers),
+		agents:       k8s.ReadyPods(agents),
+		backends:     backends,
+	}, nil
+}
+
+func (b *baseline) reached(cs kubernetes.Interface) bool {
+	servers, err := b.konnectivity.ServerPods(cs)
+	if err != nil || k8s.ReadyPods(servers) < b.servers {
+		return false
+	}
+
+	agents, err := b.konnectivity.AgentPods(cs)
+	if err != nil || k8s.ReadyPods(agents) < b.agents {
+		return false
+	}
+
+	if b.backends < 0 {
+		return true
+	}
+
+	backends, err := b.konnectivity.ServerMetric(cs, readyBackendsMetric)
+
+	return err == nil && backends >= b.backends
+}
+
+// waitFor records how long after the chaos all the servers and agents were
+// ready again and connected to each other with as many connections as before.
+func (b *baseline) waitFor(cs kubernetes.Interface, rec *metrics.Recorder, group string, chaosAt time.Time, timeout time.Duration) {
+	s := metrics.Sample{Group: group, Start: chaosAt}
+
+	for time.Since(chaosAt) < timeout {
+		time.Sleep(time.Second)
+
+		if b.reached(cs) {
+			s.Latency = time.Since(chaosAt)
+			fmt.Printf("Konnectivity back to baseline %v after chaos\n", s.Latency)
+			rec.Record(s)
+			return
+		}
+	}
+
+	s.Latency = time.Since(chaosAt)
+	s.Class = classTimeout
+	s.Err = fmt.Errorf("Konnectivity not back to baseline after %v", timeout)
+	fmt.Println(s.Err)
+	rec.Record(s)
+}
@@ -0,0 +1,113 @@
+package chaos
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Config is the chaos that runs alongside every scenario.
+type Config struct {
+	Agents    *AgentChaos     `yaml:"agents,omitempty"`
+	Servers   *ServerChaos    `yaml:"servers,omitempty"`
+	Partition *PartitionChaos `yaml:"partition,omitempty"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Agents:    NewAgentChaos(),
+		Servers:   NewServerChaos(),
+		Partition: NewPartitionChaos(),
+	}
+}
+
+// chaos is a fault injected until stopCh is closed. Measurements of the
+// recovery from the fault go to rec. cleanup reverts a fault left behind by
+// an interrupted run.
+type chaos interface {
+	validate() error
+	run(cs kubernetes.Interface, rec *metrics.Recorder, stopCh <-chan struct{})
+	cleanup(cs kubernetes.Interface) error
+}
+
+func (c *Config) enabled() []chaos {
+	var enabled []chaos
+	if c.Agents != nil && c.Agents.Enabled {
+		enabled = append(enabled, c.Agents)
+	}
+	if c.Servers != nil && c.Servers.Enabled {
+		enabled = append(enabled, c.Servers)
+	}
+	if c.Partition != nil && c.Partition.Enabled {
+		enabled = append(enabled, c.Partition)
+	}
+
+	return enabled
+}
+
+// Start injects the enabled chaos in the background. The returned func stops
+// it, waits for pending measurements and reports them.
+func (c *Config) Start() (func(), error) {
+	enabled := c.enabled()
+	if len(enabled) == 0 {
+		return func() {}, nil
+	}
+
+	for _, ch := range enabled {
+		if err := ch.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return nil, fmt.Errorf("getting clientset, %v", err)
+	}
+
+	rec := metrics.NewRecorder()
+	stopCh := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(len(enabled))
+	for _, ch := range enabled {
+		go func(ch chaos) {
+			defer wg.Done()
+			ch.run(cs, rec, stopCh)
+		}(ch)
+	}
+
+	return func() {
+		close(stopCh)
+		wg.Wait()
+
+		fmt.Println("Chaos recovery:")
+		rec.Report(os.Stdout)
+	}, nil
+}
+
+// Cleanup reverts the faults of the enabled chaos.
+func (c *Config) Cleanup() error {
+	enabled := c.enabled()
+	if len(enabled) == 0 {
+		return nil
+	}
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	var errs []error
+	for _, ch := range enabled {
+		if err := ch.cleanup(cs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
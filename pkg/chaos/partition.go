@@ -0,0 +1,199 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ipochi/konnscen/pkg/konnectivity"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	partitionIntervalSeconds = 120
+	partitionSeconds         = 30
+	partitionPolicyName      = "konnscen-partition"
+
+	groupPartitionHealed = "partition-healed"
+)
+
+// PartitionChaos applies a NetworkPolicy denying egress from the Konnectivity
+// Agent pods to the Konnectivity Servers for PartitionSeconds, on CNIs which
+// enforce NetworkPolicies. It measures the failures during the partition and
+// how long the tunnels take to recover once it is healed.
+type PartitionChaos struct {
+	Enabled bool `yaml:"enabled"`
+	// IntervalSeconds between partitions. With Random the interval is
+	// picked at random, averaging IntervalSeconds.
+	IntervalSeconds  int  `yaml:"interval_seconds"`
+	Random           bool `yaml:"random"`
+	PartitionSeconds int  `yaml:"partition_seconds"`
+	// ServerCIDRs the agents connect to, defaults to the IPs of the server
+	// pods. Set it when the agents connect through a load balancer.
+	ServerCIDRs            []string            `yaml:"server_cidrs"`
+	PolicyName             string              `yaml:"policy_name"`
+	RecoveryTimeoutSeconds int                 `yaml:"recovery_timeout_seconds"`
+	Konnectivity           konnectivity.Config `yaml:"konnectivity"`
+}
+
+func NewPartitionChaos() *PartitionChaos {
+	return &PartitionChaos{
+		IntervalSeconds:        partitionIntervalSeconds,
+		PartitionSeconds:       partitionSeconds,
+		PolicyName:             partitionPolicyName,
+		RecoveryTimeoutSeconds: recoveryTimeoutSeconds,
+		Konnectivity:           konnectivity.NewConfig(),
+	}
+}
+
+func (p *PartitionChaos) validate() error {
+	if p.IntervalSeconds <= 0 {
+		return fmt.Errorf("partition chaos: interval_seconds must be positive")
+	}
+
+	return nil
+}
+
+func (p *PartitionChaos) run(cs kubernetes.Interface, rec *metrics.Recorder, stopCh <-chan struct{}) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for schedule(time.Duration(p.IntervalSeconds)*time.Second, p.Random, stopCh) {
+		if err := p.round(cs, rec, &wg, stopCh); err != nil {
+			fmt.Printf("Partition chaos: %v\n", err)
+		}
+	}
+}
+
+func (p *PartitionChaos) round(cs kubernetes.Interface, rec *metrics.Recorder, wg *sync.WaitGroup, stopCh <-chan struct{}) error {
+	b, err := takeBaseline(cs, p.Konnectivity)
+	if err != nil {
+		return err
+	}
+
+	targets, err := spreadTargets(cs, targetsPerRound)
+	if err != nil {
+		return err
+	}
+
+	policy, err := p.policy(cs)
+	if err != nil {
+		return err
+	}
+
+	if _, err := cs.NetworkingV1().NetworkPolicies(policy.Namespace).Create(context.TODO(), policy, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("creating NetworkPolicy %s: %v", policy.Name, err)
+	}
+
+	partitionAt := time.Now()
+	fmt.Printf("Partition chaos: agents partitioned from servers by NetworkPolicy %s\n", policy.Name)
+
+	timeout := time.Duration(p.PartitionSeconds+p.RecoveryTimeoutSeconds) * time.Second
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target *corev1.Pod) {
+			defer wg.Done()
+			errorWindow(cs, rec, target, partitionAt, timeout)
+		}(target)
+	}
+
+	select {
+	case <-time.After(time.Duration(p.PartitionSeconds) * time.Second):
+	case <-stopCh:
+	}
+
+	if err := p.cleanup(cs); err != nil {
+		return err
+	}
+
+	healedAt := time.Now()
+	fmt.Printf("Partition chaos: healed after %v\n", healedAt.Sub(partitionAt))
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.waitFor(cs, rec, groupPartitionHealed, healedAt, time.Duration(p.RecoveryTimeoutSeconds)*time.Second)
+	}()
+
+	return nil
+}
+
+// policy allows egress from the agents anywhere but to the servers.
+func (p *PartitionChaos) policy(cs kubernetes.Interface) (*networkingv1.NetworkPolicy, error) {
+	selector, err := metav1.ParseToLabelSelector(p.Konnectivity.AgentSelector)
+	if err != nil {
+		return nil, fmt.Errorf("parsing agent selector %q: %v", p.Konnectivity.AgentSelector, err)
+	}
+
+	cidrs := p.ServerCIDRs
+	if len(cidrs) == 0 {
+		servers, err := p.Konnectivity.ServerPods(cs)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, server := range servers {
+			for _, ip := range server.Status.PodIPs {
+				cidrs = append(cidrs, hostCIDR(ip.IP))
+			}
+		}
+	}
+
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("no server IPs found to partition agents from")
+	}
+
+	v4 := networkingv1.IPBlock{CIDR: "0.0.0.0/0"}
+	v6 := networkingv1.IPBlock{CIDR: "::/0"}
+	for _, cidr := range cidrs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing server CIDR %q: %v", cidr, err)
+		}
+
+		if ip.To4() != nil {
+			v4.Except = append(v4.Except, cidr)
+		} else {
+			v6.Except = append(v6.Except, cidr)
+		}
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      p.PolicyName,
+			Namespace: p.Konnectivity.Namespace,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: *selector,
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			Egress: []networkingv1.NetworkPolicyEgressRule{{
+				To: []networkingv1.NetworkPolicyPeer{{IPBlock: &v4}, {IPBlock: &v6}},
+			}},
+		},
+	}, nil
+}
+
+// cleanup removes the NetworkPolicy, if it is still there.
+func (p *PartitionChaos) cleanup(cs kubernetes.Interface) error {
+	err := cs.NetworkingV1().NetworkPolicies(p.Konnectivity.Namespace).Delete(context.TODO(), p.PolicyName, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("deleting NetworkPolicy %s: %v", p.PolicyName, err)
+	}
+
+	return nil
+}
+
+func hostCIDR(ip string) string {
+	if net.ParseIP(ip).To4() != nil {
+		return ip + "/32"
+	}
+
+	return ip + "/128"
+}
@@ -0,0 +1,217 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"time"
+
+	"github.com/ipochi/konnscen/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	probeInterval = 500 * time.Millisecond
+	probeTimeout  = 5 * time.Second
+
+	groupStreamBroke       = "stream-broke"
+	groupRequestsRecovered = "requests-recovered"
+	groupErrorWindow       = "error-window"
+
+	classTimeout = "timeout"
+)
+
+// schedule waits for the next round of chaos, either exactly interval or a
+// random duration averaging interval. It returns false once stopCh is closed.
+func schedule(interval time.Duration, random bool, stopCh <-chan struct{}) bool {
+	if random {
+		interval = time.Duration(rand.Int63n(int64(2 * interval)))
+	}
+
+	select {
+	case <-time.After(interval):
+		return true
+	case <-stopCh:
+		return false
+	}
+}
+
+// pickPods returns up to n random running pods, which are not terminating.
+func pickPods(pods []corev1.Pod, n int) []corev1.Pod {
+	var running []corev1.Pod
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil {
+			running = append(running, pod)
+		}
+	}
+
+	rand.Shuffle(len(running), func(i, j int) { running[i], running[j] = running[j], running[i] })
+	if len(running) > n {
+		running = running[:n]
+	}
+
+	return running
+}
+
+// targetPod finds a running pod on the node to send kubelet-bound requests to.
+func targetPod(cs kubernetes.Interface, node string, exclude map[string]bool) (*corev1.Pod, error) {
+	pods, err := cs.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{
+		FieldSelector: fields.AndSelectors(
+			fields.OneTermEqualSelector("spec.nodeName", node),
+			fields.OneTermEqualSelector("status.phase", string(corev1.PodRunning)),
+		).String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing pods on node %s: %v", node, err)
+	}
+
+	for _, pod := range pods.Items {
+		if !exclude[pod.Name] {
+			return &pod, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no running pod found on node %s", node)
+}
+
+// canary is an in-flight log stream followed across the chaos.
+type canary struct {
+	pod    *corev1.Pod
+	cancel context.CancelFunc
+	broke  chan struct{}
+}
+
+func openCanary(cs kubernetes.Interface, pod *corev1.Pod) (*canary, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream, err := cs.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: pod.Spec.Containers[0].Name,
+		Follow:    true,
+	}).Stream(ctx)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("following logs of %s: %v", pod.Name, err)
+	}
+
+	c := &canary{pod: pod, cancel: cancel, broke: make(chan struct{})}
+	go func() {
+		io.Copy(ioutil.Discard, stream)
+		stream.Close()
+		close(c.broke)
+	}()
+
+	return c, nil
+}
+
+// watch records how long after the chaos the in-flight stream broke.
+func (c *canary) watch(rec *metrics.Recorder, chaosAt time.Time, timeout time.Duration) {
+	defer c.cancel()
+
+	select {
+	case <-c.broke:
+		fmt.Printf("In-flight stream to %s broke %v after chaos\n", c.pod.Name, time.Since(chaosAt))
+		rec.Record(metrics.Sample{Group: groupStreamBroke, Start: chaosAt, Latency: time.Since(chaosAt)})
+	case <-time.After(timeout):
+		fmt.Printf("In-flight stream to %s survived chaos\n", c.pod.Name)
+	}
+}
+
+// waitForRequests records how long after the chaos a new kubelet-bound
+// request to the pod succeeded.
+func waitForRequests(cs kubernetes.Interface, rec *metrics.Recorder, pod *corev1.Pod, chaosAt time.Time, timeout time.Duration) {
+	tail := int64(1)
+	s := metrics.Sample{Group: groupRequestsRecovered, Start: chaosAt}
+
+	for time.Since(chaosAt) < timeout {
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		_, err := cs.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+			Container: pod.Spec.Containers[0].Name,
+			TailLines: &tail,
+		}).DoRaw(ctx)
+		cancel()
+
+		if err == nil {
+			s.Latency = time.Since(chaosAt)
+			fmt.Printf("Requests to %s succeeded %v after chaos\n", pod.Name, s.Latency)
+			rec.Record(s)
+			return
+		}
+
+		s.Err = err
+		time.Sleep(probeInterval)
+	}
+
+	s.Latency = time.Since(chaosAt)
+	s.Class = classTimeout
+	fmt.Printf("Requests to %s still failing %v after chaos: %v\n", pod.Name, s.Latency, s.Err)
+	rec.Record(s)
+}
+
+// errorWindow keeps sending kubelet-bound requests to the pod until the
+// timeout and records the window between the first and the last failure.
+func errorWindow(cs kubernetes.Interface, rec *metrics.Recorder, pod *corev1.Pod, chaosAt time.Time, timeout time.Duration) {
+	tail := int64(1)
+	var first, last time.Time
+	var lastErr error
+	failures := 0
+
+	for time.Since(chaosAt) < timeout {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		_, err := cs.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+			Container: pod.Spec.Containers[0].Name,
+			TailLines: &tail,
+		}).DoRaw(ctx)
+		cancel()
+
+		if err != nil {
+			if first.IsZero() {
+				first = start
+			}
+			last = time.Now()
+			lastErr = err
+			failures++
+		}
+
+		time.Sleep(probeInterval)
+	}
+
+	if failures == 0 {
+		fmt.Printf("Requests to %s never failed during chaos\n", pod.Name)
+		return
+	}
+
+	fmt.Printf("Requests to %s failed %d times over %v, last error: %v\n", pod.Name, failures, last.Sub(first), lastErr)
+	rec.Record(metrics.Sample{Group: groupErrorWindow, Start: first, Latency: last.Sub(first), Err: lastErr})
+}
+
+// spreadTargets finds a running pod on up to n nodes to send kubelet-bound
+// requests to.
+func spreadTargets(cs kubernetes.Interface, n int) ([]*corev1.Pod, error) {
+	nodes, err := cs.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes: %v", err)
+	}
+
+	var targets []*corev1.Pod
+	for _, node := range nodes.Items {
+		if len(targets) == n {
+			break
+		}
+
+		if target, err := targetPod(cs, node.Name, nil); err == nil {
+			targets = append(targets, target)
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no running pods found to send requests to")
+	}
+
+	return targets, nil
+}
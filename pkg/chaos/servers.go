@@ -0,0 +1,214 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipochi/konnscen/pkg/konnectivity"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	serverIntervalSeconds = 120
+	serversPerRound       = 1
+	serverDeployment      = "konnectivity-server"
+	scaleDownSeconds      = 30
+	targetsPerRound       = 3
+
+	modeDelete = "delete"
+	modeScale  = "scale"
+
+	groupServersReestablished = "servers-reestablished"
+)
+
+// ServerChaos deletes Konnectivity Server pods, or scales down their
+// Deployment, while a scenario is running and measures how long the
+// apiserver to kubelet requests fail and how long it takes for all the
+// tunnels to be established again.
+type ServerChaos struct {
+	Enabled bool `yaml:"enabled"`
+	// IntervalSeconds between rounds. With Random the interval is picked at
+	// random, averaging IntervalSeconds.
+	IntervalSeconds int  `yaml:"interval_seconds"`
+	Random          bool `yaml:"random"`
+	// Mode is delete, deleting PodsPerRound server pods, or scale, scaling
+	// the Deployment to ScaleTo replicas for ScaleDownSeconds.
+	Mode                   string              `yaml:"mode"`
+	PodsPerRound           int                 `yaml:"pods_per_round"`
+	Deployment             string              `yaml:"deployment"`
+	ScaleTo                int32               `yaml:"scale_to"`
+	ScaleDownSeconds       int                 `yaml:"scale_down_seconds"`
+	GracePeriodSeconds     int64               `yaml:"grace_period_seconds"`
+	RecoveryTimeoutSeconds int                 `yaml:"recovery_timeout_seconds"`
+	Konnectivity           konnectivity.Config `yaml:"konnectivity"`
+
+	mu sync.Mutex
+	// scaledFrom is the number of replicas to scale back to, while scaled down.
+	scaledFrom *int32
+}
+
+func NewServerChaos() *ServerChaos {
+	return &ServerChaos{
+		IntervalSeconds:        serverIntervalSeconds,
+		Mode:                   modeDelete,
+		PodsPerRound:           serversPerRound,
+		Deployment:             serverDeployment,
+		ScaleDownSeconds:       scaleDownSeconds,
+		RecoveryTimeoutSeconds: recoveryTimeoutSeconds,
+		Konnectivity:           konnectivity.NewConfig(),
+	}
+}
+
+func (s *ServerChaos) validate() error {
+	if s.IntervalSeconds <= 0 {
+		return fmt.Errorf("servers chaos: interval_seconds must be positive")
+	}
+
+	return nil
+}
+
+func (s *ServerChaos) run(cs kubernetes.Interface, rec *metrics.Recorder, stopCh <-chan struct{}) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for schedule(time.Duration(s.IntervalSeconds)*time.Second, s.Random, stopCh) {
+		if err := s.round(cs, rec, &wg, stopCh); err != nil {
+			fmt.Printf("Server chaos: %v\n", err)
+		}
+	}
+}
+
+func (s *ServerChaos) round(cs kubernetes.Interface, rec *metrics.Recorder, wg *sync.WaitGroup, stopCh <-chan struct{}) error {
+	b, err := takeBaseline(cs, s.Konnectivity)
+	if err != nil {
+		return err
+	}
+
+	targets, err := spreadTargets(cs, targetsPerRound)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(s.RecoveryTimeoutSeconds) * time.Second
+	chaosAt := time.Now()
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target *corev1.Pod) {
+			defer wg.Done()
+			errorWindow(cs, rec, target, chaosAt, timeout)
+		}(target)
+	}
+
+	switch s.Mode {
+	case modeDelete:
+		err = s.deletePods(cs)
+	case modeScale:
+		err = s.scaleDown(cs, stopCh)
+	default:
+		err = fmt.Errorf("unknown mode %q", s.Mode)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// With scale, the servers can only come back once scaled up again.
+	restoredAt := time.Now()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.waitFor(cs, rec, groupServersReestablished, restoredAt, timeout)
+	}()
+
+	return nil
+}
+
+func (s *ServerChaos) deletePods(cs kubernetes.Interface) error {
+	servers, err := s.Konnectivity.ServerPods(cs)
+	if err != nil {
+		return err
+	}
+
+	victims := pickPods(servers, s.PodsPerRound)
+	if len(victims) == 0 {
+		return fmt.Errorf("no running server pods found with %q", s.Konnectivity.ServerSelector)
+	}
+
+	for _, victim := range victims {
+		// Deleting the mirror pod of a static pod does not restart it.
+		if owner := metav1.GetControllerOf(&victim); owner == nil || owner.Kind != "ReplicaSet" {
+			return fmt.Errorf("server pod %s is not managed by a Deployment", victim.Name)
+		}
+
+		if err := cs.CoreV1().Pods(victim.Namespace).Delete(context.TODO(), victim.Name, metav1.DeleteOptions{
+			GracePeriodSeconds: &s.GracePeriodSeconds,
+		}); err != nil {
+			return fmt.Errorf("deleting %s: %v", victim.Name, err)
+		}
+
+		fmt.Printf("Server chaos: deleted %s\n", victim.Name)
+	}
+
+	return nil
+}
+
+// scaleDown scales the Deployment down and back up to its replicas after
+// ScaleDownSeconds, or as soon as stopCh is closed.
+func (s *ServerChaos) scaleDown(cs kubernetes.Interface, stopCh <-chan struct{}) error {
+	deployments := cs.AppsV1().Deployments(s.Konnectivity.Namespace)
+
+	scale, err := deployments.GetScale(context.TODO(), s.Deployment, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("getting scale of %s: %v", s.Deployment, err)
+	}
+
+	replicas := scale.Spec.Replicas
+	s.mu.Lock()
+	s.scaledFrom = &replicas
+	s.mu.Unlock()
+
+	scale.Spec.Replicas = s.ScaleTo
+	if _, err = deployments.UpdateScale(context.TODO(), s.Deployment, scale, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("scaling %s to %d: %v", s.Deployment, s.ScaleTo, err)
+	}
+
+	fmt.Printf("Server chaos: scaled %s from %d to %d replicas\n", s.Deployment, replicas, s.ScaleTo)
+	select {
+	case <-time.After(time.Duration(s.ScaleDownSeconds) * time.Second):
+	case <-stopCh:
+	}
+
+	return s.cleanup(cs)
+}
+
+// cleanup scales the Deployment back up, if it is still scaled down.
+func (s *ServerChaos) cleanup(cs kubernetes.Interface) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.scaledFrom == nil {
+		return nil
+	}
+
+	deployments := cs.AppsV1().Deployments(s.Konnectivity.Namespace)
+
+	scale, err := deployments.GetScale(context.TODO(), s.Deployment, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("getting scale of %s: %v", s.Deployment, err)
+	}
+
+	scale.Spec.Replicas = *s.scaledFrom
+	if _, err := deployments.UpdateScale(context.TODO(), s.Deployment, scale, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("scaling %s back to %d: %v", s.Deployment, *s.scaledFrom, err)
+	}
+
+	fmt.Printf("Server chaos: scaled %s back to %d replicas\n", s.Deployment, *s.scaledFrom)
+	s.scaledFrom = nil
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package checksum
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	DirectionUpload   = "upload"
+	DirectionDownload = "download"
+
+	ClassCorrupted = "corrupted"
+	ClassTruncated = "truncated"
+)
+
+// Directions returns the directions of a direction option, which is upload,
+// download or both, the default.
+func Directions(direction string) []string {
+	switch direction {
+	case DirectionUpload, DirectionDownload:
+		return []string{direction}
+	default:
+		return []string{DirectionUpload, DirectionDownload}
+	}
+}
+
+// Error is returned when a payload arrived, but not intact. Class is
+// ClassCorrupted or ClassTruncated.
+type Error struct {
+	Class string
+	msg   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s payload: %s", e.Class, e.msg)
+}
+
+// Class returns the class of an Error, or empty for any other error.
+func Class(err error) string {
+	var cerr *Error
+	if errors.As(err, &cerr) {
+		return cerr.Class
+	}
+
+	return ""
+}
+
+// Upload posts size random bytes to a checksum pod at uri and checks it
+// received and summed them all.
+func Upload(client *http.Client, uri string, size int64) (int64, error) {
+	sum := sha256.New()
+	body := io.TeeReader(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), size), sum)
+
+	req, err := http.NewRequest(http.MethodPost, uri, body)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	var remoteSum string
+	var received int64
+	if _, err := fmt.Fscan(bytes.NewReader(out), &remoteSum, &received); err != nil {
+		return 0, fmt.Errorf("parsing upload response %q: %v", out, err)
+	}
+
+	if received != size {
+		return received, &Error{ClassTruncated, fmt.Sprintf("sent %d bytes, received %d", size, received)}
+	}
+
+	if localSum := hex.EncodeToString(sum.Sum(nil)); remoteSum != localSum {
+		return received, &Error{ClassCorrupted, fmt.Sprintf("sent sha256 %s, received %s", localSum, remoteSum)}
+	}
+
+	return received, nil
+}
+
+// Download gets size random bytes from a checksum pod at uri and checks
+// they match the sum the pod sent along.
+func Download(client *http.Client, uri string, size int64) (int64, error) {
+	resp, err := client.Get(fmt.Sprintf("%s/?size=%d", uri, size))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	sum := sha256.New()
+	received, err := io.Copy(sum, resp.Body)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return received, err
+	}
+
+	if received != size {
+		return received, &Error{ClassTruncated, fmt.Sprintf("expected %d bytes, received %d", size, received)}
+	}
+
+	remoteSum := resp.Header.Get("X-Sha256")
+	if localSum := hex.EncodeToString(sum.Sum(nil)); remoteSum != localSum {
+		return received, &Error{ClassCorrupted, fmt.Sprintf("sent sha256 %s, received %s", remoteSum, localSum)}
+	}
+
+	return received, nil
+}
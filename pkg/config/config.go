@@ -5,20 +5,77 @@ import (
 	"log"
 	"os"
 
+	"github.com/ipochi/konnscen/pkg/chaos"
+	"github.com/ipochi/konnscen/pkg/devenv"
+	"github.com/ipochi/konnscen/pkg/faultproxy"
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	aggregatedapi "github.com/ipochi/konnscen/pkg/scenarios/aggregated-api"
+	attachsessions "github.com/ipochi/konnscen/pkg/scenarios/attach-sessions"
+	backenddeletion "github.com/ipochi/konnscen/pkg/scenarios/backend-deletion"
 	concon "github.com/ipochi/konnscen/pkg/scenarios/concurrent-connections"
 	conportforwards "github.com/ipochi/konnscen/pkg/scenarios/concurrent-portforwards"
+	debugsessions "github.com/ipochi/konnscen/pkg/scenarios/debug-sessions"
+	dialstorm "github.com/ipochi/konnscen/pkg/scenarios/dial-storm"
+	filecopy "github.com/ipochi/konnscen/pkg/scenarios/file-copy"
+	httpconnect "github.com/ipochi/konnscen/pkg/scenarios/http-connect"
+	idletunnels "github.com/ipochi/konnscen/pkg/scenarios/idle-tunnels"
+	nodedrain "github.com/ipochi/konnscen/pkg/scenarios/node-drain"
+	nodeproxy "github.com/ipochi/konnscen/pkg/scenarios/node-proxy"
+	podproxy "github.com/ipochi/konnscen/pkg/scenarios/pod-proxy"
+	serviceproxy "github.com/ipochi/konnscen/pkg/scenarios/service-proxy"
+	ttyexec "github.com/ipochi/konnscen/pkg/scenarios/tty-exec"
+	tunnelchurn "github.com/ipochi/konnscen/pkg/scenarios/tunnel-churn"
+	webhookadmission "github.com/ipochi/konnscen/pkg/scenarios/webhook-admission"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	ConcurrentConnections  *concon.ConcurrentConnections           `yaml:"concurrent_connections,omitempty"`
 	ConcurrentPortForwards *conportforwards.ConcurrentPortForwards `yaml:"concurrent_portforwards,omitempty"`
+	TunnelChurn            *tunnelchurn.TunnelChurn                `yaml:"tunnel_churn,omitempty"`
+	DialStorm              *dialstorm.DialStorm                    `yaml:"dial_storm,omitempty"`
+	IdleTunnels            *idletunnels.IdleTunnels                `yaml:"idle_tunnels,omitempty"`
+	BackendDeletion        *backenddeletion.BackendDeletion        `yaml:"backend_deletion,omitempty"`
+	NodeDrain              *nodedrain.NodeDrain                    `yaml:"node_drain,omitempty"`
+	ServiceProxy           *serviceproxy.ServiceProxy              `yaml:"service_proxy,omitempty"`
+	PodProxy               *podproxy.PodProxy                      `yaml:"pod_proxy,omitempty"`
+	NodeProxy              *nodeproxy.NodeProxy                    `yaml:"node_proxy,omitempty"`
+	AggregatedAPI          *aggregatedapi.AggregatedAPI            `yaml:"aggregated_api,omitempty"`
+	WebhookAdmission       *webhookadmission.WebhookAdmission      `yaml:"webhook_admission,omitempty"`
+	DebugSessions          *debugsessions.DebugSessions            `yaml:"debug_sessions,omitempty"`
+	AttachSessions         *attachsessions.AttachSessions          `yaml:"attach_sessions,omitempty"`
+	FileCopy               *filecopy.FileCopy                      `yaml:"file_copy,omitempty"`
+	HTTPConnect            *httpconnect.HTTPConnect                `yaml:"http_connect,omitempty"`
+	TTYExec                *ttyexec.TTYExec                        `yaml:"tty_exec,omitempty"`
+	Chaos                  *chaos.Config                           `yaml:"chaos,omitempty"`
+	FaultProxy             *faultproxy.Config                      `yaml:"fault_proxy,omitempty"`
+	DevEnv                 *devenv.Config                          `yaml:"dev_env,omitempty"`
+	ClientRateLimit        *k8s.RateLimit                          `yaml:"client_rate_limit,omitempty"`
 }
 
 func NewConfig() *Config {
 	return &Config{
 		ConcurrentConnections:  concon.NewConcurrentConnections(),
 		ConcurrentPortForwards: conportforwards.NewConcurrentPortForwards(),
+		TunnelChurn:            tunnelchurn.NewTunnelChurn(),
+		DialStorm:              dialstorm.NewDialStorm(),
+		IdleTunnels:            idletunnels.NewIdleTunnels(),
+		BackendDeletion:        backenddeletion.NewBackendDeletion(),
+		NodeDrain:              nodedrain.NewNodeDrain(),
+		ServiceProxy:           serviceproxy.NewServiceProxy(),
+		PodProxy:               podproxy.NewPodProxy(),
+		NodeProxy:              nodeproxy.NewNodeProxy(),
+		AggregatedAPI:          aggregatedapi.NewAggregatedAPI(),
+		WebhookAdmission:       webhookadmission.NewWebhookAdmission(),
+		DebugSessions:          debugsessions.NewDebugSessions(),
+		AttachSessions:         attachsessions.NewAttachSessions(),
+		FileCopy:               filecopy.NewFileCopy(),
+		HTTPConnect:            httpconnect.NewHTTPConnect(),
+		TTYExec:                ttyexec.NewTTYExec(),
+		Chaos:                  chaos.NewConfig(),
+		FaultProxy:             faultproxy.NewConfig(),
+		DevEnv:                 devenv.NewConfig(),
+		ClientRateLimit:        k8s.NewRateLimit(),
 	}
 }
 
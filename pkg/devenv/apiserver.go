@@ -0,0 +1,320 @@
+package devenv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ipochi/konnscen/pkg/konnectivity"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+)
+
+const dialTimeout = 30 * time.Second
+
+// apiserver is the fake kube-apiserver. It serves the objects of the
+// cluster and proxies the streaming pod subresources to the kubelets
+// through the relay.
+type apiserver struct {
+	cluster *cluster
+	egress  konnectivity.Egress
+}
+
+// match reports whether the path segments match the pattern, in which *
+// matches any segment.
+func match(parts []string, pattern ...string) bool {
+	if len(parts) != len(pattern) {
+		return false
+	}
+
+	for i, p := range pattern {
+		if p != "*" && p != parts[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (a *apiserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	switch {
+	case match(parts, "api", "v1", "nodes") && r.Method == http.MethodGet:
+		writeObject(w, http.StatusOK, a.cluster.listNodes())
+	case match(parts, "api", "v1", "pods") && r.Method == http.MethodGet:
+		a.listPods(w, "", query)
+	case match(parts, "api", "v1", "namespaces", "*", "pods") && r.Method == http.MethodGet:
+		a.listPods(w, parts[3], query)
+	case match(parts, "api", "v1", "namespaces", "*", "pods", "*"):
+		a.pod(w, r, parts[3], parts[5])
+	case match(parts, "api", "v1", "namespaces", "*", "pods", "*", "*"):
+		a.podSubresource(w, r, parts[3], parts[5], parts[6])
+	case match(parts, "apis", "apps", "v1", "namespaces", "*", "deployments"):
+		a.deployments(w, r, parts[4])
+	case match(parts, "apis", "apps", "v1", "namespaces", "*", "deployments", "*"):
+		a.deployment(w, r, parts[4], parts[6])
+	default:
+		writeError(w, apierrors.NewNotFound(schema.GroupResource{}, r.URL.Path))
+	}
+}
+
+func (a *apiserver) listPods(w http.ResponseWriter, namespace string, query url.Values) {
+	list, err := a.cluster.listPods(namespace, query.Get("labelSelector"), query.Get("fieldSelector"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeObject(w, http.StatusOK, list)
+}
+
+func (a *apiserver) pod(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		p, err := a.cluster.getPod(namespace, name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeObject(w, http.StatusOK, &p.obj)
+	case http.MethodDelete:
+		if err := a.cluster.removePod(namespace, name); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeObject(w, http.StatusOK, success())
+	default:
+		writeError(w, apierrors.NewMethodNotSupported(podsResource, r.Method))
+	}
+}
+
+func (a *apiserver) podSubresource(w http.ResponseWriter, r *http.Request, namespace, name, subresource string) {
+	p, err := a.cluster.getPod(namespace, name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	container := r.URL.Query().Get("container")
+	if container == "" && len(p.obj.Spec.Containers) > 0 {
+		container = p.obj.Spec.Containers[0].Name
+	}
+
+	switch subresource {
+	case "eviction":
+		if err := a.cluster.removePod(namespace, name); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeObject(w, http.StatusCreated, success())
+	case "log":
+		a.proxy(w, r, p, fmt.Sprintf("/containerLogs/%s/%s/%s", namespace, name, container))
+	case "exec":
+		a.proxy(w, r, p, fmt.Sprintf("/exec/%s/%s/%s", namespace, name, container))
+	case "attach":
+		a.proxy(w, r, p, fmt.Sprintf("/attach/%s/%s/%s", namespace, name, container))
+	case "portforward":
+		a.proxy(w, r, p, fmt.Sprintf("/portForward/%s/%s", namespace, name))
+	default:
+		writeError(w, apierrors.NewNotFound(podsResource, name+"/"+subresource))
+	}
+}
+
+func (a *apiserver) deployments(w http.ResponseWriter, r *http.Request, namespace string) {
+	switch r.Method {
+	case http.MethodGet:
+		writeObject(w, http.StatusOK, a.cluster.listDeployments(namespace))
+	case http.MethodPost:
+		d := &appsv1.Deployment{}
+		if err := json.NewDecoder(r.Body).Decode(d); err != nil {
+			writeError(w, apierrors.NewBadRequest(fmt.Sprintf("decoding deployment: %v", err)))
+			return
+		}
+		d.Namespace = namespace
+
+		d, err := a.cluster.createDeployment(d)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeObject(w, http.StatusCreated, d)
+	default:
+		writeError(w, apierrors.NewMethodNotSupported(deploymentsResource, r.Method))
+	}
+}
+
+func (a *apiserver) deployment(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		d, err := a.cluster.getDeployment(namespace, name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeObject(w, http.StatusOK, d)
+	case http.MethodDelete:
+		if err := a.cluster.deleteDeployment(namespace, name); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeObject(w, http.StatusOK, success())
+	default:
+		writeError(w, apierrors.NewMethodNotSupported(deploymentsResource, r.Method))
+	}
+}
+
+// proxy sends the request to path on the kubelet of the pod through a
+// tunnel of the relay. Upgrades are spliced, everything else is streamed
+// back response by response. WebSocket upgrades are rejected, as the
+// kubelets only speak SPDY.
+func (a *apiserver) proxy(w http.ResponseWriter, r *http.Request, p *pod, path string) {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		writeError(w, apierrors.NewBadRequest("the dev-env only serves the spdy transport"))
+		return
+	}
+
+	conn, err := a.egress.Dial(nil, dialTimeout)
+	if err != nil {
+		writeError(w, apierrors.NewInternalError(fmt.Errorf("error dialing backend: %v", err)))
+		return
+	}
+	defer conn.Close()
+
+	tun, _, err := konnectivity.Connect(conn, net.JoinHostPort(p.obj.Status.HostIP, kubeletPort), dialTimeout)
+	if err != nil {
+		writeError(w, apierrors.NewInternalError(fmt.Errorf("error dialing backend: %v", err)))
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.URL = &url.URL{Path: path, RawQuery: r.URL.RawQuery}
+	out.Host = net.JoinHostPort(p.obj.Status.HostIP, kubeletPort)
+	out.RequestURI = ""
+	out.Header.Del("Authorization")
+
+	if httpstream.IsUpgradeRequest(r) {
+		a.splice(w, out, tun)
+		return
+	}
+
+	if err := out.Write(tun); err != nil {
+		writeError(w, apierrors.NewInternalError(fmt.Errorf("error sending to backend: %v", err)))
+		return
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(tun), out)
+	if err != nil {
+		writeError(w, apierrors.NewInternalError(fmt.Errorf("error reading from backend: %v", err)))
+		return
+	}
+	defer resp.Body.Close()
+
+	// Stop streaming once the client went away.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			tun.Close()
+		case <-done:
+		}
+	}()
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// splice hands the connection of the client over to the kubelet once the
+// upgrade request was sent, like the kube-apiserver does.
+func (a *apiserver) splice(w http.ResponseWriter, out *http.Request, tun net.Conn) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, apierrors.NewInternalError(fmt.Errorf("connection does not support upgrades")))
+		return
+	}
+
+	if err := out.Write(tun); err != nil {
+		writeError(w, apierrors.NewInternalError(fmt.Errorf("error sending to backend: %v", err)))
+		return
+	}
+
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(tun, buffered)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, tun)
+		done <- struct{}{}
+	}()
+
+	// Once a direction is done the connection is of no use to the other.
+	<-done
+}
+
+func success() *metav1.Status {
+	return &metav1.Status{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Status"},
+		Status:   metav1.StatusSuccess,
+	}
+}
+
+func writeObject(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status, ok := err.(apierrors.APIStatus)
+	if !ok {
+		status = apierrors.NewInternalError(err)
+	}
+
+	s := status.Status()
+	s.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Status"}
+	writeObject(w, int(s.Code), &s)
+}
@@ -0,0 +1,407 @@
+package devenv
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	logLines     = 1000
+	podAlphabet  = "bcdfghjklmnpqrstvwxz2456789"
+	subscription = 256
+)
+
+var (
+	podsResource        = schema.GroupResource{Resource: "pods"}
+	deploymentsResource = schema.GroupResource{Group: "apps", Resource: "deployments"}
+)
+
+// cluster holds the objects of the fake kube-apiserver. Pods are running as
+// soon as they are created and are replaced when deleted, as long as their
+// Deployment exists.
+type cluster struct {
+	net *network
+
+	mu          sync.Mutex
+	nodes       []corev1.Node
+	deployments map[string]*appsv1.Deployment
+	pods        map[string]*pod
+	nextNode    int
+	nextIP      int
+}
+
+func newCluster(n *network, nodes int) *cluster {
+	c := &cluster{
+		net:         n,
+		deployments: map[string]*appsv1.Deployment{},
+		pods:        map[string]*pod{},
+	}
+
+	for i := 1; i <= nodes; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		c.nodes = append(c.nodes, corev1.Node{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Node"},
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("dev-node-%d", i), UID: types.UID(fmt.Sprintf("dev-node-%d", i))},
+			Status: corev1.NodeStatus{
+				Addresses:  []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}},
+				Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+			},
+		})
+		n.up(ip, kubeletPort)
+	}
+
+	return c
+}
+
+func key(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// pod is a pod of the fake cluster with its main process.
+type pod struct {
+	obj corev1.Pod
+	// out is the output of the main process, which is what its logs show.
+	// Whatever is attached to the stdin of the main process is echoed to
+	// it, like the cat of the echo pods does.
+	out *output
+	// stopped is closed when the pod is deleted.
+	stopped chan struct{}
+}
+
+func (c *cluster) listNodes() *corev1.NodeList {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return &corev1.NodeList{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "NodeList"},
+		Items:    append([]corev1.Node(nil), c.nodes...),
+	}
+}
+
+func (c *cluster) createDeployment(d *appsv1.Deployment) (*appsv1.Deployment, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := key(d.Namespace, d.Name)
+	if _, ok := c.deployments[k]; ok {
+		return nil, apierrors.NewAlreadyExists(deploymentsResource, d.Name)
+	}
+
+	d = d.DeepCopy()
+	d.TypeMeta = metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"}
+	d.UID = types.UID(fmt.Sprintf("%s-%d", d.Name, time.Now().UnixNano()))
+	d.CreationTimestamp = metav1.Now()
+	c.deployments[k] = d
+
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+
+	for i := int32(0); i < replicas; i++ {
+		c.createPod(d)
+	}
+
+	d.Status.Replicas = replicas
+	d.Status.ReadyReplicas = replicas
+	d.Status.AvailableReplicas = replicas
+
+	return d, nil
+}
+
+func (c *cluster) getDeployment(namespace, name string) (*appsv1.Deployment, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d, ok := c.deployments[key(namespace, name)]
+	if !ok {
+		return nil, apierrors.NewNotFound(deploymentsResource, name)
+	}
+
+	return d, nil
+}
+
+func (c *cluster) listDeployments(namespace string) *appsv1.DeploymentList {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list := &appsv1.DeploymentList{TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "DeploymentList"}}
+	for _, d := range c.deployments {
+		if namespace == "" || d.Namespace == namespace {
+			list.Items = append(list.Items, *d)
+		}
+	}
+
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+
+	return list
+}
+
+// deleteDeployment deletes the Deployment and its pods.
+func (c *cluster) deleteDeployment(namespace, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := key(namespace, name)
+	d, ok := c.deployments[k]
+	if !ok {
+		return apierrors.NewNotFound(deploymentsResource, name)
+	}
+	delete(c.deployments, k)
+
+	for _, p := range c.pods {
+		if owned(p, d) {
+			c.deletePod(p)
+		}
+	}
+
+	return nil
+}
+
+func owned(p *pod, d *appsv1.Deployment) bool {
+	for _, ref := range p.obj.OwnerReferences {
+		if ref.UID == d.UID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// createPod creates a running pod of the Deployment on the next node.
+// c.mu must be held.
+func (c *cluster) createPod(d *appsv1.Deployment) *pod {
+	node := c.nodes[c.nextNode%len(c.nodes)]
+	c.nextNode++
+
+	c.nextIP++
+	ip := fmt.Sprintf("10.244.%d.%d", c.nextIP/250, c.nextIP%250+1)
+
+	name := d.Name + "-"
+	for i := 0; i < 5; i++ {
+		name += string(podAlphabet[rand.Intn(len(podAlphabet))])
+	}
+
+	now := metav1.Now()
+	obj := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         d.Namespace,
+			UID:               types.UID(fmt.Sprintf("%s-%d", name, now.UnixNano())),
+			Labels:            d.Spec.Template.Labels,
+			CreationTimestamp: now,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       d.Name,
+				UID:        d.UID,
+			}},
+		},
+		Spec: *d.Spec.Template.Spec.DeepCopy(),
+		Status: corev1.PodStatus{
+			Phase:     corev1.PodRunning,
+			HostIP:    node.Status.Addresses[0].Address,
+			PodIP:     ip,
+			PodIPs:    []corev1.PodIP{{IP: ip}},
+			StartTime: &now,
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+			},
+		},
+	}
+	obj.Spec.NodeName = node.Name
+
+	for _, container := range obj.Spec.Containers {
+		obj.Status.ContainerStatuses = append(obj.Status.ContainerStatuses, corev1.ContainerStatus{
+			Name:  container.Name,
+			Image: container.Image,
+			Ready: true,
+			State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{StartedAt: now}},
+		})
+	}
+
+	p := &pod{obj: obj, out: newOutput(), stopped: make(chan struct{})}
+	fmt.Fprintf(p.out, "%s started on %s\n", name, node.Name)
+
+	c.pods[key(obj.Namespace, obj.Name)] = p
+	c.net.up(ip, podPort)
+
+	return p
+}
+
+func (c *cluster) getPod(namespace, name string) (*pod, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pods[key(namespace, name)]
+	if !ok {
+		return nil, apierrors.NewNotFound(podsResource, name)
+	}
+
+	return p, nil
+}
+
+// listPods lists the pods of the namespace, or of all namespaces, matching
+// the label and field selectors.
+func (c *cluster) listPods(namespace, labelSelector, fieldSelector string) (*corev1.PodList, error) {
+	ls, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("parsing label selector: %v", err))
+	}
+
+	fs, err := fields.ParseSelector(fieldSelector)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("parsing field selector: %v", err))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list := &corev1.PodList{TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PodList"}}
+	for _, p := range c.pods {
+		if namespace != "" && p.obj.Namespace != namespace {
+			continue
+		}
+
+		podFields := fields.Set{
+			"metadata.name":      p.obj.Name,
+			"metadata.namespace": p.obj.Namespace,
+			"spec.nodeName":      p.obj.Spec.NodeName,
+			"status.phase":       string(p.obj.Status.Phase),
+		}
+		if ls.Matches(labels.Set(p.obj.Labels)) && fs.Matches(podFields) {
+			list.Items = append(list.Items, p.obj)
+		}
+	}
+
+	sort.Slice(list.Items, func(i, j int) bool {
+		return key(list.Items[i].Namespace, list.Items[i].Name) < key(list.Items[j].Namespace, list.Items[j].Name)
+	})
+
+	return list, nil
+}
+
+// removePod deletes the pod, which is replaced when its Deployment still
+// exists.
+func (c *cluster) removePod(namespace, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pods[key(namespace, name)]
+	if !ok {
+		return apierrors.NewNotFound(podsResource, name)
+	}
+
+	c.deletePod(p)
+
+	for _, d := range c.deployments {
+		if owned(p, d) {
+			c.createPod(d)
+		}
+	}
+
+	return nil
+}
+
+// deletePod stops the pod, ending every session to it. c.mu must be held.
+func (c *cluster) deletePod(p *pod) {
+	delete(c.pods, key(p.obj.Namespace, p.obj.Name))
+	c.net.down(p.obj.Status.PodIP, podPort)
+	close(p.stopped)
+}
+
+// output is the output of the main process of a pod. It keeps the last
+// lines for the logs and fans out everything written to the subscribers.
+type output struct {
+	mu      sync.Mutex
+	lines   []logLine
+	partial string
+	subs    map[chan []byte]struct{}
+}
+
+type logLine struct {
+	at   time.Time
+	text string
+}
+
+func newOutput() *output {
+	return &output{subs: map[chan []byte]struct{}{}}
+}
+
+func (o *output) Write(b []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	text := o.partial + string(b)
+	for {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			break
+		}
+
+		o.lines = append(o.lines, logLine{at: now, text: text[:i+1]})
+		text = text[i+1:]
+	}
+	o.partial = text
+
+	if len(o.lines) > logLines {
+		o.lines = o.lines[len(o.lines)-logLines:]
+	}
+
+	data := append([]byte(nil), b...)
+	for ch := range o.subs {
+		// Subscribers not keeping up miss output rather than blocking the
+		// process.
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+
+	return len(b), nil
+}
+
+// subscribe returns the lines written since the time, at most tail of them
+// unless tail is negative, and subscribes to everything written afterwards.
+func (o *output) subscribe(since time.Time, tail int) ([]string, chan []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var lines []string
+	for _, l := range o.lines {
+		if !l.at.Before(since) {
+			lines = append(lines, l.text)
+		}
+	}
+
+	if tail >= 0 && len(lines) > tail {
+		lines = lines[len(lines)-tail:]
+	}
+
+	ch := make(chan []byte, subscription)
+	o.subs[ch] = struct{}{}
+
+	return lines, ch
+}
+
+func (o *output) unsubscribe(ch chan []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.subs, ch)
+}
@@ -0,0 +1,282 @@
+package devenv
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ipochi/konnscen/pkg/faultproxy"
+	"github.com/ipochi/konnscen/pkg/konnectivity"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/client-go/util/cert"
+)
+
+const (
+	listenAddress = "127.0.0.1:0"
+	nodes         = 3
+	kubeletPort   = "10250"
+	podPort       = "8080"
+)
+
+// Config of the development environment, which stands in for a cluster
+// with Konnectivity so scenarios can be developed without one.
+//
+// A fake kube-apiserver serves the Deployments, pods and nodes konnscen
+// creates and lists, and proxies pods/log, pods/exec, pods/attach and
+// pods/portforward to stand-in kubelets. It reaches them through an
+// in-process CONNECT relay playing the Konnectivity Server, which injects
+// the faults into the relayed connections. Only the spdy transport is
+// served, WebSocket upgrades are rejected with 400.
+type Config struct {
+	// ListenAddress of the fake kube-apiserver.
+	ListenAddress string `yaml:"listen_address"`
+	// Dir is where the kubeconfig and the socket of the relay are written,
+	// a temporary directory by default.
+	Dir   string `yaml:"dir"`
+	Nodes int    `yaml:"nodes"`
+	// DialErrorProbability is the chance the relay answers a CONNECT with
+	// 503 instead of dialing.
+	DialErrorProbability float64 `yaml:"dial_error_probability"`
+	// Faults injected into every relayed connection. A reset_probability
+	// drops connections.
+	Faults   faultproxy.Faults   `yaml:"faults"`
+	Schedule []faultproxy.Window `yaml:"schedule"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		ListenAddress: listenAddress,
+		Nodes:         nodes,
+	}
+}
+
+// Env is a running development environment.
+type Env struct {
+	// Kubeconfig is the path of a kubeconfig for the fake kube-apiserver.
+	Kubeconfig string
+	// RelaySocket is the unix socket of the relay, which can be used as
+	// the egress of the http-connect scenario.
+	RelaySocket string
+
+	// tempDir is removed on Close when the directory was created by Start.
+	tempDir   string
+	cluster   *cluster
+	relay     *relay
+	apiserver *http.Server
+	kubelet   *http.Server
+	pods      *http.Server
+}
+
+// Start starts the development environment.
+func Start(cfg *Config) (*Env, error) {
+	e := &Env{}
+
+	dir := cfg.Dir
+	if dir == "" {
+		var err error
+		if dir, err = ioutil.TempDir("", "konnscen-dev-env-"); err != nil {
+			return nil, fmt.Errorf("creating directory: %v", err)
+		}
+		e.tempDir = dir
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating directory: %v", err)
+	}
+
+	e.Kubeconfig = filepath.Join(dir, "kubeconfig")
+	e.RelaySocket = filepath.Join(dir, "relay.sock")
+
+	n := newNetwork()
+	e.cluster = newCluster(n, cfg.Nodes)
+
+	e.pods = &http.Server{Handler: http.HandlerFunc(servePod)}
+	go e.pods.Serve(n.listen(podPort))
+
+	e.kubelet = &http.Server{Handler: &kubelet{cluster: e.cluster, net: n}}
+	go e.kubelet.Serve(n.listen(kubeletPort))
+
+	var err error
+	e.relay, err = startRelay(e.RelaySocket, n, cfg)
+	if err != nil {
+		e.Close()
+		return nil, err
+	}
+
+	if err := e.startAPIServer(cfg.ListenAddress); err != nil {
+		e.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// startAPIServer serves the fake kube-apiserver over TLS with a self-signed
+// certificate and writes a kubeconfig trusting it.
+func (e *Env) startAPIServer(address string) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %v", address, err)
+	}
+
+	host, _, _ := net.SplitHostPort(ln.Addr().String())
+	crt, key, err := cert.GenerateSelfSignedCertKey(host, nil, nil)
+	if err != nil {
+		ln.Close()
+		return fmt.Errorf("generating certificate: %v", err)
+	}
+
+	pair, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		ln.Close()
+		return fmt.Errorf("loading certificate: %v", err)
+	}
+
+	e.apiserver = &http.Server{Handler: &apiserver{
+		cluster: e.cluster,
+		egress:  konnectivity.Egress{UDSName: e.RelaySocket},
+	}}
+	go e.apiserver.Serve(tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{pair}}))
+
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.Clusters["dev-env"] = clientcmdapi.NewCluster()
+	kubeconfig.Clusters["dev-env"].Server = "https://" + ln.Addr().String()
+	kubeconfig.Clusters["dev-env"].CertificateAuthorityData = crt
+	kubeconfig.AuthInfos["dev-env"] = clientcmdapi.NewAuthInfo()
+	kubeconfig.Contexts["dev-env"] = clientcmdapi.NewContext()
+	kubeconfig.Contexts["dev-env"].Cluster = "dev-env"
+	kubeconfig.Contexts["dev-env"].AuthInfo = "dev-env"
+	kubeconfig.CurrentContext = "dev-env"
+
+	if err := clientcmd.WriteToFile(*kubeconfig, e.Kubeconfig); err != nil {
+		return fmt.Errorf("writing kubeconfig: %v", err)
+	}
+
+	return nil
+}
+
+// Close stops the development environment and removes its kubeconfig and
+// socket.
+func (e *Env) Close() error {
+	if e.apiserver != nil {
+		e.apiserver.Close()
+	}
+	if e.relay != nil {
+		e.relay.Close()
+	}
+
+	e.kubelet.Close()
+	e.pods.Close()
+
+	os.Remove(e.Kubeconfig)
+	os.Remove(e.RelaySocket)
+	if e.tempDir != "" {
+		os.RemoveAll(e.tempDir)
+	}
+
+	return nil
+}
+
+// network connects the relay to the kubelets and the kubelets to the pods
+// in-process. The kubelet port of every node IP is served by the kubelet
+// listener and the pod port of every pod IP by the pod listener.
+type network struct {
+	mu        sync.Mutex
+	listeners map[string]*pipeListener
+	addresses map[string]bool
+}
+
+func newNetwork() *network {
+	return &network{
+		listeners: map[string]*pipeListener{},
+		addresses: map[string]bool{},
+	}
+}
+
+// listen returns the listener for the port on every host.
+func (n *network) listen(port string) net.Listener {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ln := &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+	n.listeners[port] = ln
+
+	return ln
+}
+
+// up makes the listener of the port accept connections to the IP.
+func (n *network) up(ip, port string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.addresses[net.JoinHostPort(ip, port)] = true
+}
+
+func (n *network) down(ip, port string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.addresses, net.JoinHostPort(ip, port))
+}
+
+func (n *network) dial(address string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	ln, ok := n.listeners[port]
+	ok = ok && n.addresses[address]
+	n.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("dial tcp %s: connect: connection refused", address)
+	}
+
+	client, server := net.Pipe()
+	select {
+	case ln.conns <- server:
+		return client, nil
+	case <-ln.done:
+		return nil, fmt.Errorf("dial tcp %s: connect: connection refused", address)
+	}
+}
+
+// pipeListener accepts the in-process connections dialed on a network.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,211 @@
+package devenv_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ipochi/konnscen/pkg/devenv"
+	"github.com/ipochi/konnscen/pkg/load"
+	conportforwards "github.com/ipochi/konnscen/pkg/scenarios/concurrent-portforwards"
+	dialstorm "github.com/ipochi/konnscen/pkg/scenarios/dial-storm"
+)
+
+const (
+	burstSize = 3
+	tunnels   = 5
+	startPort = 43100
+)
+
+// startEnv starts a dev-env the clients use for the rest of the test.
+func startEnv(t *testing.T) {
+	t.Helper()
+
+	cfg := devenv.NewConfig()
+	cfg.Dir = t.TempDir()
+
+	env, err := devenv.Start(cfg)
+	if err != nil {
+		t.Fatalf("starting dev-env: %v", err)
+	}
+	t.Cleanup(func() { env.Close() })
+
+	t.Setenv("KUBECONFIG", env.Kubeconfig)
+}
+
+// captureStdout returns what run wrote to stdout, where scenarios report.
+func captureStdout(t *testing.T, run func() error) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("creating pipe: %v", err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		out <- buf.String()
+	}()
+
+	err = run()
+	w.Close()
+	report := <-out
+
+	if err != nil {
+		t.Fatalf("running scenario: %v\n%s", err, report)
+	}
+
+	return report
+}
+
+// TestDialStorm runs a burst of every streaming kind through the relay.
+func TestDialStorm(t *testing.T) {
+	for _, kind := range []string{"logs", "exec", "portforward"} {
+		kind := kind
+		t.Run(kind, func(t *testing.T) {
+			startEnv(t)
+
+			d := dialstorm.NewDialStorm()
+			d.BurstSizes = []int{burstSize}
+			d.Kinds = []string{kind}
+			d.Transport = "spdy"
+
+			report := captureStdout(t, d.Run)
+
+			if !strings.Contains(report, fmt.Sprintf("/%s: requests=%d ", kind, burstSize)) {
+				t.Errorf("got no report of %d %s requests:\n%s", burstSize, kind, report)
+			}
+
+			if strings.Contains(report, "failures[") {
+				t.Errorf("got failed %s requests:\n%s", kind, report)
+			}
+		})
+	}
+}
+
+// TestDialStormLoad sends requests from users following a load profile and
+// reports them per load level.
+func TestDialStormLoad(t *testing.T) {
+	startEnv(t)
+
+	d := dialstorm.NewDialStorm()
+	d.Kinds = []string{"logs"}
+	d.Transport = "spdy"
+	d.Load = &load.Profile{Shape: load.ShapeSteps, Steps: []int{1, 2}, StepSeconds: 2}
+
+	report := captureStdout(t, d.Run)
+
+	for _, level := range d.Load.Steps {
+		if !strings.Contains(report, fmt.Sprintf("users-%04d/http/logs: requests=", level)) {
+			t.Errorf("got no report of logs requests at %d users:\n%s", level, report)
+		}
+	}
+
+	if strings.Contains(report, "burst-") {
+		t.Errorf("got bursts released under a load profile:\n%s", report)
+	}
+
+	if strings.Contains(report, "failures[") {
+		t.Errorf("got failed requests:\n%s", report)
+	}
+}
+
+// TestPortForwardPayload transfers checksummed payloads through every
+// tunnel.
+func TestPortForwardPayload(t *testing.T) {
+	startEnv(t)
+
+	c := conportforwards.NewConcurrentPortForwards()
+	c.NumberOfConcurrentPortForwards = tunnels
+	c.StartPort = startPort
+	c.Transport = "spdy"
+	c.Payload = &conportforwards.Payload{SizeBytes: 64 << 10, Transfers: 2}
+
+	report := captureStdout(t, c.Run)
+
+	for i := 0; i < tunnels; i++ {
+		for _, direction := range []string{"upload", "download"} {
+			group := fmt.Sprintf("spdy/tunnel-%d/%s: requests=2 ", startPort+i, direction)
+			if !strings.Contains(report, group) {
+				t.Errorf("got no report of 2 %ss through tunnel %d:\n%s", direction, startPort+i, report)
+			}
+		}
+	}
+
+	if strings.Contains(report, "failures[") {
+		t.Errorf("got failed transfers:\n%s", report)
+	}
+}
+
+// TestPortForwardMatrix runs shapes one after the other on the same ports.
+func TestPortForwardMatrix(t *testing.T) {
+	startEnv(t)
+
+	c := conportforwards.NewConcurrentPortForwards()
+	c.StartPort = startPort
+	c.KeepConnectedForSeconds = 2
+	c.Transport = "spdy"
+	c.ConnectionMatrix = []conportforwards.Shape{
+		{Tunnels: 1, Connections: 3},
+		{Tunnels: 3, Connections: 1},
+	}
+
+	report := captureStdout(t, c.Run)
+
+	for _, shape := range c.ConnectionMatrix {
+		if !strings.Contains(report, fmt.Sprintf("spdy/shape-%s: requests=", shape)) {
+			t.Errorf("got no report of shape %s:\n%s", shape, report)
+		}
+	}
+
+	if strings.Contains(report, "failures[") {
+		t.Errorf("got failed requests:\n%s", report)
+	}
+}
+
+// TestPortForwardTraffic generates a traffic profile through every tunnel.
+func TestPortForwardTraffic(t *testing.T) {
+	startEnv(t)
+
+	c := conportforwards.NewConcurrentPortForwards()
+	c.NumberOfConcurrentPortForwards = 2
+	c.StartPort = startPort
+	c.Transport = "spdy"
+	c.TrafficProfiles = []*conportforwards.Traffic{{
+		Name:              "mixed",
+		RequestsPerSecond: 20,
+		Concurrency:       2,
+		KeepAlive:         true,
+		Requests: []conportforwards.TrafficRequest{
+			{Method: "GET", Path: "/", ExpectedStatus: []int{200}},
+			{Method: "POST", Path: "/", BodyBytes: 1024, ExpectedStatus: []int{200}},
+		},
+	}}
+
+	if err := c.Run(); err == nil {
+		t.Errorf("running traffic without keep_connected_for_seconds succeeded, want an error")
+	}
+
+	c.KeepConnectedForSeconds = 2
+	report := captureStdout(t, c.Run)
+
+	for i := 0; i < c.NumberOfConcurrentPortForwards; i++ {
+		group := fmt.Sprintf("spdy/tunnel-%d/mixed: requests=", startPort+i)
+		if !strings.Contains(report, group) {
+			t.Errorf("got no report of the traffic through tunnel %d:\n%s", startPort+i, report)
+		}
+	}
+
+	if strings.Contains(report, "failures[") {
+		t.Errorf("got failed requests:\n%s", report)
+	}
+}
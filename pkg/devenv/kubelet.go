@@ -0,0 +1,357 @@
+package devenv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/apimachinery/pkg/util/remotecommand"
+	remotecommandclient "k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	portForwardProtocol = "portforward.k8s.io"
+	streamTimeout       = 30 * time.Second
+)
+
+// kubelet stands in for the kubelets of every node, serving the streaming
+// endpoints the kube-apiserver proxies pods/log, pods/exec, pods/attach and
+// pods/portforward to. Only SPDY is spoken.
+type kubelet struct {
+	cluster *cluster
+	net     *network
+}
+
+func (k *kubelet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 3 {
+		http.NotFound(w, r)
+		return
+	}
+
+	p, err := k.cluster.getPod(parts[1], parts[2])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch parts[0] {
+	case "containerLogs":
+		k.logs(w, r, p)
+	case "exec":
+		k.remoteCommand(w, r, p, func(s *streams) error {
+			return p.run(r.URL.Query()["command"], s)
+		})
+	case "attach":
+		k.remoteCommand(w, r, p, p.attach)
+	case "portForward":
+		k.portForward(w, r, p)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// logs writes the output of the main process of the pod, following it
+// until the client goes away or the pod is deleted.
+func (k *kubelet) logs(w http.ResponseWriter, r *http.Request, p *pod) {
+	query := r.URL.Query()
+
+	var since time.Time
+	if s, err := strconv.Atoi(query.Get("sinceSeconds")); err == nil {
+		since = time.Now().Add(-time.Duration(s) * time.Second)
+	}
+
+	tail := -1
+	if t, err := strconv.Atoi(query.Get("tailLines")); err == nil {
+		tail = t
+	}
+
+	lines, ch := p.out.subscribe(since, tail)
+	defer p.out.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/plain")
+	for _, line := range lines {
+		io.WriteString(w, line)
+	}
+
+	if query.Get("follow") != "true" {
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case b := <-ch:
+			if _, err := w.Write(b); err != nil {
+				return
+			}
+		case <-p.stopped:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// streams of a remote command. Streams the client did not ask for read
+// nothing and discard what is written.
+type streams struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	tty    bool
+	// done is closed when the session ends.
+	done <-chan struct{}
+
+	mu   sync.Mutex
+	size remotecommandclient.TerminalSize
+}
+
+func (s *streams) terminalSize() remotecommandclient.TerminalSize {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+// exitError is returned by commands exiting with a non-zero code.
+type exitError int
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("command terminated with non-zero exit code: %d", int(e))
+}
+
+// remoteCommand serves exec and attach like the kubelet does: it accepts
+// the streams the client asked for over SPDY, runs the command on them and
+// reports how it ended on the error stream.
+func (k *kubelet) remoteCommand(w http.ResponseWriter, r *http.Request, p *pod, run func(s *streams) error) {
+	protocol, err := httpstream.Handshake(r, w, remotecommand.SupportedStreamingProtocols)
+	if err != nil {
+		return
+	}
+
+	query := r.URL.Query()
+	stdin, stdout := query.Get("stdin") == "true", query.Get("stdout") == "true"
+	tty := query.Get("tty") == "true"
+	stderr := query.Get("stderr") == "true" && !tty
+
+	expected := 1
+	for _, b := range []bool{stdin, stdout, stderr, tty && protocol != remotecommand.StreamProtocolV1Name && protocol != remotecommand.StreamProtocolV2Name} {
+		if b {
+			expected++
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	streamCh := make(chan httpstream.Stream, expected)
+	conn := spdy.NewResponseUpgrader().UpgradeResponse(w, r, func(stream httpstream.Stream, replySent <-chan struct{}) error {
+		select {
+		case streamCh <- stream:
+		case <-done:
+		}
+		return nil
+	})
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	received := map[string]httpstream.Stream{}
+	timeout := time.NewTimer(streamTimeout)
+	defer timeout.Stop()
+	for len(received) < expected {
+		select {
+		case stream := <-streamCh:
+			received[stream.Headers().Get(corev1.StreamType)] = stream
+		case <-timeout.C:
+			return
+		case <-conn.CloseChan():
+			return
+		}
+	}
+
+	errStream := received[corev1.StreamTypeError]
+	if errStream == nil {
+		return
+	}
+	defer errStream.Close()
+
+	s := &streams{stdin: strings.NewReader(""), stdout: ioutil.Discard, stderr: ioutil.Discard, tty: tty, done: done}
+	if stream := received[corev1.StreamTypeStdin]; stream != nil {
+		s.stdin = stream
+	}
+	if stream := received[corev1.StreamTypeStdout]; stream != nil {
+		s.stdout = stream
+		defer stream.Close()
+	}
+	if stream := received[corev1.StreamTypeStderr]; stream != nil {
+		s.stderr = stream
+		defer stream.Close()
+	}
+	if stream := received[corev1.StreamTypeResize]; stream != nil {
+		go func() {
+			decoder := json.NewDecoder(stream)
+			for {
+				var size remotecommandclient.TerminalSize
+				if err := decoder.Decode(&size); err != nil {
+					return
+				}
+
+				s.mu.Lock()
+				s.size = size
+				s.mu.Unlock()
+			}
+		}()
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- run(s)
+	}()
+
+	select {
+	case err = <-result:
+	case <-p.stopped:
+		// The container is gone, and so is the session.
+		return
+	case <-conn.CloseChan():
+		return
+	}
+
+	writeExitStatus(errStream, protocol, err)
+}
+
+// writeExitStatus writes how the command ended to the error stream, as a
+// Status from v4 on and as plain text before.
+func writeExitStatus(stream io.Writer, protocol string, err error) {
+	if protocol != remotecommand.StreamProtocolV4Name {
+		if err != nil {
+			io.WriteString(stream, err.Error())
+		}
+		return
+	}
+
+	status := metav1.Status{Status: metav1.StatusSuccess}
+	if code, ok := err.(exitError); ok {
+		status = metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  remotecommand.NonZeroExitCodeReason,
+			Message: err.Error(),
+			Details: &metav1.StatusDetails{
+				Causes: []metav1.StatusCause{{Type: remotecommand.ExitCodeCauseType, Message: strconv.Itoa(int(code))}},
+			},
+		}
+	} else if err != nil {
+		status = metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}
+	}
+
+	json.NewEncoder(stream).Encode(status)
+}
+
+// portForward serves port-forwards like the kubelet does: every pair of a
+// data and an error stream with the same request ID is a connection to a
+// port of the pod.
+func (k *kubelet) portForward(w http.ResponseWriter, r *http.Request, p *pod) {
+	if _, err := httpstream.Handshake(r, w, []string{portForwardProtocol}); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	streamCh := make(chan httpstream.Stream, 16)
+	conn := spdy.NewResponseUpgrader().UpgradeResponse(w, r, func(stream httpstream.Stream, replySent <-chan struct{}) error {
+		select {
+		case streamCh <- stream:
+		case <-done:
+		}
+		return nil
+	})
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	type pair struct {
+		data, err httpstream.Stream
+	}
+	pairs := map[string]*pair{}
+
+	for {
+		select {
+		case stream := <-streamCh:
+			id := stream.Headers().Get(corev1.PortForwardRequestIDHeader)
+			pr, ok := pairs[id]
+			if !ok {
+				pr = &pair{}
+				pairs[id] = pr
+			}
+
+			switch stream.Headers().Get(corev1.StreamType) {
+			case corev1.StreamTypeData:
+				pr.data = stream
+			case corev1.StreamTypeError:
+				pr.err = stream
+			default:
+				stream.Reset()
+				continue
+			}
+
+			if pr.data != nil && pr.err != nil {
+				delete(pairs, id)
+				go k.forward(p, pr.data, pr.err)
+			}
+		case <-p.stopped:
+			return
+		case <-conn.CloseChan():
+			return
+		}
+	}
+}
+
+// forward copies between the data stream and a connection to the port of
+// the pod named in its headers.
+func (k *kubelet) forward(p *pod, data, errStream httpstream.Stream) {
+	defer errStream.Close()
+	defer data.Close()
+
+	port := data.Headers().Get(corev1.PortHeader)
+	conn, err := k.net.dial(net.JoinHostPort(p.obj.Status.PodIP, port))
+	if err != nil {
+		fmt.Fprintf(errStream, "error forwarding port %s to pod %s: %v", port, p.obj.Name, err)
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn, data)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(data, conn)
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+	case <-p.stopped:
+	}
+}
@@ -0,0 +1,536 @@
+package devenv
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	block = 64 * 1024
+
+	nginxPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>Welcome to nginx!</title>
+</head>
+<body>
+<h1>Welcome to nginx!</h1>
+</body>
+</html>
+`
+)
+
+// servePod serves port 8080 of every pod. It speaks the protocol of the
+// checksum pods, streaming payloads of the requested size on GET and
+// returning the SHA-256 of the received body on POST, and otherwise answers
+// like nginx.
+func servePod(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost:
+		sum := sha256.New()
+		n, _ := io.Copy(sum, r.Body)
+		fmt.Fprintf(w, "%s %d", hex.EncodeToString(sum.Sum(nil)), n)
+	case r.URL.Query().Get("size") != "":
+		size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+		if err != nil || size < 0 {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+
+		b := make([]byte, block)
+		rand.Read(b)
+
+		sum := sha256.New()
+		for n := size; n > 0; n -= block {
+			sum.Write(b[:min(n, block)])
+		}
+
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.Header().Set("X-Sha256", hex.EncodeToString(sum.Sum(nil)))
+		for n := size; n > 0; n -= block {
+			if _, err := w.Write(b[:min(n, block)]); err != nil {
+				return
+			}
+		}
+	default:
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, nginxPage)
+	}
+}
+
+func min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// attach attaches the streams to the main process of the pod, which is a
+// cat: stdin is written to its output and its output to stdout.
+func (p *pod) attach(s *streams) error {
+	_, ch := p.out.subscribe(time.Now(), 0)
+	defer p.out.unsubscribe(ch)
+
+	go io.Copy(p.out, s.stdin)
+
+	for {
+		select {
+		case b := <-ch:
+			if _, err := s.stdout.Write(b); err != nil {
+				return nil
+			}
+		case <-s.done:
+			return nil
+		case <-p.stopped:
+			return nil
+		}
+	}
+}
+
+// run execs the command in the pod. The pods have no processes to exec, so
+// a small shell stands in for the commands konnscen runs: cat, echo,
+// sleep, stty size, tr, true, false and sh, the latter running scripts of
+// them chained with ;, && and | and redirected with >, with quotes and
+// $(...). Anything else, tar among them, is not found.
+func (p *pod) run(command []string, s *streams) error {
+	if len(command) == 0 {
+		return errors.New("no command given")
+	}
+
+	stderr := s.stderr
+	if s.tty {
+		// A terminal has a single output.
+		stderr = s.stdout
+	}
+
+	sh := &shell{pod: p, streams: s, stderr: stderr}
+	err := sh.command(command, s.stdin, s.stdout)
+	if code, ok := err.(exitShell); ok {
+		if code == 0 {
+			return nil
+		}
+		return exitError(code)
+	}
+
+	return err
+}
+
+// exitShell is returned by exit to end the shell running it.
+type exitShell int
+
+func (e exitShell) Error() string {
+	return fmt.Sprintf("exit %d", int(e))
+}
+
+type shell struct {
+	pod     *pod
+	streams *streams
+	stderr  io.Writer
+}
+
+// command runs a single command with its arguments.
+func (sh *shell) command(args []string, stdin io.Reader, stdout io.Writer) error {
+	switch args[0] {
+	case "true":
+		return nil
+	case "false":
+		return exitError(1)
+	case "echo":
+		args = args[1:]
+		newline := "\n"
+		if len(args) > 0 && args[0] == "-n" {
+			args, newline = args[1:], ""
+		}
+
+		_, err := io.WriteString(stdout, strings.Join(args, " ")+newline)
+		return err
+	case "cat":
+		_, err := io.Copy(stdout, stdin)
+		return err
+	case "sleep":
+		if len(args) != 2 {
+			fmt.Fprintln(sh.stderr, "sleep: missing operand")
+			return exitError(1)
+		}
+
+		seconds, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			fmt.Fprintf(sh.stderr, "sleep: invalid number '%s'\n", args[1])
+			return exitError(1)
+		}
+
+		select {
+		case <-time.After(time.Duration(seconds * float64(time.Second))):
+		case <-sh.streams.done:
+		case <-sh.pod.stopped:
+		}
+		return nil
+	case "stty":
+		if len(args) != 2 || args[1] != "size" {
+			fmt.Fprintln(sh.stderr, "stty: only size is supported")
+			return exitError(1)
+		}
+
+		if !sh.streams.tty {
+			fmt.Fprintln(sh.stderr, "stty: standard input: Not a tty")
+			return exitError(1)
+		}
+
+		size := sh.streams.terminalSize()
+		_, err := fmt.Fprintf(stdout, "%d %d\n", size.Height, size.Width)
+		return err
+	case "tr":
+		if len(args) != 3 {
+			fmt.Fprintln(sh.stderr, "tr: missing operand")
+			return exitError(1)
+		}
+
+		return tr(args[1], args[2], stdin, stdout)
+	case "exit":
+		code := 0
+		if len(args) > 1 {
+			code, _ = strconv.Atoi(args[1])
+		}
+		return exitShell(code)
+	case "sh":
+		if len(args) > 2 && args[1] == "-c" {
+			return sh.script(args[2], stdin, stdout)
+		}
+
+		return sh.interactive(stdin, stdout)
+	default:
+		fmt.Fprintf(sh.stderr, "sh: %s: not found\n", args[0])
+		return exitError(127)
+	}
+}
+
+// tr replaces every character of from with the one at the same position of
+// to, or the last one of to.
+func tr(from, to string, stdin io.Reader, stdout io.Writer) error {
+	if to == "" {
+		to = from
+	}
+
+	replacements := map[rune]rune{}
+	toRunes := []rune(to)
+	for i, r := range []rune(from) {
+		if i >= len(toRunes) {
+			i = len(toRunes) - 1
+		}
+		replacements[r] = toRunes[i]
+	}
+
+	br := bufio.NewReader(stdin)
+	bw := bufio.NewWriter(stdout)
+	for {
+		r, _, err := br.ReadRune()
+		if err != nil {
+			break
+		}
+
+		if replacement, ok := replacements[r]; ok {
+			r = replacement
+		}
+		bw.WriteRune(r)
+
+		if r == '\n' {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// interactive reads the stdin line by line and runs every line as a script,
+// echoing it first on a terminal.
+func (sh *shell) interactive(stdin io.Reader, stdout io.Writer) error {
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if sh.streams.tty {
+			if _, err := fmt.Fprintf(stdout, "%s\r\n", line); err != nil {
+				return nil
+			}
+		}
+
+		err := sh.script(line, strings.NewReader(""), stdout)
+		if _, ok := err.(exitShell); ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// script runs the commands of the script one after another, stopping at
+// the first failing one chained with &&.
+func (sh *shell) script(script string, stdin io.Reader, stdout io.Writer) error {
+	tokens, err := lex(script)
+	if err != nil {
+		fmt.Fprintf(sh.stderr, "sh: %v\n", err)
+		return exitError(2)
+	}
+
+	var pipeline []string
+	for i := 0; i <= len(tokens); i++ {
+		if i < len(tokens) && tokens[i] != ";" && tokens[i] != "&&" {
+			pipeline = append(pipeline, tokens[i])
+			continue
+		}
+
+		if len(pipeline) > 0 {
+			err = sh.pipeline(pipeline, stdin, stdout)
+			if _, ok := err.(exitShell); ok {
+				return err
+			}
+		}
+		pipeline = nil
+
+		if i < len(tokens) && tokens[i] == "&&" && err != nil {
+			// Skip to the next command not chained with &&.
+			for i < len(tokens) && tokens[i] != ";" {
+				i++
+			}
+			if i == len(tokens) {
+				return err
+			}
+		}
+	}
+
+	return err
+}
+
+// pipeline runs the commands of the pipeline concurrently, each reading
+// the output of the previous one.
+func (sh *shell) pipeline(tokens []string, stdin io.Reader, stdout io.Writer) error {
+	var commands [][]string
+	start := 0
+	for i := 0; i <= len(tokens); i++ {
+		if i == len(tokens) || tokens[i] == "|" {
+			commands = append(commands, tokens[start:i])
+			start = i + 1
+		}
+	}
+
+	errs := make(chan error, len(commands))
+	var last error
+	in := stdin
+	for i, command := range commands {
+		out := stdout
+		var pw *io.PipeWriter
+		var next *io.PipeReader
+		if i < len(commands)-1 {
+			next, pw = io.Pipe()
+			out = pw
+		}
+
+		run := func(command []string, in io.Reader, out io.Writer, pw *io.PipeWriter) error {
+			err := sh.redirected(command, in, out)
+			if pw != nil {
+				pw.Close()
+			}
+			if pr, ok := in.(*io.PipeReader); ok {
+				// Writers of the previous command are not left blocked.
+				pr.Close()
+			}
+			return err
+		}
+
+		if i == len(commands)-1 {
+			last = run(command, in, out, pw)
+		} else {
+			go func(command []string, in io.Reader, out io.Writer, pw *io.PipeWriter) {
+				errs <- run(command, in, out, pw)
+			}(command, in, out, pw)
+		}
+
+		in = next
+	}
+
+	for i := 0; i < len(commands)-1; i++ {
+		<-errs
+	}
+
+	return last
+}
+
+// redirected expands the words of the command and runs it with its output
+// redirected when it ends in > path.
+func (sh *shell) redirected(tokens []string, stdin io.Reader, stdout io.Writer) error {
+	var args []string
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i] != ">" {
+			word, err := sh.expand(tokens[i])
+			if err != nil {
+				return err
+			}
+			args = append(args, word)
+			continue
+		}
+
+		if i+1 == len(tokens) {
+			fmt.Fprintln(sh.stderr, "sh: syntax error: unexpected newline")
+			return exitError(2)
+		}
+
+		path, err := sh.expand(tokens[i+1])
+		if err != nil {
+			return err
+		}
+		i++
+
+		switch path {
+		case "/proc/1/fd/1", "/proc/1/fd/2":
+			stdout = sh.pod.out
+		case "/dev/null":
+			stdout = ioutil.Discard
+		default:
+			fmt.Fprintf(sh.stderr, "sh: can't create %s: Read-only file system\n", path)
+			return exitError(1)
+		}
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	return sh.command(args, stdin, stdout)
+}
+
+// expand removes the quotes of the word and substitutes the output of the
+// commands in $(...), without its trailing newlines.
+func (sh *shell) expand(word string) (string, error) {
+	var b strings.Builder
+	var quote byte
+
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		switch {
+		case quote == '\'' && c != '\'':
+			b.WriteByte(c)
+		case c == '\'' || c == '"':
+			if quote == 0 {
+				quote = c
+			} else if quote == c {
+				quote = 0
+			} else {
+				b.WriteByte(c)
+			}
+		case c == '\\' && quote == 0 && i+1 < len(word):
+			i++
+			b.WriteByte(word[i])
+		case c == '$' && strings.HasPrefix(word[i:], "$("):
+			end := closingParen(word, i+1)
+
+			var out strings.Builder
+			err := sh.script(word[i+2:end], strings.NewReader(""), &out)
+			if _, ok := err.(exitShell); ok {
+				return "", err
+			}
+
+			b.WriteString(strings.TrimRight(out.String(), "\n"))
+			i = end
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String(), nil
+}
+
+// lex splits the script into words and the operators ;, &&, | and >. Words
+// keep their quotes and $(...) for expand.
+func lex(script string) ([]string, error) {
+	var tokens []string
+	var word strings.Builder
+	inWord := false
+
+	flush := func() {
+		if inWord {
+			tokens = append(tokens, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case c == ' ' || c == '\t':
+			flush()
+		case c == ';' || c == '\n' || c == '|' || c == '>':
+			flush()
+			if c == '\n' {
+				c = ';'
+			}
+			tokens = append(tokens, string(c))
+		case c == '&' && strings.HasPrefix(script[i:], "&&"):
+			flush()
+			tokens = append(tokens, "&&")
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(script[i+1:], c)
+			if end < 0 {
+				return nil, errors.New("syntax error: unterminated quoted string")
+			}
+			word.WriteString(script[i : i+end+2])
+			inWord = true
+			i += end + 1
+		case c == '$' && strings.HasPrefix(script[i:], "$("):
+			end := closingParen(script, i+1)
+			if end == len(script) {
+				return nil, errors.New("syntax error: missing )")
+			}
+			word.WriteString(script[i : end+1])
+			inWord = true
+			i = end
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	flush()
+
+	return tokens, nil
+}
+
+// closingParen returns the index of the parenthesis closing the one at
+// open, skipping quoted ones, or the length of s when there is none.
+func closingParen(s string, open int) int {
+	depth := 0
+	var quote byte
+
+	for i := open; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return len(s)
+}
@@ -0,0 +1,95 @@
+package devenv
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/ipochi/konnscen/pkg/faultproxy"
+	"github.com/ipochi/konnscen/pkg/konnectivity"
+)
+
+// relay plays the http-connect frontend of the Konnectivity Server on a
+// unix socket. Every CONNECT is dialed on the in-process network and the
+// tunnel is forwarded with the faults of a fault proxy.
+type relay struct {
+	ln        net.Listener
+	net       *network
+	proxy     *faultproxy.Proxy
+	dialError float64
+}
+
+func startRelay(socket string, n *network, cfg *Config) (*relay, error) {
+	os.Remove(socket)
+
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %v", socket, err)
+	}
+
+	r := &relay{
+		ln:  ln,
+		net: n,
+		proxy: faultproxy.New(&faultproxy.Config{
+			Faults:   cfg.Faults,
+			Schedule: cfg.Schedule,
+		}),
+		dialError: cfg.DialErrorProbability,
+	}
+
+	go r.serve()
+
+	return r, nil
+}
+
+func (r *relay) Close() error {
+	err := r.ln.Close()
+	r.proxy.Close()
+
+	return err
+}
+
+func (r *relay) serve() {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go r.handle(conn)
+	}
+}
+
+func (r *relay) handle(client net.Conn) {
+	br := bufio.NewReader(client)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		client.Close()
+		return
+	}
+
+	if req.Method != http.MethodConnect {
+		fmt.Fprintf(client, "HTTP/1.1 %d %s\r\n\r\n", http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		client.Close()
+		return
+	}
+
+	if r.dialError > 0 && rand.Float64() < r.dialError {
+		fmt.Fprintf(client, "HTTP/1.1 %d %s\r\n\r\nfailed to dial %s: injected error", http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), req.Host)
+		client.Close()
+		return
+	}
+
+	server, err := r.net.dial(req.Host)
+	if err != nil {
+		fmt.Fprintf(client, "HTTP/1.1 %d %s\r\n\r\nfailed to dial %s: %v", http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), req.Host, err)
+		client.Close()
+		return
+	}
+
+	fmt.Fprintf(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+	r.proxy.Forward(&konnectivity.BufferedConn{Conn: client, Reader: br}, server)
+}
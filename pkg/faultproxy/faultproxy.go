@@ -0,0 +1,235 @@
+package faultproxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	listenAddress = "127.0.0.1:0"
+	bufferSize    = 32 * 1024
+)
+
+// Faults injected into the connections going through the proxy. Faults
+// apply to every chunk of data read from either side of a connection.
+type Faults struct {
+	LatencyMillis int `yaml:"latency_millis"`
+	// BandwidthBytesPerSecond limits every direction of every connection.
+	BandwidthBytesPerSecond int64 `yaml:"bandwidth_bytes_per_second"`
+	// ResetProbability is the chance a chunk resets the connection instead.
+	ResetProbability float64 `yaml:"reset_probability"`
+	// StallProbability is the chance a chunk stalls for StallMillis first.
+	StallProbability float64 `yaml:"stall_probability"`
+	StallMillis      int     `yaml:"stall_millis"`
+}
+
+// Window replaces the faults between AfterSeconds and AfterSeconds +
+// DurationSeconds since the start of the proxy.
+type Window struct {
+	AfterSeconds    int    `yaml:"after_seconds"`
+	DurationSeconds int    `yaml:"duration_seconds"`
+	Faults          Faults `yaml:"faults"`
+}
+
+// Config of the TCP proxy put in front of the kube-apiserver. TLS is passed
+// through untouched.
+type Config struct {
+	Enabled       bool     `yaml:"enabled"`
+	ListenAddress string   `yaml:"listen_address"`
+	Faults        Faults   `yaml:"faults"`
+	Schedule      []Window `yaml:"schedule"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		ListenAddress: listenAddress,
+	}
+}
+
+// Proxy forwards connections to the target, injecting faults.
+type Proxy struct {
+	cfg    *Config
+	target string
+	ln     net.Listener
+	start  time.Time
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// Start listens on the configured address and forwards every connection to
+// the target.
+func Start(cfg *Config, target string) (*Proxy, error) {
+	ln, err := net.Listen("tcp", cfg.ListenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %v", cfg.ListenAddress, err)
+	}
+
+	p := New(cfg)
+	p.target = target
+	p.ln = ln
+
+	go p.serve()
+
+	return p, nil
+}
+
+// New returns a proxy which does not listen, for forwarding connections
+// accepted elsewhere with Forward. The schedule starts now.
+func New(cfg *Config) *Proxy {
+	return &Proxy{
+		cfg:   cfg,
+		start: time.Now(),
+		conns: map[net.Conn]struct{}{},
+	}
+}
+
+func (p *Proxy) Addr() string {
+	return p.ln.Addr().String()
+}
+
+// Close stops listening and closes all the connections.
+func (p *Proxy) Close() error {
+	var err error
+	if p.ln != nil {
+		err = p.ln.Close()
+	}
+
+	p.mu.Lock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+
+	return err
+}
+
+func (p *Proxy) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go p.handle(conn)
+	}
+}
+
+func (p *Proxy) handle(client net.Conn) {
+	server, err := net.Dial("tcp", p.target)
+	if err != nil {
+		client.Close()
+		return
+	}
+
+	p.Forward(client, server)
+}
+
+// Forward copies between the connections, injecting faults, until either of
+// them is done. Both are closed when it returns.
+func (p *Proxy) Forward(client, server net.Conn) {
+	p.track(client, server)
+	defer p.untrack(client, server)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		p.pipe(server, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		p.pipe(client, server)
+		done <- struct{}{}
+	}()
+
+	// Once a direction is done the connection is of no use to the other.
+	<-done
+	client.Close()
+	server.Close()
+	<-done
+}
+
+func (p *Proxy) track(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range conns {
+		p.conns[conn] = struct{}{}
+	}
+}
+
+func (p *Proxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range conns {
+		delete(p.conns, conn)
+	}
+}
+
+// faults returns the faults of the current window of the schedule.
+func (p *Proxy) faults() Faults {
+	elapsed := time.Since(p.start)
+	for _, w := range p.cfg.Schedule {
+		from := time.Duration(w.AfterSeconds) * time.Second
+		to := from + time.Duration(w.DurationSeconds)*time.Second
+		if elapsed >= from && elapsed < to {
+			return w.Faults
+		}
+	}
+
+	return p.cfg.Faults
+}
+
+func (p *Proxy) pipe(dst, src net.Conn) {
+	buf := make([]byte, bufferSize)
+
+	for {
+		chunk := buf
+		// Keep chunks small enough for the limit to be smooth.
+		if limit := p.faults().BandwidthBytesPerSecond / 10; limit > 0 && limit < int64(len(chunk)) {
+			chunk = buf[:limit]
+		}
+
+		n, err := src.Read(chunk)
+		if n > 0 {
+			// The read may have blocked past the end of a window.
+			f := p.faults()
+
+			if f.ResetProbability > 0 && rand.Float64() < f.ResetProbability {
+				reset(src)
+				reset(dst)
+				return
+			}
+
+			if f.StallProbability > 0 && rand.Float64() < f.StallProbability {
+				time.Sleep(time.Duration(f.StallMillis) * time.Millisecond)
+			}
+
+			time.Sleep(time.Duration(f.LatencyMillis) * time.Millisecond)
+
+			if f.BandwidthBytesPerSecond > 0 {
+				time.Sleep(time.Duration(int64(n) * int64(time.Second) / f.BandwidthBytesPerSecond))
+			}
+
+			if _, werr := dst.Write(chunk[:n]); werr != nil {
+				return
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// reset closes the connection with a RST instead of a FIN.
+func reset(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+
+	conn.Close()
+}
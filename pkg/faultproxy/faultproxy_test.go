@@ -0,0 +1,132 @@
+package faultproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const body = "hello through the proxy"
+
+// startProxy starts a proxy with the config in front of a server answering
+// every request with the payload, and returns the URL to reach it through
+// the proxy.
+func startProxy(t *testing.T, cfg *Config, payload []byte) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	}))
+	t.Cleanup(server.Close)
+
+	cfg.ListenAddress = listenAddress
+	p, err := Start(cfg, strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("starting proxy: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	return "http://" + p.Addr()
+}
+
+// get fetches the URL over a new connection.
+func get(url string) ([]byte, error) {
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+		Timeout:   10 * time.Second,
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func TestPassthrough(t *testing.T) {
+	url := startProxy(t, &Config{}, []byte(body))
+
+	got, err := get(url)
+	if err != nil {
+		t.Fatalf("getting through the proxy: %v", err)
+	}
+
+	if string(got) != body {
+		t.Errorf("got %q, want %q", got, body)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	latency := 100 * time.Millisecond
+	url := startProxy(t, &Config{Faults: Faults{LatencyMillis: int(latency / time.Millisecond)}}, []byte(body))
+
+	start := time.Now()
+	if _, err := get(url); err != nil {
+		t.Fatalf("getting through the proxy: %v", err)
+	}
+
+	// Both the request and the response are delayed.
+	if elapsed := time.Since(start); elapsed < 2*latency {
+		t.Errorf("request took %v, want at least %v", elapsed, 2*latency)
+	}
+}
+
+func TestReset(t *testing.T) {
+	url := startProxy(t, &Config{Faults: Faults{ResetProbability: 1}}, []byte(body))
+
+	if _, err := get(url); err == nil {
+		t.Errorf("getting through the proxy succeeded, want the connection reset")
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 5000)
+	url := startProxy(t, &Config{Faults: Faults{BandwidthBytesPerSecond: 10000}}, payload)
+
+	start := time.Now()
+	got, err := get(url)
+	if err != nil {
+		t.Fatalf("getting through the proxy: %v", err)
+	}
+
+	if !bytes.Equal(got, payload) {
+		t.Errorf("got %d bytes, want the %d bytes of the payload", len(got), len(payload))
+	}
+
+	if elapsed, want := time.Since(start), 500*time.Millisecond; elapsed < want {
+		t.Errorf("transfer took %v, want at least %v", elapsed, want)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	cfg := &Config{
+		Schedule: []Window{{
+			AfterSeconds:    0,
+			DurationSeconds: 1,
+			Faults:          Faults{ResetProbability: 1},
+		}},
+	}
+	url := startProxy(t, cfg, []byte(body))
+	start := time.Now()
+
+	if _, err := get(url); err == nil {
+		t.Errorf("getting through the proxy within the window succeeded, want the connection reset")
+	}
+
+	time.Sleep(time.Until(start.Add(time.Second + 100*time.Millisecond)))
+
+	got, err := get(url)
+	if err != nil {
+		t.Fatalf("getting through the proxy after the window: %v", err)
+	}
+
+	if string(got) != body {
+		t.Errorf("got %q, want %q", got, body)
+	}
+}
@@ -0,0 +1,134 @@
+package konnectivity
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ErrConnectRejected is returned when the server answered the CONNECT
+// request with anything but 200.
+var ErrConnectRejected = errors.New("CONNECT rejected")
+
+// Egress is how the kube-apiserver reaches the http-connect frontend of the
+// Konnectivity Server, as in its EgressSelectorConfiguration: either the
+// unix socket UDSName, or URL over TCP with the egress certs for mTLS.
+type Egress struct {
+	UDSName string `yaml:"uds_name"`
+	// URL is https://host:port of the server, used when UDSName is empty.
+	URL        string `yaml:"url"`
+	CABundle   string `yaml:"ca_bundle"`
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+}
+
+// TLSConfig loads the egress certs for dialing URL.
+func (e Egress) TLSConfig() (*tls.Config, error) {
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing url %q: %v", e.URL, err)
+	}
+
+	cfg := &tls.Config{ServerName: u.Hostname()}
+
+	if e.CABundle != "" {
+		ca, err := ioutil.ReadFile(e.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca bundle: %v", err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", e.CABundle)
+		}
+	}
+
+	if e.ClientCert != "" || e.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(e.ClientCert, e.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client cert: %v", err)
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// Dial connects to the server, completing the TLS handshake over TCP. A nil
+// tlsConfig is loaded with TLSConfig.
+func (e Egress) Dial(tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	if e.UDSName != "" {
+		return dialer.Dial("unix", e.UDSName)
+	}
+
+	if e.URL == "" {
+		return nil, fmt.Errorf("uds_name or url must be set")
+	}
+
+	if tlsConfig == nil {
+		var err error
+		if tlsConfig, err = e.TLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing url %q: %v", e.URL, err)
+	}
+
+	return tls.DialWithDialer(dialer, "tcp", u.Host, tlsConfig)
+}
+
+// Connect asks the server for a tunnel to address over conn, returning the
+// status the server answered with. Once it returns without an error, conn
+// carries the traffic of the tunnel.
+func Connect(conn net.Conn, address string, timeout time.Duration) (net.Conn, int, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: konnscen\r\n\r\n", address, address); err != nil {
+		return nil, 0, fmt.Errorf("sending CONNECT: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading CONNECT response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, resp.StatusCode, fmt.Errorf("%w: %s: %s", ErrConnectRejected, resp.Status, body)
+	}
+
+	// The server may already have sent some of the traffic of the tunnel.
+	if br.Buffered() > 0 {
+		return &BufferedConn{Conn: conn, Reader: br}, resp.StatusCode, nil
+	}
+
+	return conn, resp.StatusCode, nil
+}
+
+// BufferedConn is a connection whose reads go through Reader, so that what
+// was buffered past a CONNECT request or response is read first.
+type BufferedConn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
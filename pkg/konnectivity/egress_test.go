@@ -0,0 +1,204 @@
+package konnectivity
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	address = "10.0.0.1:8080"
+	timeout = 5 * time.Second
+)
+
+// serveConnect reads a CONNECT request for address from conn, writes the
+// reply and echoes the traffic of the tunnel back.
+func serveConnect(t *testing.T, conn net.Conn, reply string) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		t.Errorf("reading CONNECT request: %v", err)
+		return
+	}
+
+	if req.Method != http.MethodConnect || req.Host != address {
+		t.Errorf("got %s %s, want %s %s", req.Method, req.Host, http.MethodConnect, address)
+	}
+
+	if _, err := io.WriteString(conn, reply); err != nil {
+		t.Errorf("writing CONNECT reply: %v", err)
+		return
+	}
+
+	io.Copy(conn, br)
+}
+
+// echo checks the tunnel carries traffic both ways.
+func echo(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("writing through the tunnel: %v", err)
+	}
+
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("reading through the tunnel: %v", err)
+	}
+
+	if string(got) != "ping" {
+		t.Errorf("got %q through the tunnel, want %q", got, "ping")
+	}
+}
+
+func TestConnectOverUDS(t *testing.T) {
+	uds := filepath.Join(t.TempDir(), "konnectivity-server.socket")
+	ln, err := net.Listen("unix", uds)
+	if err != nil {
+		t.Fatalf("listening on %s: %v", uds, err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		serveConnect(t, conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	}()
+
+	conn, err := Egress{UDSName: uds}.Dial(nil, timeout)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", uds, err)
+	}
+	defer conn.Close()
+
+	tunnel, status, err := Connect(conn, address, timeout)
+	if err != nil {
+		t.Fatalf("connecting to %s: %v", address, err)
+	}
+
+	if status != http.StatusOK {
+		t.Errorf("got status %d, want %d", status, http.StatusOK)
+	}
+
+	echo(t, tunnel)
+}
+
+func TestConnectRejected(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go serveConnect(t, server, "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 8\r\n\r\nno agent")
+
+	_, status, err := Connect(client, address, timeout)
+	if !errors.Is(err, ErrConnectRejected) {
+		t.Fatalf("got error %v, want %v", err, ErrConnectRejected)
+	}
+
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", status, http.StatusServiceUnavailable)
+	}
+}
+
+func TestConnectBuffered(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// The traffic sent along with the reply is read with it.
+	go serveConnect(t, server, "HTTP/1.1 200 Connection Established\r\n\r\nhello")
+
+	tunnel, _, err := Connect(client, address, timeout)
+	if err != nil {
+		t.Fatalf("connecting to %s: %v", address, err)
+	}
+
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(tunnel, got); err != nil {
+		t.Fatalf("reading through the tunnel: %v", err)
+	}
+
+	if string(got) != "hello" {
+		t.Errorf("got %q through the tunnel, want %q", got, "hello")
+	}
+
+	echo(t, tunnel)
+}
+
+func TestConnectOverMTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			t.Errorf("got no client certificate")
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijacking: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		io.Copy(conn, rw)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	// The server certificate doubles as the client certificate.
+	dir := t.TempDir()
+	cert := server.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("marshaling key: %v", err)
+	}
+
+	egress := Egress{
+		URL:        server.URL,
+		CABundle:   writePEM(t, dir, "ca.crt", "CERTIFICATE", server.Certificate().Raw),
+		ClientCert: writePEM(t, dir, "client.crt", "CERTIFICATE", cert.Certificate[0]),
+		ClientKey:  writePEM(t, dir, "client.key", "PRIVATE KEY", key),
+	}
+
+	tlsConfig, err := egress.TLSConfig()
+	if err != nil {
+		t.Fatalf("loading egress certs: %v", err)
+	}
+
+	conn, err := egress.Dial(tlsConfig, timeout)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", server.URL, err)
+	}
+	defer conn.Close()
+
+	tunnel, _, err := Connect(conn, address, timeout)
+	if err != nil {
+		t.Fatalf("connecting to %s: %v", address, err)
+	}
+
+	echo(t, tunnel)
+}
+
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+
+	return path
+}
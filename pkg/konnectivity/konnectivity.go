@@ -0,0 +1,116 @@
+package konnectivity
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	namespace         = "kube-system"
+	serverSelector    = "k8s-app=konnectivity-server"
+	agentSelector     = "k8s-app=konnectivity-agent"
+	serverMetricsPort = 8095
+)
+
+// Config locates the Konnectivity Server and Agent pods in the cluster.
+type Config struct {
+	Namespace         string `yaml:"namespace"`
+	ServerSelector    string `yaml:"server_selector"`
+	AgentSelector     string `yaml:"agent_selector"`
+	ServerMetricsPort int    `yaml:"server_metrics_port"`
+}
+
+func NewConfig() Config {
+	return Config{
+		Namespace:         namespace,
+		ServerSelector:    serverSelector,
+		AgentSelector:     agentSelector,
+		ServerMetricsPort: serverMetricsPort,
+	}
+}
+
+func (c Config) ServerPods(cs kubernetes.Interface) ([]corev1.Pod, error) {
+	return c.pods(cs, c.ServerSelector)
+}
+
+func (c Config) AgentPods(cs kubernetes.Interface) ([]corev1.Pod, error) {
+	return c.pods(cs, c.AgentSelector)
+}
+
+func (c Config) pods(cs kubernetes.Interface, selector string) ([]corev1.Pod, error) {
+	pods, err := cs.CoreV1().Pods(c.Namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing pods %q in namespace %q: %v", selector, c.Namespace, err)
+	}
+
+	return pods.Items, nil
+}
+
+// ServerMetric sums the named metrics over every Konnectivity Server pod.
+func (c Config) ServerMetric(cs kubernetes.Interface, names ...string) (float64, error) {
+	pods, err := c.ServerPods(cs)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(pods) == 0 {
+		return 0, fmt.Errorf("no Konnectivity Server pods found with %q", c.ServerSelector)
+	}
+
+	var sum float64
+	for _, pod := range pods {
+		out, err := cs.CoreV1().Pods(pod.Namespace).ProxyGet("http", pod.Name, strconv.Itoa(c.ServerMetricsPort), "metrics", nil).DoRaw(context.TODO())
+		if err != nil {
+			return 0, fmt.Errorf("scraping metrics of %s: %v", pod.Name, err)
+		}
+
+		sum += sumMetrics(out, names)
+	}
+
+	return sum, nil
+}
+
+// sumMetrics sums the samples of the named metrics in the Prometheus text format.
+func sumMetrics(out []byte, names []string) float64 {
+	var sum float64
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		name := fields[0]
+		if i := strings.IndexByte(name, '{'); i >= 0 {
+			name = name[:i]
+		}
+
+		for _, n := range names {
+			if n != name {
+				continue
+			}
+
+			if v, err := strconv.ParseFloat(fields[len(fields)-1], 64); err == nil {
+				sum += v
+			}
+		}
+	}
+
+	return sum
+}
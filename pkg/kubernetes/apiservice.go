@@ -0,0 +1,307 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const apiServicesPath = "/apis/apiregistration.k8s.io/v1/apiservices"
+
+const (
+	// aggregatedAPIManifest serves a minimal aggregated API with a single
+	// pings resource over TLS, enough for discovery and list requests.
+	aggregatedAPIManifest = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app: konnscen-aggregated
+  name: konnscen-aggregated
+  namespace: default
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: konnscen-aggregated
+  template:
+    metadata:
+      labels:
+        app: konnscen-aggregated
+    spec:
+      containers:
+      - image: python:3.9-alpine
+        name: aggregated
+        command:
+        - python3
+        - -c
+        - |
+          import json, ssl
+          from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+          GV = "konnscen.io/v1alpha1"
+          RESOURCES = {
+              "/apis": {"kind": "APIGroupList", "apiVersion": "v1", "groups": [
+                  {"name": "konnscen.io", "versions": [{"groupVersion": GV, "version": "v1alpha1"}],
+                   "preferredVersion": {"groupVersion": GV, "version": "v1alpha1"}}]},
+              "/apis/konnscen.io": {"kind": "APIGroup", "apiVersion": "v1", "name": "konnscen.io",
+                  "versions": [{"groupVersion": GV, "version": "v1alpha1"}],
+                  "preferredVersion": {"groupVersion": GV, "version": "v1alpha1"}},
+              "/apis/" + GV: {"kind": "APIResourceList", "apiVersion": "v1", "groupVersion": GV,
+                  "resources": [{"name": "pings", "singularName": "ping", "namespaced": False,
+                                 "kind": "Ping", "verbs": ["get", "list"]}]},
+              "/apis/" + GV + "/pings": {"kind": "PingList", "apiVersion": GV, "metadata": {}, "items": []},
+          }
+
+          class Handler(BaseHTTPRequestHandler):
+              protocol_version = "HTTP/1.1"
+
+              def do_GET(self):
+                  path = self.path.split("?")[0].rstrip("/")
+                  if path in ("/healthz", "/readyz", "/livez"):
+                      body, status = b"ok", 200
+                  elif path in RESOURCES:
+                      body, status = json.dumps(RESOURCES[path]).encode(), 200
+                  else:
+                      body, status = b"{}", 404
+                  self.send_response(status)
+                  self.send_header("Content-Type", "application/json")
+                  self.send_header("Content-Length", str(len(body)))
+                  self.end_headers()
+                  self.wfile.write(body)
+
+              def log_message(self, *args):
+                  pass
+
+          server = ThreadingHTTPServer(("", 8443), Handler)
+          ctx = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+          ctx.load_cert_chain("/tls/tls.crt", "/tls/tls.key")
+          server.socket = ctx.wrap_socket(server.socket, server_side=True)
+          server.serve_forever()
+        ports:
+        - containerPort: 8443
+          name: https
+        volumeMounts:
+        - name: tls
+          mountPath: /tls
+          readOnly: true
+      volumes:
+      - name: tls
+        secret:
+          secretName: konnscen-aggregated
+`
+	aggregatedAPIServiceManifest = `
+apiVersion: v1
+kind: Service
+metadata:
+  labels:
+    app: konnscen-aggregated
+  name: konnscen-aggregated
+  namespace: default
+spec:
+  selector:
+    app: konnscen-aggregated
+  ports:
+  - name: https
+    port: 443
+    targetPort: https
+`
+	aggregatedAPIServiceName = "v1alpha1.konnscen.io"
+)
+
+// APIService is the part of an apiregistration.k8s.io/v1 APIService used by
+// konnscen, which does not vendor the aggregator clientset.
+type APIService struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              APIServiceSpec   `json:"spec"`
+	Status            APIServiceStatus `json:"status,omitempty"`
+}
+
+type APIServiceSpec struct {
+	Service               *ServiceReference `json:"service,omitempty"`
+	Group                 string            `json:"group,omitempty"`
+	Version               string            `json:"version,omitempty"`
+	InsecureSkipTLSVerify bool              `json:"insecureSkipTLSVerify,omitempty"`
+	GroupPriorityMinimum  int32             `json:"groupPriorityMinimum"`
+	VersionPriority       int32             `json:"versionPriority"`
+}
+
+type ServiceReference struct {
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Port      *int32 `json:"port,omitempty"`
+}
+
+type APIServiceStatus struct {
+	Conditions []APIServiceCondition `json:"conditions,omitempty"`
+}
+
+type APIServiceCondition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Available returns whether the Available condition of the APIService is
+// True, and its reason otherwise.
+func (a APIService) Available() (bool, string) {
+	for _, c := range a.Status.Conditions {
+		if c.Type == "Available" {
+			return c.Status == "True", c.Reason
+		}
+	}
+
+	return false, "Unknown"
+}
+
+// GroupVersion returns the API path the APIService serves.
+func (a APIService) GroupVersion() string {
+	return fmt.Sprintf("/apis/%s/%s", a.Spec.Group, a.Spec.Version)
+}
+
+func ListAPIServices(cs kubernetes.Interface) ([]APIService, error) {
+	raw, err := cs.Discovery().RESTClient().Get().AbsPath(apiServicesPath).DoRaw(context.TODO())
+	if err != nil {
+		return nil, fmt.Errorf("listing APIServices: %v", err)
+	}
+
+	list := struct {
+		Items []APIService `json:"items"`
+	}{}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("decoding APIServices: %v", err)
+	}
+
+	return list.Items, nil
+}
+
+func GetAPIService(cs kubernetes.Interface, name string) (*APIService, error) {
+	raw, err := cs.Discovery().RESTClient().Get().AbsPath(apiServicesPath, name).DoRaw(context.TODO())
+	if err != nil {
+		return nil, fmt.Errorf("getting APIService %s: %v", name, err)
+	}
+
+	a := &APIService{}
+	if err := json.Unmarshal(raw, a); err != nil {
+		return nil, fmt.Errorf("decoding APIService %s: %v", name, err)
+	}
+
+	return a, nil
+}
+
+// AggregatedAPI is a test aggregated API created by konnscen.
+type AggregatedAPI struct {
+	Secret     *corev1.Secret
+	Deployment *appsv1.Deployment
+	Service    *corev1.Service
+	APIService *APIService
+}
+
+// CreateAggregatedAPI deploys the aggregated API of aggregatedAPIManifest
+// with a self-signed certificate and registers it as v1alpha1.konnscen.io.
+// The returned AggregatedAPI holds whatever was created, also on error.
+// created is called with everything created so far after every object, so
+// an interrupted run can delete it.
+func CreateAggregatedAPI(created func(AggregatedAPI)) (*AggregatedAPI, error) {
+	cs, err := GetK8sClientset()
+	if err != nil {
+		return nil, fmt.Errorf("getting clientset, %v", err)
+	}
+
+	a := &AggregatedAPI{}
+
+	if a.Service, err = createService(cs, aggregatedAPIServiceManifest); err != nil {
+		return a, err
+	}
+	created(*a)
+	svc := a.Service
+
+	if a.Secret, err = createTLSSecret(cs, svc); err != nil {
+		return a, err
+	}
+	created(*a)
+
+	if a.Deployment, err = createDeploymentObject(cs, aggregatedAPIManifest); err != nil {
+		return a, err
+	}
+	created(*a)
+
+	if err := waitForDeploymentRunning(cs, a.Deployment); err != nil {
+		return a, err
+	}
+
+	port := int32(443)
+	apiService := &APIService{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apiregistration.k8s.io/v1", Kind: "APIService"},
+		ObjectMeta: metav1.ObjectMeta{Name: aggregatedAPIServiceName},
+		Spec: APIServiceSpec{
+			Service:               &ServiceReference{Namespace: svc.Namespace, Name: svc.Name, Port: &port},
+			Group:                 "konnscen.io",
+			Version:               "v1alpha1",
+			InsecureSkipTLSVerify: true,
+			GroupPriorityMinimum:  1000,
+			VersionPriority:       15,
+		},
+	}
+
+	body, err := json.Marshal(apiService)
+	if err != nil {
+		return a, fmt.Errorf("encoding APIService: %v", err)
+	}
+
+	if err := cs.Discovery().RESTClient().Post().AbsPath(apiServicesPath).Body(body).Do(context.TODO()).Error(); err != nil {
+		return a, fmt.Errorf("failed to create %s APIService: %v", apiService.Name, err)
+	}
+	a.APIService = apiService
+	created(*a)
+
+	fmt.Printf("%s APIService created\n", apiService.Name)
+
+	return a, nil
+}
+
+// Delete removes everything CreateAggregatedAPI created, the APIService first
+// so discovery does not keep failing on it.
+func (a *AggregatedAPI) Delete() error {
+	cs, err := GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	if a.APIService != nil {
+		if err := cs.Discovery().RESTClient().Delete().AbsPath(apiServicesPath, a.APIService.Name).Do(context.TODO()).Error(); err != nil {
+			return fmt.Errorf("failed to delete %s APIService: %v", a.APIService.Name, err)
+		}
+		a.APIService = nil
+	}
+
+	if a.Deployment != nil {
+		if err := DeleteDeployment(a.Deployment); err != nil {
+			return err
+		}
+		a.Deployment = nil
+	}
+
+	if a.Service != nil {
+		if err := DeleteService(a.Service); err != nil {
+			return err
+		}
+		a.Service = nil
+	}
+
+	if a.Secret != nil {
+		if err := deleteSecret(cs, a.Secret); err != nil {
+			return err
+		}
+		a.Secret = nil
+	}
+
+	return nil
+}
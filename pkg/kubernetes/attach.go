@@ -0,0 +1,81 @@
+package kubernetes
+
+import (
+	"io"
+	"io/ioutil"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+type AttachToPodRequest struct {
+	// RestConfig is the kubernetes config
+	RestConfig *rest.Config
+	// Pod is the pod to attach to
+	Pod corev1.Pod
+	// Container defaults to the first container of the Pod, it may be an
+	// ephemeral container.
+	Container string
+	// Stdin is optional, Stdout and Stderr default to being discarded.
+	// Stderr is merged into Stdout when TTY is set.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// TTY attaches to the terminal of the container, which must have one.
+	TTY bool
+	// Transport is TransportSPDY, the default, or TransportWebSocket.
+	Transport string
+}
+
+// AttachToPod attaches to the main process of a running container and waits
+// for the process to exit or Stdin to be closed.
+func AttachToPod(req AttachToPodRequest) error {
+	cs, err := kubernetes.NewForConfig(req.RestConfig)
+	if err != nil {
+		return err
+	}
+
+	container := req.Container
+	if container == "" && len(req.Pod.Spec.Containers) > 0 {
+		container = req.Pod.Spec.Containers[0].Name
+	}
+
+	stdout, stderr := req.Stdout, req.Stderr
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	if req.TTY {
+		stderr = nil
+	}
+
+	r := cs.CoreV1().RESTClient().Post().
+		Namespace(req.Pod.Namespace).
+		Resource("pods").
+		Name(req.Pod.Name).
+		SubResource("attach").
+		VersionedParams(&corev1.PodAttachOptions{
+			Container: container,
+			Stdin:     req.Stdin != nil,
+			Stdout:    true,
+			Stderr:    stderr != nil,
+			TTY:       req.TTY,
+		}, scheme.ParameterCodec)
+
+	attach, err := newExecutor(req.RestConfig, r.URL(), req.Transport)
+	if err != nil {
+		return err
+	}
+
+	return attach.Stream(remotecommand.StreamOptions{
+		Stdin:  req.Stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+		Tty:    req.TTY,
+	})
+}
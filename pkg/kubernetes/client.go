@@ -3,16 +3,21 @@ package kubernetes
 import (
 	"context"
 	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/client-go/util/homedir"
 	"sigs.k8s.io/yaml"
 )
@@ -41,6 +46,107 @@ spec:
       containers:
       - image: bitnami/nginx
         name: nginx
+`
+	// echoManifest runs cat as the main process, so whatever is written to
+	// its stdin, or to /proc/1/fd/1 from an exec, ends up in its logs.
+	echoManifest = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app: echo
+  name: echo
+  namespace: default
+spec:
+  replicas: 3
+  selector:
+    matchLabels:
+      app: echo
+  template:
+    metadata:
+      labels:
+        app: echo
+    spec:
+      containers:
+      - image: busybox
+        name: echo
+        command:
+        - cat
+        stdin: true
+`
+	// checksumManifest runs a small HTTP server which streams payloads of the
+	// requested size on GET and returns the SHA-256 of the received body on POST.
+	checksumManifest = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app: checksum
+  name: checksum
+  namespace: default
+spec:
+  replicas: 10
+  selector:
+    matchLabels:
+      app: checksum
+  template:
+    metadata:
+      labels:
+        app: checksum
+    spec:
+      containers:
+      - image: python:3.9-alpine
+        name: checksum
+        command:
+        - python3
+        - -c
+        - |
+          import hashlib, os
+          from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+          from urllib.parse import urlparse, parse_qs
+
+          BLOCK = 65536
+
+          class Handler(BaseHTTPRequestHandler):
+              protocol_version = "HTTP/1.1"
+
+              def do_GET(self):
+                  size = int(parse_qs(urlparse(self.path).query).get("size", ["0"])[0])
+                  block = os.urandom(BLOCK)
+                  digest = hashlib.sha256()
+                  n = size
+                  while n > 0:
+                      digest.update(block[:min(n, BLOCK)])
+                      n -= BLOCK
+                  self.send_response(200)
+                  self.send_header("Content-Length", str(size))
+                  self.send_header("X-Sha256", digest.hexdigest())
+                  self.end_headers()
+                  n = size
+                  while n > 0:
+                      self.wfile.write(block[:min(n, BLOCK)])
+                      n -= BLOCK
+
+              def do_POST(self):
+                  size = int(self.headers.get("Content-Length", "0"))
+                  digest = hashlib.sha256()
+                  got = 0
+                  while got < size:
+                      b = self.rfile.read(min(BLOCK, size - got))
+                      if not b:
+                          break
+                      digest.update(b)
+                      got += len(b)
+                  body = ("%s %d" % (digest.hexdigest(), got)).encode()
+                  self.send_response(200)
+                  self.send_header("Content-Length", str(len(body)))
+                  self.end_headers()
+                  self.wfile.write(body)
+
+              def log_message(self, *args):
+                  pass
+
+          ThreadingHTTPServer(("", 8080), Handler).serve_forever()
 `
 )
 
@@ -60,7 +166,54 @@ func getKubeconfig() (string, error) {
 	return "", fmt.Errorf("kubeconfig not found, nor KUBECONFIG env was set")
 }
 
-func GetRestConfig() (*rest.Config, error) {
+// proxyAddress is where the clients connect to instead of the apiserver, see UseProxy.
+var proxyAddress string
+
+// UseProxy makes the clients created afterwards connect to the apiserver
+// through a TLS passthrough proxy listening at addr.
+func UseProxy(addr string) {
+	proxyAddress = addr
+}
+
+// RateLimit is the client-side rate limit of the clients. The zero value
+// keeps client-go's default of 5 requests per second with a burst of 10.
+type RateLimit struct {
+	QPS   float32 `yaml:"qps"`
+	Burst int     `yaml:"burst"`
+	// Unlimited lifts the limit, so that it does not throttle the load the
+	// scenarios generate before it reaches the apiserver.
+	Unlimited bool `yaml:"unlimited"`
+}
+
+func NewRateLimit() *RateLimit {
+	return &RateLimit{}
+}
+
+func (l *RateLimit) Validate() error {
+	if l.QPS < 0 {
+		return fmt.Errorf("client rate limit: qps must not be negative")
+	}
+
+	if l.QPS > 0 && l.Burst <= 0 {
+		return fmt.Errorf("client rate limit: burst must be positive when qps is set")
+	}
+
+	if l.Unlimited && l.QPS > 0 {
+		return fmt.Errorf("client rate limit: qps cannot be combined with unlimited")
+	}
+
+	return nil
+}
+
+// rateLimit limits the requests of the clients, see UseRateLimit.
+var rateLimit RateLimit
+
+// UseRateLimit makes the clients created afterwards limit their requests to l.
+func UseRateLimit(l RateLimit) {
+	rateLimit = l
+}
+
+func buildRestConfig() (*rest.Config, error) {
 	kubeconfig, err := getKubeconfig()
 	if err != nil {
 		return nil, err
@@ -69,13 +222,58 @@ func GetRestConfig() (*rest.Config, error) {
 	return clientcmd.BuildConfigFromFlags("", kubeconfig)
 }
 
-func GetK8sClientset() (*kubernetes.Clientset, error) {
-	kubeconfig, err := getKubeconfig()
+// APIServerAddress is the host:port of the apiserver in the kubeconfig.
+func APIServerAddress() (string, error) {
+	config, err := buildRestConfig()
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(config.Host)
+	if err != nil {
+		return "", fmt.Errorf("parsing apiserver host %q: %v", config.Host, err)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+func GetRestConfig() (*rest.Config, error) {
+	config, err := buildRestConfig()
 	if err != nil {
 		return nil, err
 	}
-	// use the current context in kubeconfig
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+
+	if proxyAddress != "" {
+		u, err := url.Parse(config.Host)
+		if err != nil {
+			return nil, fmt.Errorf("parsing apiserver host %q: %v", config.Host, err)
+		}
+
+		// Keep verifying the certificate against the apiserver name.
+		if config.TLSClientConfig.ServerName == "" {
+			config.TLSClientConfig.ServerName = u.Hostname()
+		}
+		config.Host = "https://" + proxyAddress
+	}
+
+	switch {
+	case rateLimit.Unlimited:
+		config.RateLimiter = flowcontrol.NewFakeAlwaysRateLimiter()
+	case rateLimit.QPS > 0:
+		config.QPS = rateLimit.QPS
+		config.Burst = rateLimit.Burst
+	}
+
+	return config, nil
+}
+
+func GetK8sClientset() (*kubernetes.Clientset, error) {
+	config, err := GetRestConfig()
 	if err != nil {
 		return nil, fmt.Errorf("building kubeconfig")
 	}
@@ -89,31 +287,130 @@ func GetK8sClientset() (*kubernetes.Clientset, error) {
 	return clientset, nil
 }
 
+// GetUnlimitedK8sClientset returns a clientset without a client-side rate
+// limit, whatever the configured one, for scenarios whose requests must go
+// out when they are due.
+func GetUnlimitedK8sClientset() (*kubernetes.Clientset, error) {
+	config, err := GetRestConfig()
+	if err != nil {
+		return nil, fmt.Errorf("building kubeconfig")
+	}
+
+	config.RateLimiter = flowcontrol.NewFakeAlwaysRateLimiter()
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("getting clientset")
+	}
+
+	return clientset, nil
+}
+
 func CreateNginxDeployment() (*appsv1.Deployment, error) {
+	return createDeployment(nginxManifest)
+}
+
+// CreateChecksumDeployment creates a Deployment whose pods serve and verify
+// payloads on port 8080, see checksumManifest.
+func CreateChecksumDeployment() (*appsv1.Deployment, error) {
+	return createDeployment(checksumManifest)
+}
+
+// CreateEchoDeployment creates a Deployment whose pods echo their stdin to
+// their logs, see echoManifest.
+func CreateEchoDeployment() (*appsv1.Deployment, error) {
+	return createDeployment(echoManifest)
+}
+
+func createDeployment(manifest string) (*appsv1.Deployment, error) {
 	cs, err := GetK8sClientset()
 	if err != nil {
 		return nil, fmt.Errorf("getting clientset, %v", err)
 	}
 
+	d, err := createDeploymentObject(cs, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := waitForDeploymentRunning(cs, d); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// createDeploymentObject creates the Deployment of the manifest without
+// waiting for its pods.
+func createDeploymentObject(cs *kubernetes.Clientset, manifest string) (*appsv1.Deployment, error) {
 	// Create a deployment for port-forwarding
 	d := &appsv1.Deployment{}
-	if err := yaml.Unmarshal([]byte(nginxManifest), d); err != nil {
+	if err := yaml.Unmarshal([]byte(manifest), d); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal deployment manifest: %v", err)
 	}
 
 	if _, err := cs.AppsV1().Deployments("default").Create(context.TODO(), d, metav1.CreateOptions{}); err != nil {
-		return nil, fmt.Errorf("failed to create nginx deployment: %v", err)
+		return nil, fmt.Errorf("failed to create %s deployment: %v", d.Name, err)
 	}
 
-	fmt.Println("nginx Deployment created")
+	fmt.Printf("%s Deployment created\n", d.Name)
 
-	if err := waitForPodsRunning(cs, "app=nginx"); err != nil {
-		return nil, fmt.Errorf("timed out waiting for pods to be in Running state: %v", err)
+	return d, nil
+}
+
+func waitForDeploymentRunning(cs *kubernetes.Clientset, d *appsv1.Deployment) error {
+	if err := waitForPodsRunning(cs, metav1.FormatLabelSelector(d.Spec.Selector)); err != nil {
+		return fmt.Errorf("timed out waiting for pods to be in Running state: %v", err)
 	}
 
-	fmt.Println("nginx pods in Running state, continuing")
+	fmt.Printf("%s pods in Running state, continuing\n", d.Name)
 
-	return d, nil
+	return nil
+}
+
+// DeploymentPods lists the pods of a Deployment created by konnscen.
+func DeploymentPods(cs kubernetes.Interface, d *appsv1.Deployment) ([]corev1.Pod, error) {
+	pods, err := cs.CoreV1().Pods(d.Namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: metav1.FormatLabelSelector(d.Spec.Selector),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("retreiving %s pods: %v", d.Name, err)
+	}
+
+	if len(pods.Items) == 0 {
+		return nil, fmt.Errorf("no %s pods found in the cluster", d.Name)
+	}
+
+	return pods.Items, nil
+}
+
+// RandomPod returns a random pod of the default namespace matching the selector.
+func RandomPod(cs kubernetes.Interface, selector string) (corev1.Pod, error) {
+	pods, err := cs.CoreV1().Pods("default").List(context.TODO(), metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return corev1.Pod{}, fmt.Errorf("retreiving all pods in the cluster: %q", err)
+	}
+
+	if len(pods.Items) == 0 {
+		return corev1.Pod{}, fmt.Errorf("No pods found in the cluster")
+	}
+
+	rand.Seed(time.Now().UnixNano())
+
+	return pods.Items[rand.Intn(len(pods.Items))], nil
+}
+
+// EvictPod evicts the pod through the eviction API, which respects its
+// PodDisruptionBudgets.
+func EvictPod(cs kubernetes.Interface, pod corev1.Pod) error {
+	return cs.CoreV1().Pods(pod.Namespace).EvictV1(context.TODO(), &policyv1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+	})
 }
 
 func DeleteDeployment(d *appsv1.Deployment) error {
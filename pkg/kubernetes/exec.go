@@ -0,0 +1,85 @@
+package kubernetes
+
+import (
+	"io"
+	"io/ioutil"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+type ExecInPodRequest struct {
+	// RestConfig is the kubernetes config
+	RestConfig *rest.Config
+	// Pod is the pod to run the command in
+	Pod corev1.Pod
+	// Container defaults to the first container of the Pod
+	Container string
+	// Command is the command and its arguments
+	Command []string
+	// Stdin is optional, Stdout and Stderr default to being discarded.
+	// Stderr is merged into Stdout when TTY is set.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// TTY allocates a terminal for the command
+	TTY bool
+	// TerminalSizeQueue is optional, it resizes the terminal when TTY is set.
+	TerminalSizeQueue remotecommand.TerminalSizeQueue
+	// Transport is TransportSPDY, the default, or TransportWebSocket.
+	Transport string
+}
+
+// ExecInPod runs a command in the pod and waits for it to finish.
+func ExecInPod(req ExecInPodRequest) error {
+	cs, err := kubernetes.NewForConfig(req.RestConfig)
+	if err != nil {
+		return err
+	}
+
+	container := req.Container
+	if container == "" && len(req.Pod.Spec.Containers) > 0 {
+		container = req.Pod.Spec.Containers[0].Name
+	}
+
+	stdout, stderr := req.Stdout, req.Stderr
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	if req.TTY {
+		stderr = nil
+	}
+
+	r := cs.CoreV1().RESTClient().Post().
+		Namespace(req.Pod.Namespace).
+		Resource("pods").
+		Name(req.Pod.Name).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   req.Command,
+			Stdin:     req.Stdin != nil,
+			Stdout:    true,
+			Stderr:    stderr != nil,
+			TTY:       req.TTY,
+		}, scheme.ParameterCodec)
+
+	exec, err := newExecutor(req.RestConfig, r.URL(), req.Transport)
+	if err != nil {
+		return err
+	}
+
+	return exec.Stream(remotecommand.StreamOptions{
+		Stdin:             req.Stdin,
+		Stdout:            stdout,
+		Stderr:            stderr,
+		Tty:               req.TTY,
+		TerminalSizeQueue: req.TerminalSizeQueue,
+	})
+}
@@ -0,0 +1,112 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	evictRetryInterval  = 5 * time.Second
+	mirrorPodAnnotation = "kubernetes.io/config.mirror"
+)
+
+// CordonNode marks the node as unschedulable, or schedulable again.
+func CordonNode(cs kubernetes.Interface, name string, unschedulable bool) error {
+	patch := fmt.Sprintf(`{"spec":{"unschedulable":%t}}`, unschedulable)
+	if _, err := cs.CoreV1().Nodes().Patch(context.TODO(), name, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("setting node %s unschedulable to %t: %v", name, unschedulable, err)
+	}
+
+	return nil
+}
+
+// DrainNode evicts every pod from the node like kubectl drain
+// --ignore-daemonsets does, retrying evictions blocked by a
+// PodDisruptionBudget, and waits for the pods to be gone.
+func DrainNode(cs kubernetes.Interface, name string, timeout time.Duration) error {
+	end := time.Now().Add(timeout)
+
+	pods, err := cs.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", name).String(),
+	})
+	if err != nil {
+		return fmt.Errorf("listing pods on node %s: %v", name, err)
+	}
+
+	var evicted []corev1.Pod
+	for _, pod := range pods.Items {
+		if !evictable(pod) {
+			continue
+		}
+
+		for {
+			err := EvictPod(cs, pod)
+			if err == nil || apierrors.IsNotFound(err) {
+				break
+			}
+
+			if !apierrors.IsTooManyRequests(err) || time.Now().After(end) {
+				return fmt.Errorf("evicting %s/%s: %v", pod.Namespace, pod.Name, err)
+			}
+
+			time.Sleep(evictRetryInterval)
+		}
+
+		evicted = append(evicted, pod)
+	}
+
+	for _, pod := range evicted {
+		for {
+			p, err := cs.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) || (err == nil && p.UID != pod.UID) {
+				break
+			}
+
+			if time.Now().After(end) {
+				return fmt.Errorf("pod %s/%s still on node %s after %v", pod.Namespace, pod.Name, name, timeout)
+			}
+
+			time.Sleep(time.Second)
+		}
+	}
+
+	return nil
+}
+
+func evictable(pod corev1.Pod) bool {
+	if _, ok := pod.Annotations[mirrorPodAnnotation]; ok {
+		return false
+	}
+
+	if owner := metav1.GetControllerOf(&pod); owner != nil && owner.Kind == "DaemonSet" {
+		return false
+	}
+
+	return pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed
+}
+
+// ReadyPods counts the pods which are ready and not terminating.
+func ReadyPods(pods []corev1.Pod) int {
+	ready := 0
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+
+		for _, cond := range pod.Status.Conditions {
+			if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
+				ready++
+			}
+		}
+	}
+
+	return ready
+}
@@ -0,0 +1,146 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// ErrPortForwardNotReady is returned when a tunnel did not become ready in time.
+var ErrPortForwardNotReady = errors.New("port-forward not ready")
+
+type PortForwardAPodRequest struct {
+	// RestConfig is the kubernetes config
+	RestConfig *rest.Config
+	// Pod is the selected pod for this port forwarding
+	Pod corev1.Pod
+	// LocalPort is the local port that will be selected to expose the PodPort
+	LocalPort int
+	// PodPort is the target port for the pod
+	PodPort int
+	// Steams configures where to write or read input from
+	Streams genericclioptions.IOStreams
+	// StopCh is the channel used to manage the port forward lifecycle
+	StopCh <-chan struct{}
+	// ReadyCh communicates when the tunnel is ready to receive traffic
+	ReadyCh chan struct{}
+	// Transport is TransportSPDY, the default, or TransportWebSocket.
+	Transport string
+}
+
+func PortForwardAPod(req PortForwardAPodRequest) error {
+	fw, err := newPortForwarder(req)
+	if err != nil {
+		return err
+	}
+	return fw.ForwardPorts()
+}
+
+func newPortForwarder(req PortForwardAPodRequest) (*portforward.PortForwarder, error) {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/portforward",
+		req.Pod.Namespace, req.Pod.Name)
+	hostIP := strings.TrimPrefix(req.RestConfig.Host, "https://")
+	hostIP = strings.TrimSuffix(hostIP, "/")
+
+	u := &url.URL{Scheme: "https", Path: path, Host: hostIP}
+
+	var dialer httpstream.Dialer
+	switch req.Transport {
+	case "", TransportSPDY:
+		transport, upgrader, err := spdy.RoundTripperFor(req.RestConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		dialer = spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, u)
+	case TransportWebSocket:
+		u.RawQuery = url.Values{"ports": {strconv.Itoa(req.PodPort)}}.Encode()
+		dialer = &wsPortForwardDialer{config: req.RestConfig, url: u}
+	default:
+		return nil, fmt.Errorf("unknown transport %q", req.Transport)
+	}
+
+	return portforward.New(dialer, []string{fmt.Sprintf("%d:%d", req.LocalPort, req.PodPort)}, req.StopCh, req.ReadyCh, req.Streams.Out, req.Streams.ErrOut)
+}
+
+// PortForward is a tunnel opened by OpenPortForward.
+type PortForward struct {
+	fw     *portforward.PortForwarder
+	stopCh chan struct{}
+	doneCh chan error
+	once   sync.Once
+}
+
+// OpenPortForward forwards a local port to the pod over the transport and
+// waits for the tunnel to be ready. A zero localPort picks a random free port.
+func OpenPortForward(config *rest.Config, transport string, pod corev1.Pod, localPort, podPort int, timeout time.Duration) (*PortForward, error) {
+	stopCh := make(chan struct{})
+	readyCh := make(chan struct{})
+
+	fw, err := newPortForwarder(PortForwardAPodRequest{
+		RestConfig: config,
+		Pod:        pod,
+		LocalPort:  localPort,
+		PodPort:    podPort,
+		Streams:    genericclioptions.IOStreams{Out: ioutil.Discard, ErrOut: ioutil.Discard},
+		StopCh:     stopCh,
+		ReadyCh:    readyCh,
+		Transport:  transport,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PortForward{fw: fw, stopCh: stopCh, doneCh: make(chan error, 1)}
+	go func() {
+		p.doneCh <- fw.ForwardPorts()
+	}()
+
+	select {
+	case <-readyCh:
+		return p, nil
+	case err := <-p.doneCh:
+		if err == nil {
+			err = fmt.Errorf("port-forward to %s closed before it was ready", pod.Name)
+		}
+		return nil, err
+	case <-time.After(timeout):
+		p.Close()
+		return nil, fmt.Errorf("%w to %s after %v", ErrPortForwardNotReady, pod.Name, timeout)
+	}
+}
+
+// LocalPort is the local end of the tunnel.
+func (p *PortForward) LocalPort() int {
+	ports, err := p.fw.GetPorts()
+	if err != nil || len(ports) == 0 {
+		return 0
+	}
+
+	return int(ports[0].Local)
+}
+
+// Done receives once the tunnel is closed, either by Close or because the
+// connection to the apiserver was lost.
+func (p *PortForward) Done() <-chan error {
+	return p.doneCh
+}
+
+func (p *PortForward) Close() {
+	p.once.Do(func() {
+		close(p.stopCh)
+	})
+}
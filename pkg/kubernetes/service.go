@@ -0,0 +1,183 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/cert"
+	"sigs.k8s.io/yaml"
+)
+
+// PodNameHeader is set by the whoami pods to the name of the pod serving the request.
+const PodNameHeader = "X-Pod-Name"
+
+const (
+	// whoamiManifest runs a small HTTP server which answers every request
+	// with the name of its pod.
+	whoamiManifest = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app: whoami
+  name: whoami
+  namespace: default
+spec:
+  replicas: 5
+  selector:
+    matchLabels:
+      app: whoami
+  template:
+    metadata:
+      labels:
+        app: whoami
+    spec:
+      containers:
+      - image: python:3.9-alpine
+        name: whoami
+        command:
+        - python3
+        - -c
+        - |
+          import socket
+          from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+          NAME = socket.gethostname().encode()
+
+          class Handler(BaseHTTPRequestHandler):
+              protocol_version = "HTTP/1.1"
+
+              def reply(self):
+                  size = int(self.headers.get("Content-Length", "0"))
+                  if size:
+                      self.rfile.read(size)
+                  self.send_response(200)
+                  self.send_header("X-Pod-Name", NAME.decode())
+                  self.send_header("Content-Length", str(len(NAME)))
+                  self.end_headers()
+                  self.wfile.write(NAME)
+
+              do_GET = do_POST = do_PUT = do_DELETE = reply
+
+              def log_message(self, *args):
+                  pass
+
+          ThreadingHTTPServer(("", 8080), Handler).serve_forever()
+        ports:
+        - containerPort: 8080
+          name: http
+`
+	whoamiServiceManifest = `
+apiVersion: v1
+kind: Service
+metadata:
+  labels:
+    app: whoami
+  name: whoami
+  namespace: default
+spec:
+  selector:
+    app: whoami
+  ports:
+  - name: http
+    port: 80
+    targetPort: http
+`
+)
+
+// CreateWhoamiDeployment creates a Deployment, and a Service named whoami in
+// front of it, whose pods tell which pod served a request, see whoamiManifest.
+func CreateWhoamiDeployment() (*appsv1.Deployment, *corev1.Service, error) {
+	d, err := createDeployment(whoamiManifest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cs, err := GetK8sClientset()
+	if err != nil {
+		return d, nil, fmt.Errorf("getting clientset, %v", err)
+	}
+
+	svc, err := createService(cs, whoamiServiceManifest)
+	if err != nil {
+		return d, nil, err
+	}
+
+	return d, svc, nil
+}
+
+func createService(cs kubernetes.Interface, manifest string) (*corev1.Service, error) {
+	svc := &corev1.Service{}
+	if err := yaml.Unmarshal([]byte(manifest), svc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal service manifest: %v", err)
+	}
+
+	if _, err := cs.CoreV1().Services(svc.Namespace).Create(context.TODO(), svc, metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to create %s service: %v", svc.Name, err)
+	}
+
+	return svc, nil
+}
+
+func DeleteService(svc *corev1.Service) error {
+	cs, err := GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	if err := cs.CoreV1().Services(svc.Namespace).Delete(context.TODO(), svc.Name, metav1.DeleteOptions{}); err != nil {
+		return fmt.Errorf("failed to delete %s service: %v", svc.Name, err)
+	}
+
+	return nil
+}
+
+// HTTPClientFor returns a plain HTTP client authenticated to the apiserver,
+// for requests whose response headers matter.
+func HTTPClientFor(config *rest.Config) (*http.Client, error) {
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{Transport: transport, Timeout: config.Timeout}, nil
+}
+
+// createTLSSecret creates a TLS Secret named after the Service, holding a
+// self-signed certificate for its in-cluster DNS name. The certificate
+// doubles as the CA bundle clients of the Service verify it with.
+func createTLSSecret(cs kubernetes.Interface, svc *corev1.Service) (*corev1.Secret, error) {
+	crt, key, err := cert.GenerateSelfSignedCertKey(fmt.Sprintf("%s.%s.svc", svc.Name, svc.Namespace), nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("generating certificate: %v", err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: svc.Name, Namespace: svc.Namespace},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       crt,
+			corev1.TLSPrivateKeyKey: key,
+		},
+	}
+
+	if _, err := cs.CoreV1().Secrets(secret.Namespace).Create(context.TODO(), secret, metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to create %s secret: %v", secret.Name, err)
+	}
+
+	return secret, nil
+}
+
+func deleteSecret(cs kubernetes.Interface, secret *corev1.Secret) error {
+	if err := cs.CoreV1().Secrets(secret.Namespace).Delete(context.TODO(), secret.Name, metav1.DeleteOptions{}); err != nil {
+		return fmt.Errorf("failed to delete %s secret: %v", secret.Name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+const (
+	// webhookManifest allows every AdmissionReview it is sent, over TLS.
+	webhookManifest = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app: konnscen-webhook
+  name: konnscen-webhook
+  namespace: default
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: konnscen-webhook
+  template:
+    metadata:
+      labels:
+        app: konnscen-webhook
+    spec:
+      containers:
+      - image: python:3.9-alpine
+        name: webhook
+        command:
+        - python3
+        - -c
+        - |
+          import json, ssl
+          from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+          class Handler(BaseHTTPRequestHandler):
+              protocol_version = "HTTP/1.1"
+
+              def do_POST(self):
+                  review = json.loads(self.rfile.read(int(self.headers["Content-Length"])))
+                  body = json.dumps({
+                      "apiVersion": "admission.k8s.io/v1",
+                      "kind": "AdmissionReview",
+                      "response": {"uid": review["request"]["uid"], "allowed": True},
+                  }).encode()
+                  self.send_response(200)
+                  self.send_header("Content-Type", "application/json")
+                  self.send_header("Content-Length", str(len(body)))
+                  self.end_headers()
+                  self.wfile.write(body)
+
+              def log_message(self, *args):
+                  pass
+
+          server = ThreadingHTTPServer(("", 8443), Handler)
+          ctx = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+          ctx.load_cert_chain("/tls/tls.crt", "/tls/tls.key")
+          server.socket = ctx.wrap_socket(server.socket, server_side=True)
+          server.serve_forever()
+        ports:
+        - containerPort: 8443
+          name: https
+        volumeMounts:
+        - name: tls
+          mountPath: /tls
+          readOnly: true
+      volumes:
+      - name: tls
+        secret:
+          secretName: konnscen-webhook
+`
+	webhookServiceManifest = `
+apiVersion: v1
+kind: Service
+metadata:
+  labels:
+    app: konnscen-webhook
+  name: konnscen-webhook
+  namespace: default
+spec:
+  selector:
+    app: konnscen-webhook
+  ports:
+  - name: https
+    port: 443
+    targetPort: https
+`
+	// WebhookNamespace is the only namespace the konnscen webhook is called for.
+	WebhookNamespace = "konnscen-webhook"
+
+	webhookName              = "konnscen-webhook"
+	webhookConfigurationName = "konnscen.io"
+	webhookNamespaceLabel    = "konnscen.io/webhook"
+)
+
+// CreateWebhook deploys the webhook of webhookManifest and registers it for
+// creating and deleting ConfigMaps in WebhookNamespace. Whatever it created
+// is removed by DeleteWebhook, also when it failed half way.
+func CreateWebhook(timeoutSeconds int32) error {
+	cs, err := GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	svc, err := createService(cs, webhookServiceManifest)
+	if err != nil {
+		return err
+	}
+
+	secret, err := createTLSSecret(cs, svc)
+	if err != nil {
+		return err
+	}
+
+	if _, err := createDeployment(webhookManifest); err != nil {
+		return err
+	}
+
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   WebhookNamespace,
+			Labels: map[string]string{webhookNamespaceLabel: "true"},
+		},
+	}
+	if _, err := cs.CoreV1().Namespaces().Create(context.TODO(), ns, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create %s namespace: %v", ns.Name, err)
+	}
+
+	path := "/validate"
+	port := int32(443)
+	failurePolicy := admissionregistrationv1.Fail
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	scope := admissionregistrationv1.NamespacedScope
+
+	configuration := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: webhookConfigurationName},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{{
+			Name: "configmaps.konnscen.io",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Namespace: svc.Namespace,
+					Name:      svc.Name,
+					Path:      &path,
+					Port:      &port,
+				},
+				CABundle: secret.Data[corev1.TLSCertKey],
+			},
+			Rules: []admissionregistrationv1.RuleWithOperations{{
+				Operations: []admissionregistrationv1.OperationType{
+					admissionregistrationv1.Create,
+					admissionregistrationv1.Delete,
+				},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{""},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"configmaps"},
+					Scope:       &scope,
+				},
+			}},
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{webhookNamespaceLabel: "true"},
+			},
+			FailurePolicy:           &failurePolicy,
+			SideEffects:             &sideEffects,
+			TimeoutSeconds:          &timeoutSeconds,
+			AdmissionReviewVersions: []string{"v1"},
+		}},
+	}
+	if _, err := cs.AdmissionregistrationV1().ValidatingWebhookConfigurations().Create(context.TODO(), configuration, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create %s webhook configuration: %v", configuration.Name, err)
+	}
+
+	fmt.Printf("%s ValidatingWebhookConfiguration created\n", configuration.Name)
+
+	return nil
+}
+
+// DeleteWebhook removes whatever CreateWebhook created, the webhook
+// configuration first so admission does not keep failing on it.
+func DeleteWebhook() error {
+	cs, err := GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	ctx := context.TODO()
+	opts := metav1.DeleteOptions{}
+
+	var errs []error
+	deleted := func(kind, name string, err error) {
+		if err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("failed to delete %s %s: %v", name, kind, err))
+		}
+	}
+
+	deleted("webhook configuration", webhookConfigurationName,
+		cs.AdmissionregistrationV1().ValidatingWebhookConfigurations().Delete(ctx, webhookConfigurationName, opts))
+	deleted("namespace", WebhookNamespace, cs.CoreV1().Namespaces().Delete(ctx, WebhookNamespace, opts))
+	deleted("deployment", webhookName, cs.AppsV1().Deployments("default").Delete(ctx, webhookName, opts))
+	deleted("service", webhookName, cs.CoreV1().Services("default").Delete(ctx, webhookName, opts))
+	deleted("secret", webhookName, cs.CoreV1().Secrets("default").Delete(ctx, webhookName, opts))
+
+	return utilerrors.NewAggregate(errs)
+}
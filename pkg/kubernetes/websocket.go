@@ -0,0 +1,542 @@
+package kubernetes
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/remotecommand"
+	"k8s.io/client-go/rest"
+	remotecommandclient "k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/exec"
+)
+
+const (
+	// TransportSPDY streams exec, attach and port-forward over SPDY, the
+	// way kubectl always did.
+	TransportSPDY = "spdy"
+	// TransportWebSocket streams them over WebSockets speaking the
+	// channel.k8s.io protocols.
+	TransportWebSocket = "websocket"
+	// transportBoth selects both transports in turn.
+	transportBoth = "both"
+
+	// channelProtocolV5 adds closing a channel to channelProtocolV4, which
+	// is the only way to tell a command its stdin ended.
+	channelProtocolV5 = "v5.channel.k8s.io"
+	channelProtocolV4 = "v4.channel.k8s.io"
+
+	channelStdin  = 0
+	channelStdout = 1
+	channelStderr = 2
+	channelError  = 3
+	channelResize = 4
+	channelClose  = 255
+
+	portForwardChannelData  = 0
+	portForwardChannelError = 1
+)
+
+// ErrStdinNotClosable is returned by exec and attach over a WebSocket when
+// stdin ended on a server without v5.channel.k8s.io. The WebSocket then had
+// to be closed, losing the output and the exit status of the command.
+var ErrStdinNotClosable = errors.New("end of stdin needs " + channelProtocolV5 + ", the command was cut off")
+
+// Transports returns the transports of a transport option, which is spdy,
+// websocket or both. Empty means spdy.
+func Transports(option string) ([]string, error) {
+	switch option {
+	case "", TransportSPDY:
+		return []string{TransportSPDY}, nil
+	case TransportWebSocket:
+		return []string{TransportWebSocket}, nil
+	case transportBoth:
+		return []string{TransportSPDY, TransportWebSocket}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q, must be %s, %s or %s", option, TransportSPDY, TransportWebSocket, transportBoth)
+	}
+}
+
+// newExecutor returns the executor streaming exec or attach at u over the
+// transport.
+func newExecutor(config *rest.Config, u *url.URL, transport string) (remotecommandclient.Executor, error) {
+	switch transport {
+	case "", TransportSPDY:
+		return remotecommandclient.NewSPDYExecutor(config, http.MethodPost, u)
+	case TransportWebSocket:
+		return &wsExecutor{config: config, url: u}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", transport)
+	}
+}
+
+// wsRoundTripper upgrades requests to WebSockets. It is wrapped with the
+// authentication of the rest config like the SPDY round tripper, so the
+// upgrade request carries the same credentials.
+type wsRoundTripper struct {
+	tlsConfig *tls.Config
+	protocols []string
+	conn      *websocket.Conn
+}
+
+func (rt *wsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+
+	config, err := websocket.NewConfig(u.String(), "http://localhost")
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = rt.protocols
+	config.TlsConfig = rt.tlsConfig
+	for k, v := range req.Header {
+		config.Header[k] = v
+	}
+
+	if rt.conn, err = websocket.DialConfig(config); err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+// dialWebSocket opens a WebSocket to u speaking one of the protocols, most
+// preferred first, and returns it with the protocol picked by the server.
+func dialWebSocket(config *rest.Config, u *url.URL, protocols ...string) (*websocket.Conn, string, error) {
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	upgrader := &wsRoundTripper{tlsConfig: tlsConfig, protocols: protocols}
+	rt, err := rest.HTTPWrappersForConfig(config, upgrader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, "", err
+	}
+	resp.Body.Close()
+
+	protocol := ""
+	if p := upgrader.conn.Config().Protocol; len(p) == 1 {
+		protocol = p[0]
+	}
+
+	return upgrader.conn, protocol, nil
+}
+
+// channelConn demultiplexes a channel.k8s.io WebSocket, whose messages
+// start with the number of the channel they belong to.
+type channelConn struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+	readers []*io.PipeReader
+	writers []*io.PipeWriter
+	once    sync.Once
+	// closed is closed by Close, after which reading errors end the
+	// channels like the server closing the WebSocket does.
+	closed chan struct{}
+}
+
+// newChannelConn reads the channels below channels from the WebSocket until
+// it is closed. Every channel must be read, or the others stall.
+func newChannelConn(ws *websocket.Conn, channels int) *channelConn {
+	c := &channelConn{ws: ws, closed: make(chan struct{})}
+	for i := 0; i < channels; i++ {
+		r, w := io.Pipe()
+		c.readers = append(c.readers, r)
+		c.writers = append(c.writers, w)
+	}
+
+	go c.readLoop()
+
+	return c
+}
+
+func (c *channelConn) readLoop() {
+	var err error
+	for {
+		var msg []byte
+		if err = websocket.Message.Receive(c.ws, &msg); err != nil {
+			break
+		}
+
+		// Servers open every channel with an empty message.
+		if len(msg) < 2 || int(msg[0]) >= len(c.writers) {
+			continue
+		}
+
+		if _, err = c.writers[msg[0]].Write(msg[1:]); err != nil {
+			break
+		}
+	}
+
+	select {
+	case <-c.closed:
+		err = nil
+	default:
+		if err == io.EOF {
+			err = nil
+		}
+	}
+
+	for _, w := range c.writers {
+		w.CloseWithError(err)
+	}
+}
+
+// channel returns the reading end of a channel.
+func (c *channelConn) channel(ch int) io.Reader {
+	return c.readers[ch]
+}
+
+func (c *channelConn) write(ch byte, p []byte) (int, error) {
+	msg := make([]byte, 0, len(p)+1)
+	msg = append(msg, ch)
+	msg = append(msg, p...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := websocket.Message.Send(c.ws, msg); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *channelConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.ws.Close()
+	})
+
+	return err
+}
+
+// channelWriter writes to a single channel of a channelConn.
+type channelWriter struct {
+	conn *channelConn
+	ch   byte
+}
+
+func (w channelWriter) Write(p []byte) (int, error) {
+	return w.conn.write(w.ch, p)
+}
+
+// wsExecutor streams exec and attach over a WebSocket, like the executor of
+// remotecommand does over SPDY.
+type wsExecutor struct {
+	config *rest.Config
+	url    *url.URL
+}
+
+func (e *wsExecutor) Stream(options remotecommandclient.StreamOptions) error {
+	ws, protocol, err := dialWebSocket(e.config, e.url, channelProtocolV5, channelProtocolV4)
+	if err != nil {
+		return err
+	}
+
+	conn := newChannelConn(ws, channelError+1)
+	defer conn.Close()
+
+	// hungUp is closed when the WebSocket was closed for the end of stdin.
+	hungUp := make(chan struct{})
+
+	errCh := make(chan error, 1)
+	go func() {
+		message, err := ioutil.ReadAll(conn.channel(channelError))
+		switch {
+		case err != nil:
+			errCh <- fmt.Errorf("error reading from error stream: %v", err)
+		case len(message) > 0:
+			errCh <- decodeStatus(message)
+		default:
+			select {
+			case <-hungUp:
+				errCh <- ErrStdinNotClosable
+			default:
+				errCh <- nil
+			}
+		}
+	}()
+
+	if options.Stdin != nil {
+		go func() {
+			io.Copy(channelWriter{conn, channelStdin}, options.Stdin)
+
+			// Without v5 the end of stdin can only be told by closing
+			// the WebSocket altogether.
+			if protocol == channelProtocolV5 {
+				conn.write(channelClose, []byte{channelStdin})
+			} else {
+				close(hungUp)
+				conn.Close()
+			}
+		}()
+	}
+
+	if options.Tty && options.TerminalSizeQueue != nil {
+		go func() {
+			for size := options.TerminalSizeQueue.Next(); size != nil; size = options.TerminalSizeQueue.Next() {
+				data, err := json.Marshal(size)
+				if err != nil {
+					return
+				}
+
+				if _, err := conn.write(channelResize, data); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	stdout, stderr := options.Stdout, options.Stderr
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(stdout, conn.channel(channelStdout))
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(stderr, conn.channel(channelStderr))
+	}()
+
+	wg.Wait()
+
+	return <-errCh
+}
+
+// decodeStatus interprets the metav1.Status sent on the error channel the
+// way remotecommand does for SPDY.
+func decodeStatus(message []byte) error {
+	status := metav1.Status{}
+	if err := json.Unmarshal(message, &status); err != nil {
+		return fmt.Errorf("error stream protocol error: %v in %q", err, string(message))
+	}
+
+	switch status.Status {
+	case metav1.StatusSuccess:
+		return nil
+	case metav1.StatusFailure:
+		if status.Reason != remotecommand.NonZeroExitCodeReason || status.Details == nil {
+			return errors.New(status.Message)
+		}
+
+		for _, c := range status.Details.Causes {
+			if c.Type != remotecommand.ExitCodeCauseType {
+				continue
+			}
+
+			rc, err := strconv.ParseUint(c.Message, 10, 8)
+			if err != nil {
+				return fmt.Errorf("error stream protocol error: invalid exit code value %q", c.Message)
+			}
+
+			return exec.CodeExitError{
+				Err:  fmt.Errorf("command terminated with exit code %d", rc),
+				Code: int(rc),
+			}
+		}
+
+		return errors.New(status.Message)
+	default:
+		return errors.New("error stream protocol error: unknown error")
+	}
+}
+
+// wsPortForwardDialer lets a portforward.PortForwarder forward over
+// WebSockets. The WebSocket protocol forwards a single connection per
+// WebSocket, so one is opened for every forwarded connection.
+type wsPortForwardDialer struct {
+	config *rest.Config
+	// url has the forwarded port in its ports parameter.
+	url *url.URL
+}
+
+func (d *wsPortForwardDialer) Dial(protocols ...string) (httpstream.Connection, string, error) {
+	// Open a WebSocket once, so that an unreachable pod fails the dial like
+	// it does with SPDY, where the dial opens the connection streams use.
+	ws, _, err := dialWebSocket(d.config, d.url, channelProtocolV4)
+	if err != nil {
+		return nil, "", err
+	}
+	ws.Close()
+
+	c := &wsPortForwardConnection{
+		dialer:  d,
+		streams: map[string]*wsPortForwardStreams{},
+		closeCh: make(chan bool),
+	}
+
+	return c, protocols[0], nil
+}
+
+// wsPortForwardConnection hands out the data and error channels of a
+// WebSocket per forwarded connection, as the streams of that connection.
+type wsPortForwardConnection struct {
+	dialer  *wsPortForwardDialer
+	mu      sync.Mutex
+	streams map[string]*wsPortForwardStreams
+	closeCh chan bool
+	once    sync.Once
+	nextID  uint32
+}
+
+// wsPortForwardStreams are the streams of a forwarded connection.
+type wsPortForwardStreams struct {
+	conn                    *channelConn
+	dataCreated, errCreated bool
+}
+
+func (c *wsPortForwardConnection) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	requestID := headers.Get(corev1.PortForwardRequestIDHeader)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	streams, ok := c.streams[requestID]
+	if !ok {
+		ws, _, err := dialWebSocket(c.dialer.config, c.dialer.url, channelProtocolV4)
+		if err != nil {
+			return nil, err
+		}
+
+		streams = &wsPortForwardStreams{conn: newChannelConn(ws, portForwardChannelError+1)}
+		c.streams[requestID] = streams
+	}
+
+	ch := portForwardChannelData
+	if headers.Get(corev1.StreamType) == corev1.StreamTypeError {
+		ch = portForwardChannelError
+		streams.errCreated = true
+	} else {
+		streams.dataCreated = true
+	}
+
+	// Once both streams were handed out nobody asks for the connection
+	// again.
+	if streams.dataCreated && streams.errCreated {
+		delete(c.streams, requestID)
+	}
+
+	c.nextID++
+
+	return &wsPortForwardStream{
+		conn:    streams.conn,
+		ch:      byte(ch),
+		headers: headers,
+		id:      c.nextID,
+	}, nil
+}
+
+func (c *wsPortForwardConnection) Close() error {
+	c.once.Do(func() {
+		close(c.closeCh)
+	})
+
+	return nil
+}
+
+func (c *wsPortForwardConnection) CloseChan() <-chan bool {
+	return c.closeCh
+}
+
+func (c *wsPortForwardConnection) SetIdleTimeout(timeout time.Duration) {}
+
+func (c *wsPortForwardConnection) RemoveStreams(streams ...httpstream.Stream) {}
+
+// wsPortForwardStream is the data or error channel of a forwarded
+// connection. The server starts both with the port they forward.
+type wsPortForwardStream struct {
+	conn    *channelConn
+	ch      byte
+	headers http.Header
+	id      uint32
+
+	readPort bool
+}
+
+func (s *wsPortForwardStream) Read(p []byte) (int, error) {
+	if !s.readPort {
+		port := make([]byte, 2)
+		if _, err := io.ReadFull(s.conn.channel(int(s.ch)), port); err != nil {
+			return 0, err
+		}
+		s.readPort = true
+
+		if got, want := strconv.Itoa(int(binary.LittleEndian.Uint16(port))), s.headers.Get(corev1.PortHeader); got != want {
+			return 0, fmt.Errorf("server forwards port %s, not %s", got, want)
+		}
+	}
+
+	return s.conn.channel(int(s.ch)).Read(p)
+}
+
+func (s *wsPortForwardStream) Write(p []byte) (int, error) {
+	return s.conn.write(s.ch, p)
+}
+
+// Close closes the WebSocket when the data stream is closed, which cannot
+// be half-closed. The error stream is closed right after being created, as
+// nothing is written to it.
+func (s *wsPortForwardStream) Close() error {
+	if s.ch == portForwardChannelData {
+		return s.conn.Close()
+	}
+
+	return nil
+}
+
+func (s *wsPortForwardStream) Reset() error {
+	return s.conn.Close()
+}
+
+func (s *wsPortForwardStream) Headers() http.Header {
+	return s.headers
+}
+
+func (s *wsPortForwardStream) Identifier() uint32 {
+	return s.id
+}
@@ -0,0 +1,81 @@
+package load
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const maxInFlight = 1000
+
+// ArrivalRate is an open-model executor: it starts operations at a
+// constant rate for DurationSeconds, however long the ones already started
+// take. Unlike the virtual users of a Profile, which only start their next
+// operation once the previous one completed, it does not slow down along
+// with the system under test, so latency growth under load shows up as
+// latency rather than as fewer operations.
+type ArrivalRate struct {
+	RatePerSecond   float64 `yaml:"rate_per_second"`
+	DurationSeconds int     `yaml:"duration_seconds"`
+	// MaxInFlight caps the operations running at once, 1000 by default.
+	// Operations due while at the cap are dropped and counted.
+	MaxInFlight int `yaml:"max_in_flight"`
+}
+
+func (a *ArrivalRate) Validate() error {
+	if a.RatePerSecond <= 0 || a.DurationSeconds <= 0 {
+		return fmt.Errorf("arrival rate: rate_per_second and duration_seconds must be positive")
+	}
+
+	return nil
+}
+
+// Run starts op every 1/RatePerSecond until DurationSeconds elapsed, waits
+// for the started operations and returns how many were dropped.
+//
+// Operations are passed the time they were scheduled for. Measuring their
+// latency from it rather than from when they actually started corrects for
+// coordinated omission: when the executor falls behind, the delay counts
+// against the operations it held up instead of disappearing.
+func (a *ArrivalRate) Run(op func(scheduled time.Time)) int {
+	max := a.MaxInFlight
+	if max <= 0 {
+		max = maxInFlight
+	}
+
+	inFlight := make(chan struct{}, max)
+	interval := float64(time.Second) / a.RatePerSecond
+	start := time.Now()
+	end := start.Add(time.Duration(a.DurationSeconds) * time.Second)
+
+	var wg sync.WaitGroup
+	dropped := 0
+	for i := 0; ; i++ {
+		// Schedules are computed from the start, so sleeping late does not
+		// shift the ones after.
+		scheduled := start.Add(time.Duration(float64(i) * interval))
+		if !scheduled.Before(end) {
+			break
+		}
+		time.Sleep(time.Until(scheduled))
+
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			dropped++
+			continue
+		}
+
+		wg.Add(1)
+		go func(scheduled time.Time) {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+
+			op(scheduled)
+		}(scheduled)
+	}
+
+	wg.Wait()
+
+	return dropped
+}
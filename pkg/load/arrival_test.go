@@ -0,0 +1,100 @@
+package load
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestArrivalRateValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		rate  ArrivalRate
+		valid bool
+	}{
+		{"valid", ArrivalRate{RatePerSecond: 10, DurationSeconds: 60}, true},
+		{"fractional rate", ArrivalRate{RatePerSecond: 0.5, DurationSeconds: 60}, true},
+		{"no rate", ArrivalRate{DurationSeconds: 60}, false},
+		{"negative rate", ArrivalRate{RatePerSecond: -1, DurationSeconds: 60}, false},
+		{"no duration", ArrivalRate{RatePerSecond: 10}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.rate.Validate()
+			if tc.valid && err != nil {
+				t.Errorf("got error %v, want the arrival rate valid", err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("got the arrival rate valid, want an error")
+			}
+		})
+	}
+}
+
+// TestArrivalRateSchedule checks operations are passed the time they were
+// due, evenly spaced from the start, and never start before it.
+func TestArrivalRateSchedule(t *testing.T) {
+	a := ArrivalRate{RatePerSecond: 20, DurationSeconds: 1}
+
+	var mu sync.Mutex
+	var scheduled []time.Time
+	dropped := a.Run(func(s time.Time) {
+		if late := time.Since(s); late < 0 {
+			t.Errorf("operation due at %v started %v early", s, -late)
+		}
+
+		mu.Lock()
+		scheduled = append(scheduled, s)
+		mu.Unlock()
+	})
+
+	if dropped != 0 {
+		t.Errorf("got %d operations dropped, want none", dropped)
+	}
+
+	if len(scheduled) != 20 {
+		t.Fatalf("got %d operations, want 20", len(scheduled))
+	}
+
+	sort.Slice(scheduled, func(i, j int) bool { return scheduled[i].Before(scheduled[j]) })
+	for i := 1; i < len(scheduled); i++ {
+		if gap := scheduled[i].Sub(scheduled[i-1]); gap != 50*time.Millisecond {
+			t.Errorf("operations %d and %d due %v apart, want 50ms", i-1, i, gap)
+		}
+	}
+}
+
+// TestArrivalRateDrops checks operations due while max_in_flight are
+// running are dropped and counted, and the running ones waited for.
+func TestArrivalRateDrops(t *testing.T) {
+	a := ArrivalRate{RatePerSecond: 100, DurationSeconds: 1, MaxInFlight: 5}
+
+	release := make(chan struct{})
+	time.AfterFunc(1500*time.Millisecond, func() { close(release) })
+
+	var mu sync.Mutex
+	started, finished := 0, 0
+	dropped := a.Run(func(time.Time) {
+		mu.Lock()
+		started++
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		finished++
+		mu.Unlock()
+	})
+
+	if started != 5 {
+		t.Errorf("got %d operations started, want max_in_flight of 5", started)
+	}
+
+	if finished != started {
+		t.Errorf("got %d of %d operations finished when Run returned", finished, started)
+	}
+
+	if dropped != 95 {
+		t.Errorf("got %d operations dropped, want 95", dropped)
+	}
+}
@@ -0,0 +1,272 @@
+package load
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	ShapeRamp  = "ramp"
+	ShapeSteps = "steps"
+	ShapeSpike = "spike"
+	ShapeSine  = "sine"
+
+	intervalSeconds = 1
+)
+
+// Profile is the number of active virtual users over the run of a scenario,
+// in one of four shapes:
+//
+//   - ramp goes linearly from From to To users over DurationSeconds.
+//   - steps holds each number of users of Steps for StepSeconds.
+//   - spike holds From users, jumps to To users SpikeAfterSeconds in for
+//     SpikeSeconds and drops back to From until DurationSeconds.
+//   - sine swings between From and To users every PeriodSeconds, starting
+//     at From, for DurationSeconds.
+//
+// Every scenario takes a profile as its load option, in place of its fixed
+// number of users, workers, sessions or tunnels.
+type Profile struct {
+	Shape             string `yaml:"shape"`
+	From              int    `yaml:"from"`
+	To                int    `yaml:"to"`
+	DurationSeconds   int    `yaml:"duration_seconds"`
+	Steps             []int  `yaml:"steps"`
+	StepSeconds       int    `yaml:"step_seconds"`
+	SpikeAfterSeconds int    `yaml:"spike_after_seconds"`
+	SpikeSeconds      int    `yaml:"spike_seconds"`
+	PeriodSeconds     int    `yaml:"period_seconds"`
+	// IntervalSeconds is how often the number of users is adjusted.
+	IntervalSeconds int `yaml:"interval_seconds"`
+}
+
+func (p *Profile) Validate() error {
+	if p.From < 0 || p.To < 0 {
+		return fmt.Errorf("load profile: from and to must not be negative")
+	}
+
+	switch p.Shape {
+	case ShapeRamp:
+		if p.DurationSeconds <= 0 {
+			return fmt.Errorf("load profile: ramp needs duration_seconds")
+		}
+	case ShapeSteps:
+		if len(p.Steps) == 0 || p.StepSeconds <= 0 {
+			return fmt.Errorf("load profile: steps needs steps and step_seconds")
+		}
+
+		for _, users := range p.Steps {
+			if users < 0 {
+				return fmt.Errorf("load profile: steps must not be negative")
+			}
+		}
+	case ShapeSpike:
+		if p.DurationSeconds <= 0 || p.SpikeSeconds <= 0 {
+			return fmt.Errorf("load profile: spike needs duration_seconds and spike_seconds")
+		}
+
+		if p.SpikeAfterSeconds < 0 || p.SpikeAfterSeconds+p.SpikeSeconds > p.DurationSeconds {
+			return fmt.Errorf("load profile: spike must end within duration_seconds")
+		}
+	case ShapeSine:
+		if p.DurationSeconds <= 0 || p.PeriodSeconds <= 0 {
+			return fmt.Errorf("load profile: sine needs duration_seconds and period_seconds")
+		}
+	default:
+		return fmt.Errorf("load profile: shape %q is not one of %s, %s, %s or %s", p.Shape, ShapeRamp, ShapeSteps, ShapeSpike, ShapeSine)
+	}
+
+	return nil
+}
+
+// Duration is how long the profile runs for.
+func (p *Profile) Duration() time.Duration {
+	if p.Shape == ShapeSteps {
+		return time.Duration(len(p.Steps)*p.StepSeconds) * time.Second
+	}
+
+	return time.Duration(p.DurationSeconds) * time.Second
+}
+
+// Users returns the number of active users the profile asks for after it
+// ran for elapsed.
+func (p *Profile) Users(elapsed time.Duration) int {
+	seconds := elapsed.Seconds()
+
+	switch p.Shape {
+	case ShapeRamp:
+		progress := math.Min(seconds/float64(p.DurationSeconds), 1)
+		return int(math.Round(float64(p.From) + float64(p.To-p.From)*progress))
+	case ShapeSteps:
+		step := int(seconds) / p.StepSeconds
+		if step >= len(p.Steps) {
+			step = len(p.Steps) - 1
+		}
+		return p.Steps[step]
+	case ShapeSpike:
+		if seconds >= float64(p.SpikeAfterSeconds) && seconds < float64(p.SpikeAfterSeconds+p.SpikeSeconds) {
+			return p.To
+		}
+		return p.From
+	case ShapeSine:
+		mid, amplitude := float64(p.From+p.To)/2, float64(p.To-p.From)/2
+		return int(math.Round(mid - amplitude*math.Cos(2*math.Pi*seconds/float64(p.PeriodSeconds))))
+	default:
+		return 0
+	}
+}
+
+// User is a virtual user. It runs until stop is closed, finishing the
+// operation in progress first.
+type User func(id int, stop <-chan struct{})
+
+// Runner starts and stops virtual users following a profile and keeps
+// track of the load level, the number of active users.
+type Runner struct {
+	profile *Profile
+	done    chan struct{}
+	once    sync.Once
+
+	mu    sync.Mutex
+	level int
+}
+
+func NewRunner(p *Profile) *Runner {
+	return &Runner{profile: p, done: make(chan struct{})}
+}
+
+// Done is closed once the profile is over or Stop was called, before the
+// remaining users are stopped, so they can tell from being stopped early.
+func (r *Runner) Done() <-chan struct{} {
+	return r.done
+}
+
+// Stop ends the profile early.
+func (r *Runner) Stop() {
+	r.once.Do(func() { close(r.done) })
+}
+
+// Level returns the current number of active users.
+func (r *Runner) Level() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.level
+}
+
+// Group tags the group with the current load level, so samples are
+// reported per level.
+func (r *Runner) Group(group string) string {
+	return fmt.Sprintf("users-%04d/%s", r.Level(), group)
+}
+
+// Run adjusts the active users to the profile every interval until its
+// duration elapsed or Stop was called and waits for all of them to return.
+// The users started last are stopped first. User IDs are never reused, so
+// no two users share one even while a stopped user is still finishing.
+func (r *Runner) Run(user User) {
+	interval := time.Duration(r.profile.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = intervalSeconds * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	var stops []chan struct{}
+	next := 0
+	start := time.Now()
+
+profile:
+	for elapsed := time.Duration(0); elapsed < r.profile.Duration(); elapsed = time.Since(start) {
+		users := r.profile.Users(elapsed)
+
+		r.mu.Lock()
+		changed := users != r.level
+		r.level = users
+		r.mu.Unlock()
+
+		if changed {
+			fmt.Printf("Load level %d users at %v\n", users, elapsed.Round(time.Second))
+		}
+
+		for len(stops) > users {
+			close(stops[len(stops)-1])
+			stops = stops[:len(stops)-1]
+		}
+
+		for len(stops) < users {
+			stop := make(chan struct{})
+			stops = append(stops, stop)
+
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				user(id, stop)
+			}(next)
+			next++
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.done:
+			break profile
+		}
+	}
+
+	r.Stop()
+	for _, stop := range stops {
+		close(stop)
+	}
+
+	wg.Wait()
+}
+
+// Users runs a fixed number of users until duration elapsed and waits for
+// all of them to return, for scenarios run without a profile.
+func Users(users int, duration time.Duration, user User) {
+	stop := make(chan struct{})
+	timer := time.AfterFunc(duration, func() { close(stop) })
+	defer timer.Stop()
+
+	var wg sync.WaitGroup
+	wg.Add(users)
+	for id := 0; id < users; id++ {
+		go func(id int) {
+			defer wg.Done()
+			user(id, stop)
+		}(id)
+	}
+
+	wg.Wait()
+}
+
+// Untagged leaves the group as it is, for results of users run without a
+// profile.
+func Untagged(group string) string {
+	return group
+}
+
+// Wait waits for the next tick, or not at all when ticks is nil, and
+// reports whether stop was not closed meanwhile.
+func Wait(ticks <-chan time.Time, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+
+	if ticks == nil {
+		return true
+	}
+
+	select {
+	case <-ticks:
+		return true
+	case <-stop:
+		return false
+	}
+}
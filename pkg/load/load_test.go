@@ -0,0 +1,198 @@
+package load
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProfileValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		profile Profile
+		valid   bool
+	}{
+		{"ramp", Profile{Shape: ShapeRamp, From: 1, To: 10, DurationSeconds: 60}, true},
+		{"ramp without duration", Profile{Shape: ShapeRamp, To: 10}, false},
+		{"negative from", Profile{Shape: ShapeRamp, From: -1, To: 10, DurationSeconds: 60}, false},
+		{"steps", Profile{Shape: ShapeSteps, Steps: []int{1, 5, 10}, StepSeconds: 30}, true},
+		{"steps without steps", Profile{Shape: ShapeSteps, StepSeconds: 30}, false},
+		{"steps without step_seconds", Profile{Shape: ShapeSteps, Steps: []int{1}}, false},
+		{"negative step", Profile{Shape: ShapeSteps, Steps: []int{1, -1}, StepSeconds: 30}, false},
+		{"spike", Profile{Shape: ShapeSpike, From: 1, To: 10, DurationSeconds: 60, SpikeAfterSeconds: 20, SpikeSeconds: 10}, true},
+		{"spike to the end", Profile{Shape: ShapeSpike, From: 1, To: 10, DurationSeconds: 60, SpikeAfterSeconds: 50, SpikeSeconds: 10}, true},
+		{"spike past the end", Profile{Shape: ShapeSpike, From: 1, To: 10, DurationSeconds: 60, SpikeAfterSeconds: 55, SpikeSeconds: 10}, false},
+		{"spike before the start", Profile{Shape: ShapeSpike, From: 1, To: 10, DurationSeconds: 60, SpikeAfterSeconds: -5, SpikeSeconds: 10}, false},
+		{"spike without spike_seconds", Profile{Shape: ShapeSpike, From: 1, To: 10, DurationSeconds: 60}, false},
+		{"sine", Profile{Shape: ShapeSine, From: 1, To: 10, DurationSeconds: 60, PeriodSeconds: 20}, true},
+		{"sine without period", Profile{Shape: ShapeSine, From: 1, To: 10, DurationSeconds: 60}, false},
+		{"unknown shape", Profile{Shape: "square", DurationSeconds: 60}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.profile.Validate()
+			if tc.valid && err != nil {
+				t.Errorf("got error %v, want the profile valid", err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("got the profile valid, want an error")
+			}
+		})
+	}
+}
+
+func TestProfileUsers(t *testing.T) {
+	ramp := Profile{Shape: ShapeRamp, From: 0, To: 10, DurationSeconds: 10}
+	steps := Profile{Shape: ShapeSteps, Steps: []int{1, 3, 2}, StepSeconds: 10}
+	spike := Profile{Shape: ShapeSpike, From: 2, To: 8, DurationSeconds: 30, SpikeAfterSeconds: 10, SpikeSeconds: 5}
+	sine := Profile{Shape: ShapeSine, From: 0, To: 10, DurationSeconds: 40, PeriodSeconds: 20}
+
+	for _, tc := range []struct {
+		name    string
+		profile Profile
+		seconds float64
+		want    int
+	}{
+		{"ramp start", ramp, 0, 0},
+		{"ramp middle", ramp, 5, 5},
+		{"ramp end", ramp, 10, 10},
+		{"ramp past the end", ramp, 20, 10},
+		{"first step", steps, 0, 1},
+		{"second step", steps, 15, 3},
+		{"last step", steps, 25, 2},
+		{"past the last step", steps, 40, 2},
+		{"before the spike", spike, 9.9, 2},
+		{"spike start", spike, 10, 8},
+		{"during the spike", spike, 14.9, 8},
+		{"after the spike", spike, 15, 2},
+		{"sine start", sine, 0, 0},
+		{"sine rising", sine, 5, 5},
+		{"sine top", sine, 10, 10},
+		{"sine falling", sine, 15, 5},
+		{"sine second period", sine, 20, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			elapsed := time.Duration(tc.seconds * float64(time.Second))
+			if got := tc.profile.Users(elapsed); got != tc.want {
+				t.Errorf("Users(%v) = %d, want %d", elapsed, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProfileDuration(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		profile Profile
+		want    time.Duration
+	}{
+		{"ramp", Profile{Shape: ShapeRamp, DurationSeconds: 60}, time.Minute},
+		{"steps", Profile{Shape: ShapeSteps, Steps: []int{1, 2, 3}, StepSeconds: 20}, time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.profile.Duration(); got != tc.want {
+				t.Errorf("Duration() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestRunner checks the users follow the steps and are never given the
+// same ID twice.
+func TestRunner(t *testing.T) {
+	r := NewRunner(&Profile{Shape: ShapeSteps, Steps: []int{2, 4, 1}, StepSeconds: 1})
+
+	var mu sync.Mutex
+	ids := map[int]bool{}
+	active, peak := 0, 0
+
+	r.Run(func(id int, stop <-chan struct{}) {
+		mu.Lock()
+		if ids[id] {
+			t.Errorf("user %d started twice", id)
+		}
+		ids[id] = true
+		active++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+
+		<-stop
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+	})
+
+	if active != 0 {
+		t.Errorf("got %d users still active after Run returned", active)
+	}
+
+	if peak != 4 {
+		t.Errorf("got a peak of %d users, want 4", peak)
+	}
+
+	// 2 users, 2 more for the second step, none for the third.
+	if len(ids) != 4 {
+		t.Errorf("got %d users started, want 4", len(ids))
+	}
+}
+
+// TestRunnerStop checks Stop ends the profile early and users stopped by it
+// see Done closed, unlike users stopped while it runs.
+func TestRunnerStop(t *testing.T) {
+	r := NewRunner(&Profile{Shape: ShapeSteps, Steps: []int{2, 1, 1}, StepSeconds: 1})
+
+	var mu sync.Mutex
+	early, done := 0, 0
+	time.AfterFunc(1500*time.Millisecond, r.Stop)
+
+	start := time.Now()
+	r.Run(func(id int, stop <-chan struct{}) {
+		<-stop
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		select {
+		case <-r.Done():
+			done++
+		default:
+			early++
+		}
+	})
+
+	if elapsed := time.Since(start); elapsed >= 2*time.Second {
+		t.Errorf("Run returned after %v, want Stop to end the 3s profile after 1.5s", elapsed)
+	}
+
+	// One user stopped for the second step, the other by Stop.
+	if early != 1 || done != 1 {
+		t.Errorf("got %d users stopped early and %d by Stop, want 1 and 1", early, done)
+	}
+}
+
+// TestUsers checks the fixed users are stopped once the duration elapsed.
+func TestUsers(t *testing.T) {
+	var mu sync.Mutex
+	ids := map[int]bool{}
+
+	start := time.Now()
+	Users(3, 100*time.Millisecond, func(id int, stop <-chan struct{}) {
+		<-stop
+
+		mu.Lock()
+		ids[id] = true
+		mu.Unlock()
+	})
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("users stopped after %v, want 100ms", elapsed)
+	}
+
+	for id := 0; id < 3; id++ {
+		if !ids[id] {
+			t.Errorf("user %d did not run", id)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+const aggregateGroup = "aggregate"
+
+// Sample is a single measured operation of a scenario.
+type Sample struct {
+	// Group is the bucket the sample is reported under, e.g. a tunnel or a node.
+	Group string
+	// Start is when the operation was started.
+	Start time.Time
+	// Latency is how long the operation took.
+	Latency time.Duration
+	// Bytes is the amount of data transferred by the operation.
+	Bytes int64
+	// Status is the HTTP status code of the operation, if any.
+	Status int
+	// Class is the failure class of the operation, empty on success.
+	Class string
+	// Err is the error returned by the operation, if any.
+	Err error
+}
+
+// Recorder collects samples from concurrently running operations.
+type Recorder struct {
+	mu      sync.Mutex
+	samples []Sample
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) Record(s Sample) {
+	if s.Err != nil && s.Class == "" {
+		s.Class = "error"
+	}
+
+	r.mu.Lock()
+	r.samples = append(r.samples, s)
+	r.mu.Unlock()
+}
+
+// Samples returns a copy of all the recorded samples.
+func (r *Recorder) Samples() []Sample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Sample(nil), r.samples...)
+}
+
+// Report writes a summary per group followed by the aggregate of all groups.
+func (r *Recorder) Report(w io.Writer) {
+	samples := r.Samples()
+
+	groups := map[string][]Sample{}
+	for _, s := range samples {
+		groups[s.Group] = append(groups[s.Group], s)
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		writeSummary(w, name, groups[name])
+	}
+
+	if len(groups) > 1 {
+		writeSummary(w, aggregateGroup, samples)
+	}
+}
+
+func writeSummary(w io.Writer, name string, samples []Sample) {
+	if len(samples) == 0 {
+		return
+	}
+
+	latencies := make([]time.Duration, 0, len(samples))
+	failures := map[string]int{}
+	statuses := map[int]int{}
+	var bytes int64
+	first, last := samples[0].Start, samples[0].Start.Add(samples[0].Latency)
+
+	for _, s := range samples {
+		latencies = append(latencies, s.Latency)
+		bytes += s.Bytes
+		if s.Class != "" {
+			failures[s.Class]++
+		}
+		if s.Status != 0 {
+			statuses[s.Status]++
+		}
+		if s.Start.Before(first) {
+			first = s.Start
+		}
+		if end := s.Start.Add(s.Latency); end.After(last) {
+			last = end
+		}
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Fprintf(w, "%s: requests=%d p50=%v p90=%v p99=%v max=%v\n", name, len(samples),
+		percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+
+	if bytes > 0 {
+		fmt.Fprintf(w, "\tbytes=%d throughput=%.2f MiB/s\n", bytes, throughput(bytes, last.Sub(first)))
+	}
+
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	for _, code := range codes {
+		fmt.Fprintf(w, "\tstatus[%d]=%d\n", code, statuses[code])
+	}
+
+	classes := make([]string, 0, len(failures))
+	for class := range failures {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	for _, class := range classes {
+		fmt.Fprintf(w, "\tfailures[%s]=%d\n", class, failures[class])
+	}
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func throughput(bytes int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+
+	return float64(bytes) / (1 << 20) / d.Seconds()
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	for _, tc := range []struct {
+		name   string
+		sorted []time.Duration
+		p      int
+		want   time.Duration
+	}{
+		{"empty", nil, 50, 0},
+		{"single", []time.Duration{7}, 99, 7},
+		{"p0", sorted, 0, 1},
+		{"p50", sorted, 50, 5},
+		{"p90", sorted, 90, 9},
+		{"p99", sorted, 99, 9},
+		{"p100", sorted, 100, 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := percentile(tc.sorted, tc.p); got != tc.want {
+				t.Errorf("percentile(%v, %d) = %v, want %v", tc.sorted, tc.p, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		bytes int64
+		d     time.Duration
+		want  float64
+	}{
+		{"one MiB per second", 1 << 20, time.Second, 1},
+		{"ten MiB in two seconds", 10 << 20, 2 * time.Second, 5},
+		{"half a MiB in a second", 1 << 19, time.Second, 0.5},
+		{"no time", 1 << 20, 0, 0},
+		{"negative time", 1 << 20, -time.Second, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := throughput(tc.bytes, tc.d); got != tc.want {
+				t.Errorf("throughput(%d, %v) = %v, want %v", tc.bytes, tc.d, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReport(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name    string
+		samples []Sample
+		want    string
+	}{
+		{
+			name: "nothing recorded",
+			want: "",
+		},
+		{
+			name: "single group",
+			samples: []Sample{
+				{Group: "a", Start: start, Latency: 10 * time.Millisecond, Status: 200},
+				{Group: "a", Start: start, Latency: 30 * time.Millisecond, Status: 200},
+				{Group: "a", Start: start, Latency: 20 * time.Millisecond, Status: 503, Class: "unexpected-status"},
+			},
+			want: "a: requests=3 p50=20ms p90=20ms p99=20ms max=30ms\n" +
+				"\tstatus[200]=2\n" +
+				"\tstatus[503]=1\n" +
+				"\tfailures[unexpected-status]=1\n",
+		},
+		{
+			name: "groups sorted and aggregated",
+			samples: []Sample{
+				{Group: "b", Start: start, Latency: time.Second, Bytes: 1 << 20},
+				{Group: "a", Start: start, Latency: 2 * time.Second, Err: errors.New("reset")},
+			},
+			want: "a: requests=1 p50=2s p90=2s p99=2s max=2s\n" +
+				"\tfailures[error]=1\n" +
+				"b: requests=1 p50=1s p90=1s p99=1s max=1s\n" +
+				"\tbytes=1048576 throughput=1.00 MiB/s\n" +
+				"aggregate: requests=2 p50=1s p90=1s p99=1s max=2s\n" +
+				"\tbytes=1048576 throughput=0.50 MiB/s\n" +
+				"\tfailures[error]=1\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := NewRecorder()
+			for _, s := range tc.samples {
+				rec.Record(s)
+			}
+
+			var buf bytes.Buffer
+			rec.Report(&buf)
+
+			if got := buf.String(); got != tc.want {
+				t.Errorf("got report:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
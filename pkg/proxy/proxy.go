@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+)
+
+// ClassUnexpectedStatus is the failure class of requests answered with a status >= 400.
+const ClassUnexpectedStatus = "unexpected-status"
+
+// Target is a URL requested through an apiserver proxy subresource.
+type Target struct {
+	// Group is what requests to the target are reported under.
+	Group string
+	URL   string
+	// ByPod reports the requests under endpoint/<pod> instead, as told by
+	// the X-Pod-Name response header of the whoami pods. Responses without
+	// the header stay under Group.
+	ByPod bool
+}
+
+type Request struct {
+	Client  *http.Client
+	Targets []Target
+	// RequestsPerSecond is shared by all workers, 0 means no limit.
+	RequestsPerSecond float64
+	Concurrency       int
+	Duration          time.Duration
+	// Load replaces Concurrency and Duration with workers started and
+	// stopped following the profile. Requests are then reported per load
+	// level.
+	Load *load.Profile
+}
+
+// Run requests the targets round-robin from concurrent workers until the
+// duration or the load profile is over and records every request.
+func Run(rec *metrics.Recorder, req Request) {
+	var ticks <-chan time.Time
+	if req.RequestsPerSecond > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / req.RequestsPerSecond))
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	// Every request takes the next target, whichever worker sends it.
+	var mu sync.Mutex
+	next := 0
+	target := func() Target {
+		mu.Lock()
+		defer mu.Unlock()
+
+		t := req.Targets[next%len(req.Targets)]
+		next++
+		return t
+	}
+
+	work := func(tag func(group string) string, stop <-chan struct{}) {
+		for load.Wait(ticks, stop) {
+			s := Get(req.Client, target())
+			s.Group = tag(s.Group)
+			rec.Record(s)
+		}
+	}
+
+	if req.Load != nil {
+		r := load.NewRunner(req.Load)
+		r.Run(func(_ int, stop <-chan struct{}) { work(r.Group, stop) })
+		return
+	}
+
+	load.Users(req.Concurrency, req.Duration, func(_ int, stop <-chan struct{}) { work(load.Untagged, stop) })
+}
+
+// Get requests the target and reads the whole response.
+func Get(client *http.Client, t Target) metrics.Sample {
+	s := metrics.Sample{Group: t.Group, Start: time.Now()}
+
+	resp, err := client.Get(t.URL)
+	if err != nil {
+		s.Latency = time.Since(s.Start)
+		s.Err = err
+		return s
+	}
+
+	s.Bytes, s.Err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	s.Latency = time.Since(s.Start)
+	s.Status = resp.StatusCode
+
+	if pod := resp.Header.Get(k8s.PodNameHeader); t.ByPod && pod != "" {
+		s.Group = "endpoint/" + pod
+	}
+
+	if s.Err == nil && resp.StatusCode >= http.StatusBadRequest {
+		s.Class = ClassUnexpectedStatus
+	}
+
+	return s
+}
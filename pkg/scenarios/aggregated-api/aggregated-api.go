@@ -0,0 +1,266 @@
+package aggregatedapi
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	"github.com/ipochi/konnscen/pkg/proxy"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	requestsPerSecond       = 20
+	concurrency             = 10
+	durationSeconds         = 60
+	timeoutSeconds          = 30
+	availableTimeoutSeconds = 120
+	Name                    = "aggregated-api"
+)
+
+// AggregatedAPI sends discovery and list requests to aggregated API servers,
+// which the apiserver reaches through the egress selector. Results are
+// reported per APIService and resource.
+type AggregatedAPI struct {
+	// APIServices are the names of the APIServices to request. By default
+	// every APIService backed by an in-cluster Service is requested.
+	APIServices []string `yaml:"apiservices"`
+	// Deploy deploys and registers a test aggregated API. It is also
+	// deployed when no APIService backed by a Service is found.
+	Deploy                  bool    `yaml:"deploy"`
+	AvailableTimeoutSeconds int     `yaml:"available_timeout_seconds"`
+	RequestsPerSecond       float64 `yaml:"requests_per_second"`
+	Concurrency             int     `yaml:"concurrency"`
+	DurationSeconds         int     `yaml:"duration_seconds"`
+	TimeoutSeconds          int     `yaml:"timeout_seconds"`
+	// Load replaces concurrency and duration_seconds with workers started
+	// and stopped following the profile. Requests are reported per load
+	// level.
+	Load *load.Profile `yaml:"load,omitempty"`
+
+	mu       sync.Mutex
+	deployed *k8s.AggregatedAPI
+}
+
+func NewAggregatedAPI() *AggregatedAPI {
+	return &AggregatedAPI{
+		AvailableTimeoutSeconds: availableTimeoutSeconds,
+		RequestsPerSecond:       requestsPerSecond,
+		Concurrency:             concurrency,
+		DurationSeconds:         durationSeconds,
+		TimeoutSeconds:          timeoutSeconds,
+	}
+}
+
+func (a *AggregatedAPI) Run() error {
+	if a.Load != nil {
+		if err := a.Load.Validate(); err != nil {
+			return err
+		}
+	}
+
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+	config.Timeout = time.Duration(a.TimeoutSeconds) * time.Second
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	defer a.Cleanup()
+
+	apiServices, err := a.apiServices(cs)
+	if err != nil {
+		return err
+	}
+
+	if len(apiServices) == 0 || a.Deploy {
+		deployed, err := a.deploy(cs)
+		if err != nil {
+			return err
+		}
+
+		apiServices = append(apiServices, *deployed)
+	}
+
+	fmt.Println("APIServices before:")
+	printAvailability(cs, apiServices)
+
+	client, err := k8s.HTTPClientFor(config)
+	if err != nil {
+		return fmt.Errorf("building HTTP client: %v", err)
+	}
+
+	host := strings.TrimSuffix(config.Host, "/")
+
+	var targets []proxy.Target
+	for _, apiService := range apiServices {
+		targets = append(targets, proxy.Target{
+			Group: fmt.Sprintf("apiservice/%s/discovery", apiService.Name),
+			URL:   host + apiService.GroupVersion(),
+		})
+
+		resources, err := listableResources(cs, apiService)
+		if err != nil {
+			fmt.Printf("Discovering resources of %s: %v\n", apiService.Name, err)
+			continue
+		}
+
+		for _, resource := range resources {
+			targets = append(targets, proxy.Target{
+				Group: fmt.Sprintf("apiservice/%s/%s", apiService.Name, resource),
+				URL:   fmt.Sprintf("%s%s/%s", host, apiService.GroupVersion(), resource),
+			})
+		}
+	}
+
+	rec := metrics.NewRecorder()
+	proxy.Run(rec, proxy.Request{
+		Client:            client,
+		Targets:           targets,
+		RequestsPerSecond: a.RequestsPerSecond,
+		Concurrency:       a.Concurrency,
+		Duration:          time.Duration(a.DurationSeconds) * time.Second,
+		Load:              a.Load,
+	})
+
+	rec.Report(os.Stdout)
+
+	fmt.Println("APIServices after:")
+	printAvailability(cs, apiServices)
+
+	return nil
+}
+
+// apiServices returns the APIServices to request, excluding the ones served
+// by the apiserver itself.
+func (a *AggregatedAPI) apiServices(cs kubernetes.Interface) ([]k8s.APIService, error) {
+	all, err := k8s.ListAPIServices(cs)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range a.APIServices {
+		wanted[name] = true
+	}
+
+	var apiServices []k8s.APIService
+	for _, apiService := range all {
+		if apiService.Spec.Service == nil {
+			continue
+		}
+
+		if len(wanted) > 0 && !wanted[apiService.Name] {
+			continue
+		}
+
+		apiServices = append(apiServices, apiService)
+	}
+
+	if len(wanted) > 0 && len(apiServices) != len(wanted) {
+		return nil, fmt.Errorf("not all of the APIServices %v exist and are backed by a service", a.APIServices)
+	}
+
+	return apiServices, nil
+}
+
+// deploy creates the test aggregated API and waits for it to become available.
+func (a *AggregatedAPI) deploy(cs kubernetes.Interface) (*k8s.APIService, error) {
+	deployed, err := k8s.CreateAggregatedAPI(func(created k8s.AggregatedAPI) {
+		a.mu.Lock()
+		a.deployed = &created
+		a.mu.Unlock()
+	})
+
+	a.mu.Lock()
+	a.deployed = deployed
+	a.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	name := deployed.APIService.Name
+	end := time.Now().Add(time.Duration(a.AvailableTimeoutSeconds) * time.Second)
+
+	for {
+		apiService, err := k8s.GetAPIService(cs, name)
+		if err == nil {
+			if available, _ := apiService.Available(); available {
+				return apiService, nil
+			}
+		}
+
+		if time.Now().After(end) {
+			return nil, fmt.Errorf("APIService %s did not become available", name)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// listableResources returns the top-level resources of the APIService which
+// support list.
+func listableResources(cs kubernetes.Interface, apiService k8s.APIService) ([]string, error) {
+	list, err := cs.Discovery().ServerResourcesForGroupVersion(apiService.Spec.Group + "/" + apiService.Spec.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []string
+	for _, resource := range list.APIResources {
+		if strings.Contains(resource.Name, "/") {
+			continue
+		}
+
+		for _, verb := range resource.Verbs {
+			if verb == "list" {
+				resources = append(resources, resource.Name)
+				break
+			}
+		}
+	}
+
+	return resources, nil
+}
+
+func printAvailability(cs kubernetes.Interface, apiServices []k8s.APIService) {
+	for _, apiService := range apiServices {
+		current, err := k8s.GetAPIService(cs, apiService.Name)
+		if err != nil {
+			fmt.Printf("\t%s: %v\n", apiService.Name, err)
+			continue
+		}
+
+		available, reason := current.Available()
+		fmt.Printf("\t%s: available=%v reason=%s\n", current.Name, available, reason)
+	}
+}
+
+// Cleanup removes the test aggregated API, if it was deployed. Leaving behind
+// an unavailable APIService breaks discovery for every client of the cluster.
+func (a *AggregatedAPI) Cleanup() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.deployed == nil {
+		return nil
+	}
+
+	if err := a.deployed.Delete(); err != nil {
+		return err
+	}
+
+	a.deployed = nil
+
+	return nil
+}
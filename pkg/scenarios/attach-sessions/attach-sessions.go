@@ -0,0 +1,187 @@
+package attachsessions
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	"github.com/ipochi/konnscen/pkg/tunnels"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	clients              = 10
+	durationSeconds      = 600
+	probeIntervalSeconds = 10
+	probeTimeoutSeconds  = 30
+	Name                 = "attach-sessions"
+
+	classOpenFailed   = "open-failed"
+	classDisconnected = "disconnected"
+	classProbeFailed  = "probe-failed"
+	classProbeTimeout = "probe-timeout"
+)
+
+// AttachSessions attaches clients to the cat running as the main process of
+// the echo pods and keeps them attached, probing every client with data
+// written to its stdin and read back from its stdout.
+//
+// Probes are reported under <transport>/probe/<pod>. Every attach session is
+// reported under <transport>/session/<pod> with how long it lasted, failing
+// as disconnected when it ended before the duration was over.
+type AttachSessions struct {
+	Clients              int `yaml:"clients"`
+	DurationSeconds      int `yaml:"duration_seconds"`
+	ProbeIntervalSeconds int `yaml:"probe_interval_seconds"`
+	ProbeTimeoutSeconds  int `yaml:"probe_timeout_seconds"`
+	// Reconnect attaches again after a disconnect, for as long as the
+	// duration lasts.
+	Reconnect bool `yaml:"reconnect"`
+	// Transport is spdy, websocket or both, in which case the clients
+	// alternate between them.
+	Transport string `yaml:"transport"`
+	// Load replaces clients and duration_seconds with clients started and
+	// stopped following the profile. Results are reported per load level.
+	Load *load.Profile `yaml:"load,omitempty"`
+}
+
+func NewAttachSessions() *AttachSessions {
+	return &AttachSessions{
+		Clients:              clients,
+		DurationSeconds:      durationSeconds,
+		ProbeIntervalSeconds: probeIntervalSeconds,
+		ProbeTimeoutSeconds:  probeTimeoutSeconds,
+		Reconnect:            true,
+	}
+}
+
+func (a *AttachSessions) Run() error {
+	if a.Load != nil {
+		if err := a.Load.Validate(); err != nil {
+			return err
+		}
+	}
+
+	transports, err := k8s.Transports(a.Transport)
+	if err != nil {
+		return err
+	}
+
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	echo, err := k8s.CreateEchoDeployment()
+	if err != nil {
+		return err
+	}
+	defer k8s.DeleteDeployment(echo)
+
+	pods, err := k8s.DeploymentPods(cs, echo)
+	if err != nil {
+		return err
+	}
+
+	rec := metrics.NewRecorder()
+	client := func(id int, tag func(group string) string, stop <-chan struct{}) {
+		a.client(config, rec, tag, transports[id%len(transports)], pods[id%len(pods)], stop)
+	}
+
+	if a.Load != nil {
+		r := load.NewRunner(a.Load)
+		r.Run(func(id int, stop <-chan struct{}) { client(id, r.Group, stop) })
+	} else {
+		load.Users(a.Clients, time.Duration(a.DurationSeconds)*time.Second, func(id int, stop <-chan struct{}) { client(id, load.Untagged, stop) })
+	}
+
+	rec.Report(os.Stdout)
+
+	return nil
+}
+
+// client keeps a session attached to the pod until stop is closed. Results
+// are reported under the groups returned by tag.
+func (a *AttachSessions) client(config *rest.Config, rec *metrics.Recorder, tag func(group string) string, transport string, pod corev1.Pod, stop <-chan struct{}) {
+	timeout := time.Duration(a.ProbeTimeoutSeconds) * time.Second
+	interval := time.Duration(a.ProbeIntervalSeconds) * time.Second
+
+	for {
+		s := metrics.Sample{Group: tag(transport + "/session/" + pod.Name), Start: time.Now()}
+
+		tun, err := tunnels.OpenAttach(config, transport, pod, timeout)
+		if err != nil {
+			s.Latency = time.Since(s.Start)
+			s.Err = err
+			s.Class = classOpenFailed
+			rec.Record(s)
+		} else {
+			disconnected := a.probe(rec, tun, tag, transport+"/probe/"+pod.Name, stop)
+			tun.Close()
+
+			s.Latency = time.Since(s.Start)
+			if disconnected {
+				s.Err = fmt.Errorf("attach to %s closed", pod.Name)
+				s.Class = classDisconnected
+			}
+			rec.Record(s)
+
+			if !disconnected {
+				return
+			}
+		}
+
+		if !a.Reconnect {
+			return
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// probe probes the session every interval until stop is closed and returns
+// whether it was disconnected before.
+func (a *AttachSessions) probe(rec *metrics.Recorder, tun tunnels.Tunnel, tag func(group string) string, group string, stop <-chan struct{}) bool {
+	timeout := time.Duration(a.ProbeTimeoutSeconds) * time.Second
+
+	ticker := time.NewTicker(time.Duration(a.ProbeIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tun.Dead():
+			return true
+		case <-stop:
+			return false
+		case <-ticker.C:
+		}
+
+		s := metrics.Sample{Group: tag(group), Start: time.Now()}
+		s.Err = tun.Probe(timeout)
+		s.Latency = time.Since(s.Start)
+		if s.Err == tunnels.ErrProbeTimeout {
+			s.Class = classProbeTimeout
+		} else if s.Err != nil {
+			s.Class = classProbeFailed
+		}
+		rec.Record(s)
+	}
+}
+
+func (a *AttachSessions) Cleanup() error {
+
+	return nil
+}
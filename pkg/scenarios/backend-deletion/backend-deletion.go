@@ -0,0 +1,305 @@
+package backenddeletion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	"github.com/ipochi/konnscen/pkg/tunnels"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	podsToDelete        = 2
+	tunnelsPerPod       = 2
+	warmupSeconds       = 5
+	probeIntervalMillis = 200
+	probeTimeoutSeconds = 5
+	hangTimeoutSeconds  = 60
+	readyTimeoutSeconds = 30
+	Name                = "backend-deletion"
+
+	kindPortForward = "portforward"
+	kindExec        = "exec"
+
+	methodDelete = "delete"
+	methodEvict  = "evict"
+
+	classOpenFailed  = "open-failed"
+	classHung        = "hung"
+	classFailedEarly = "failed-before-deletion"
+
+	groupWarmup = "warmup"
+)
+
+// BackendDeletion deletes or evicts the pods at the other end of active
+// port-forwards and exec sessions, and measures how long it takes for every
+// client to see an error. Tunnels which see no error within
+// HangTimeoutSeconds are reported as hung.
+//
+// Results are reported under <transport>/<kind>. Tunnels which failed
+// during the warmup, before any pod was deleted, are reported under
+// <transport>/<kind>/warmup instead, so they do not count as detections.
+type BackendDeletion struct {
+	PodsToDelete  int `yaml:"pods_to_delete"`
+	TunnelsPerPod int `yaml:"tunnels_per_pod"`
+	// Kinds of tunnels to open to every pod: portforward and exec.
+	Kinds []string `yaml:"kinds"`
+	// Method is delete or evict.
+	Method              string `yaml:"method"`
+	WarmupSeconds       int    `yaml:"warmup_seconds"`
+	ProbeIntervalMillis int    `yaml:"probe_interval_millis"`
+	ProbeTimeoutSeconds int    `yaml:"probe_timeout_seconds"`
+	HangTimeoutSeconds  int    `yaml:"hang_timeout_seconds"`
+	// Transport is spdy, websocket or both, in which case the tunnels to
+	// every pod alternate between them.
+	Transport string `yaml:"transport"`
+	// Load replaces tunnels_per_pod and warmup_seconds with users started
+	// and stopped following the profile, each opening a tunnel, round-robin
+	// over the pods and kinds, and closing it when stopped. The pods are
+	// deleted once the profile is over, with the tunnels of the users still
+	// active. Results are reported per load level the tunnels were opened
+	// at.
+	Load *load.Profile `yaml:"load,omitempty"`
+}
+
+func NewBackendDeletion() *BackendDeletion {
+	return &BackendDeletion{
+		PodsToDelete:        podsToDelete,
+		TunnelsPerPod:       tunnelsPerPod,
+		Kinds:               []string{kindPortForward, kindExec},
+		Method:              methodDelete,
+		WarmupSeconds:       warmupSeconds,
+		ProbeIntervalMillis: probeIntervalMillis,
+		ProbeTimeoutSeconds: probeTimeoutSeconds,
+		HangTimeoutSeconds:  hangTimeoutSeconds,
+	}
+}
+
+// watched is a tunnel probed until it fails.
+type watched struct {
+	group    string
+	pod      string
+	tunnel   tunnels.Tunnel
+	failed   chan struct{}
+	failedAt time.Time
+	err      error
+}
+
+func (b *BackendDeletion) Run() error {
+	if b.Load != nil {
+		if err := b.Load.Validate(); err != nil {
+			return err
+		}
+
+		if len(b.Kinds) == 0 {
+			return fmt.Errorf("kinds must be set to run a load profile")
+		}
+	}
+
+	transports, err := k8s.Transports(b.Transport)
+	if err != nil {
+		return err
+	}
+
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	d, err := k8s.CreateNginxDeployment()
+	if err != nil {
+		return err
+	}
+	defer k8s.DeleteDeployment(d)
+
+	pods, err := k8s.DeploymentPods(cs, d)
+	if err != nil {
+		return err
+	}
+
+	if len(pods) > b.PodsToDelete {
+		pods = pods[:b.PodsToDelete]
+	}
+
+	rec := metrics.NewRecorder()
+	var all []*watched
+	if b.Load != nil {
+		all = b.runLoad(rec, config, cs, transports, pods)
+	} else {
+		for _, pod := range pods {
+			for _, kind := range b.Kinds {
+				for i := 0; i < b.TunnelsPerPod; i++ {
+					if w := b.open(rec, config, cs, load.Untagged, transports[i%len(transports)], kind, pod); w != nil {
+						all = append(all, w)
+					}
+				}
+			}
+		}
+
+		time.Sleep(time.Duration(b.WarmupSeconds) * time.Second)
+	}
+
+	for _, w := range all {
+		defer w.tunnel.Close()
+	}
+
+	deletedAt := time.Now()
+	for _, pod := range pods {
+		if err := b.remove(cs, pod); err != nil {
+			return err
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(all))
+	for _, w := range all {
+		go func(w *watched) {
+			defer wg.Done()
+			rec.Record(b.wait(w, deletedAt))
+		}(w)
+	}
+
+	wg.Wait()
+	rec.Report(os.Stdout)
+
+	return nil
+}
+
+// runLoad opens and closes tunnels following the load profile and returns
+// the ones still open when it is over.
+func (b *BackendDeletion) runLoad(rec *metrics.Recorder, config *rest.Config, cs kubernetes.Interface, transports []string, pods []corev1.Pod) []*watched {
+	var mu sync.Mutex
+	var held []*watched
+
+	r := load.NewRunner(b.Load)
+	r.Run(func(id int, stop <-chan struct{}) {
+		pod := pods[id%len(pods)]
+		kind := b.Kinds[id/len(pods)%len(b.Kinds)]
+		transport := transports[id/(len(pods)*len(b.Kinds))%len(transports)]
+
+		w := b.open(rec, config, cs, r.Group, transport, kind, pod)
+		if w == nil {
+			return
+		}
+
+		<-stop
+
+		select {
+		case <-r.Done():
+			mu.Lock()
+			held = append(held, w)
+			mu.Unlock()
+		default:
+			w.tunnel.Close()
+		}
+	})
+
+	return held
+}
+
+// open opens a tunnel to the pod and starts probing it. A tunnel failing to
+// open is recorded under the group returned by tag and nil returned.
+func (b *BackendDeletion) open(rec *metrics.Recorder, config *rest.Config, cs kubernetes.Interface, tag func(group string) string, transport, kind string, pod corev1.Pod) *watched {
+	group := tag(tunnels.Transport(transport, kind) + "/" + kind)
+
+	tun, err := tunnels.Open(config, cs, transport, kind, pod, readyTimeoutSeconds*time.Second)
+	if err != nil {
+		fmt.Printf("Opening %s to %s: %v\n", kind, pod.Name, err)
+		rec.Record(metrics.Sample{Group: group, Start: time.Now(), Err: err, Class: classOpenFailed})
+		return nil
+	}
+
+	w := &watched{group: group, pod: pod.Name, tunnel: tun, failed: make(chan struct{})}
+	go w.probe(time.Duration(b.ProbeIntervalMillis)*time.Millisecond, time.Duration(b.ProbeTimeoutSeconds)*time.Second)
+
+	return w
+}
+
+// probe keeps sending traffic through the tunnel until it fails. A probe
+// timing out is a hung tunnel, not a failed one, so probing goes on until
+// the tunnel is closed or a probe errors.
+func (w *watched) probe(interval, timeout time.Duration) {
+	defer close(w.failed)
+
+	for {
+		select {
+		case <-w.tunnel.Dead():
+			w.failedAt = time.Now()
+			w.err = fmt.Errorf("tunnel closed")
+			return
+		case <-time.After(interval):
+		}
+
+		if err := w.tunnel.Probe(timeout); err != nil && !errors.Is(err, tunnels.ErrProbeTimeout) {
+			w.failedAt = time.Now()
+			w.err = err
+			return
+		}
+	}
+}
+
+func (b *BackendDeletion) remove(cs kubernetes.Interface, pod corev1.Pod) error {
+	switch b.Method {
+	case methodDelete:
+		if err := cs.CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{}); err != nil {
+			return fmt.Errorf("deleting %s: %v", pod.Name, err)
+		}
+	case methodEvict:
+		if err := k8s.EvictPod(cs, pod); err != nil {
+			return fmt.Errorf("evicting %s: %v", pod.Name, err)
+		}
+	default:
+		return fmt.Errorf("unknown method %q", b.Method)
+	}
+
+	fmt.Printf("Pod %s %sd\n", pod.Name, b.Method)
+
+	return nil
+}
+
+// wait records how long after the deletion the tunnel failed.
+func (b *BackendDeletion) wait(w *watched, deletedAt time.Time) metrics.Sample {
+	s := metrics.Sample{Group: w.group, Start: deletedAt}
+
+	select {
+	case <-w.failed:
+		if w.failedAt.Before(deletedAt) {
+			s.Group += "/" + groupWarmup
+			s.Start = w.failedAt
+			s.Class = classFailedEarly
+			s.Err = fmt.Errorf("%s to %s failed before deletion: %v", w.group, w.pod, w.err)
+			fmt.Println(s.Err)
+			break
+		}
+
+		s.Latency = w.failedAt.Sub(deletedAt)
+		fmt.Printf("%s to %s failed %v after deletion: %v\n", w.group, w.pod, s.Latency, w.err)
+	case <-time.After(time.Until(deletedAt.Add(time.Duration(b.HangTimeoutSeconds) * time.Second))):
+		s.Latency = time.Since(deletedAt)
+		s.Class = classHung
+		s.Err = fmt.Errorf("%s to %s still open %v after deletion", w.group, w.pod, s.Latency)
+		fmt.Println(s.Err)
+	}
+
+	return s
+}
+
+func (b *BackendDeletion) Cleanup() error {
+
+	return nil
+}
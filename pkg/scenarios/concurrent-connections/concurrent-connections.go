@@ -6,24 +6,39 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"os"
 	"sync"
 	"time"
 
 	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 )
 
 const (
 	numberOfConcurrentUsers = 5
 	numberOfTimes           = 10
 	contextTimeout          = 30
+	thinkSeconds            = 15
 	Name                    = "concurrent-connections"
+
+	groupLogs = "logs"
 )
 
 type ConcurrentConnections struct {
 	NumberOfConcurrentUsers int `yaml:"number_of_concurrent_users"`
 	NumberOfTimes           int `yaml:"number_of_times"`
+	// Load replaces the fixed users with users started and stopped
+	// following the profile. Every user fetches logs until stopped, and the
+	// fetches are reported per load level.
+	Load *load.Profile `yaml:"load,omitempty"`
+	// ArrivalRate replaces the users with log fetches started at a constant
+	// rate, however long they take. Their latency is measured from when they
+	// were due. It cannot be combined with load.
+	ArrivalRate *load.ArrivalRate `yaml:"arrival_rate,omitempty"`
 }
 
 func NewConcurrentConnections() *ConcurrentConnections {
@@ -38,6 +53,18 @@ func (c *ConcurrentConnections) Run() error {
 	//		return fmt.Errorf("Konnectivity Server/Agent, not found")
 
 	//TODO: get metrics of Konnectivity server, before the start of scenario
+	if c.ArrivalRate != nil {
+		if c.Load != nil {
+			return fmt.Errorf("arrival_rate cannot be combined with load")
+		}
+
+		return c.runArrivals()
+	}
+
+	if c.Load != nil {
+		return c.runLoad()
+	}
+
 	ctx := context.Background()
 	var wg sync.WaitGroup
 	errChan := make(chan error)
@@ -84,48 +111,127 @@ func (c *ConcurrentConnections) getLogs(ctx context.Context, wg *sync.WaitGroup,
 
 	defer wg.Done()
 	for i := 0; i < c.NumberOfTimes; i++ {
-		randomSleep(15)
-		podLogOpts := corev1.PodLogOptions{}
+		randomSleep(thinkSeconds)
 
-		// Get all the pods in the cluster.
-		pods, err := cs.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{})
+		logs, err := fetchLogs(ctx, cs)
 		if err != nil {
-			errChan <- fmt.Errorf("retreiving all pods in the cluster: %q", err)
+			errChan <- err
 			continue
 		}
 
-		if len(pods.Items) == 0 {
-			errChan <- fmt.Errorf("No pods found in the cluster")
-			continue
-		}
+		fmt.Println(logs)
+	}
+}
 
-		index := getRandomIndex(len(pods.Items))
-		pod := pods.Items[index]
+// runLoad runs users fetching logs following the load profile.
+func (c *ConcurrentConnections) runLoad() error {
+	if err := c.Load.Validate(); err != nil {
+		return err
+	}
 
-		// To avoid error in getting logs of a pod with multiple containers.
-		// Default to the first container in the pod.Spec.Container list.
-		if len(pod.Spec.Containers) > 1 {
-			podLogOpts.Container = pod.Spec.Containers[0].Name
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	rec := metrics.NewRecorder()
+	r := load.NewRunner(c.Load)
+	r.Run(func(id int, stop <-chan struct{}) {
+		for {
+			// Users think up to thinkSeconds between fetches, like in the
+			// fixed loop.
+			select {
+			case <-time.After(time.Duration(rand.Intn(thinkSeconds)) * time.Second):
+			case <-stop:
+				return
+			}
+
+			s := metrics.Sample{Group: r.Group(groupLogs), Start: time.Now()}
+			logs, err := fetchLogs(context.Background(), cs)
+			s.Latency = time.Since(s.Start)
+			s.Bytes = int64(len(logs))
+			s.Err = err
+			rec.Record(s)
 		}
+	})
 
-		req := cs.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &podLogOpts)
-		podLogs, err := req.Stream(ctx)
+	rec.Report(os.Stdout)
 
-		if err != nil {
-			errChan <- fmt.Errorf("opening stream: %q", err)
-			continue
-		}
+	return nil
+}
 
-		buf := new(bytes.Buffer)
-		_, err = io.Copy(buf, podLogs)
-		if err != nil {
-			errChan <- fmt.Errorf("copying information from podLogs to buf: %q", err)
-			continue
-		}
-		str := buf.String()
-		fmt.Println(str)
-		podLogs.Close()
+// runArrivals fetches logs at the arrival rate and reports the fetches
+// along with the ones dropped for hitting max_in_flight.
+func (c *ConcurrentConnections) runArrivals() error {
+	if err := c.ArrivalRate.Validate(); err != nil {
+		return err
 	}
+
+	// A client-side rate limit would hold fetches back past when they are
+	// due and turn the open model into a closed one.
+	cs, err := k8s.GetUnlimitedK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	rec := metrics.NewRecorder()
+	dropped := c.ArrivalRate.Run(func(scheduled time.Time) {
+		ctx, cancel := context.WithTimeout(context.Background(), contextTimeout*time.Second)
+		defer cancel()
+
+		logs, err := fetchLogs(ctx, cs)
+		rec.Record(metrics.Sample{
+			Group:   groupLogs,
+			Start:   scheduled,
+			Latency: time.Since(scheduled),
+			Bytes:   int64(len(logs)),
+			Err:     err,
+		})
+	})
+
+	rec.Report(os.Stdout)
+	fmt.Printf("%s: dropped_iterations=%d\n", groupLogs, dropped)
+
+	return nil
+}
+
+// fetchLogs fetches the logs of a random pod of the cluster.
+func fetchLogs(ctx context.Context, cs kubernetes.Interface) (string, error) {
+	podLogOpts := corev1.PodLogOptions{}
+
+	// Get all the pods in the cluster.
+	pods, err := cs.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("retreiving all pods in the cluster: %q", err)
+	}
+
+	if len(pods.Items) == 0 {
+		return "", fmt.Errorf("No pods found in the cluster")
+	}
+
+	index := getRandomIndex(len(pods.Items))
+	pod := pods.Items[index]
+
+	// To avoid error in getting logs of a pod with multiple containers.
+	// Default to the first container in the pod.Spec.Container list.
+	if len(pod.Spec.Containers) > 1 {
+		podLogOpts.Container = pod.Spec.Containers[0].Name
+	}
+
+	req := cs.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &podLogOpts)
+	podLogs, err := req.Stream(ctx)
+	if err != nil {
+		return "", fmt.Errorf("opening stream: %q", err)
+	}
+	defer podLogs.Close()
+
+	buf := new(bytes.Buffer)
+	_, err = io.Copy(buf, podLogs)
+	if err != nil {
+		return "", fmt.Errorf("copying information from podLogs to buf: %q", err)
+	}
+
+	return buf.String(), nil
 }
 
 func randomSleep(seconds int) {
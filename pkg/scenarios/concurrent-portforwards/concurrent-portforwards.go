@@ -1,27 +1,21 @@
 package concurrentportforwards
 
 import (
-	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
-	corev1 "k8s.io/api/core/v1"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/portforward"
-	"k8s.io/client-go/transport/spdy"
 )
 
 const (
@@ -34,23 +28,22 @@ type ConcurrentPortForwards struct {
 	NumberOfConcurrentPortForwards int `yaml:"number_of_concurrent_portforwards"`
 	KeepConnectedForSeconds        int `yaml:"keep_connected_for_seconds"`
 	StartPort                      int `yaml:"start_port"`
-}
-
-type PortForwardAPodRequest struct {
-	// RestConfig is the kubernetes config
-	RestConfig *rest.Config
-	// Pod is the selected pod for this port forwarding
-	Pod corev1.Pod
-	// LocalPort is the local port that will be selected to expose the PodPort
-	LocalPort int
-	// PodPort is the target port for the pod
-	PodPort int
-	// Steams configures where to write or read input from
-	Streams genericclioptions.IOStreams
-	// StopCh is the channel used to manage the port forward lifecycle
-	StopCh <-chan struct{}
-	// ReadyCh communicates when the tunnel is ready to receive traffic
-	ReadyCh chan struct{}
+	// Payload switches the tunnels from polling nginx to transferring
+	// checksummed payloads, see Payload.
+	Payload *Payload `yaml:"payload,omitempty"`
+	// TrafficProfiles replace the polling of nginx with generated HTTP
+	// traffic. Tunnels are assigned the profiles round-robin.
+	TrafficProfiles []*Traffic `yaml:"traffic_profiles,omitempty"`
+	// ConnectionMatrix runs every shape in turn, see Shape.
+	ConnectionMatrix []Shape `yaml:"connection_matrix,omitempty"`
+	// Load replaces number_of_concurrent_portforwards, start_port and
+	// keep_connected_for_seconds with tunnels opened and closed following
+	// the profile, see runLoad. It cannot be combined with payload,
+	// traffic_profiles or connection_matrix.
+	Load *load.Profile `yaml:"load,omitempty"`
+	// Transport is spdy, websocket or both, in which case the tunnels
+	// alternate between them. Results are reported per transport.
+	Transport string `yaml:"transport"`
 }
 
 func NewConcurrentPortForwards() *ConcurrentPortForwards {
@@ -64,104 +57,199 @@ func (c *ConcurrentPortForwards) Run() error {
 	//		return fmt.Errorf("Konnectivity Server/Agent, not found")
 
 	//TODO: get metrics of Konnectivity server, before the start of scenario
-	var wg sync.WaitGroup
-	errChan := make(chan error)
-	wgDone := make(chan bool)
-
-	wg.Add(c.NumberOfConcurrentPortForwards)
-
-	d, err := k8s.CreateNginxDeployment()
-	if err != nil {
+	if _, err := k8s.Transports(c.Transport); err != nil {
 		return err
 	}
 
-	for i := 0; i < c.NumberOfConcurrentPortForwards; i++ {
-		go getPortForwards(&wg, errChan, c.KeepConnectedForSeconds, c.StartPort+i)
+	if c.Load != nil {
+		if c.Payload != nil || len(c.TrafficProfiles) > 0 || len(c.ConnectionMatrix) > 0 {
+			return fmt.Errorf("load cannot be combined with payload, traffic_profiles or connection_matrix")
+		}
+
+		if err := c.Load.Validate(); err != nil {
+			return err
+		}
 	}
 
-	go func() {
-		wg.Wait()
-		wgDone <- true
-	}()
+	if len(c.TrafficProfiles) > 0 || len(c.ConnectionMatrix) > 0 {
+		// Traffic is generated for keep_connected_for_seconds.
+		if c.KeepConnectedForSeconds <= 0 {
+			return fmt.Errorf("traffic_profiles and connection_matrix need keep_connected_for_seconds")
+		}
 
-	isDone := false
-	for {
-		if isDone {
-			if err := k8s.DeleteDeployment(d); err != nil {
+		for _, t := range c.TrafficProfiles {
+			if err := t.validate(); err != nil {
 				return err
 			}
-			break
 		}
 
-		select {
-		case <-wgDone:
-			isDone = true
-			close(wgDone)
-			close(errChan)
-		case err = <-errChan:
-			close(wgDone)
-			close(errChan)
-			isDone = true
-		default:
+		for _, shape := range c.ConnectionMatrix {
+			if shape.Tunnels <= 0 || shape.Connections <= 0 {
+				return fmt.Errorf("connection_matrix shape %s needs positive tunnels and connections", shape)
+			}
 		}
 	}
 
-	return err
-}
+	createDeployment := k8s.CreateNginxDeployment
+	if c.Payload != nil {
+		createDeployment = k8s.CreateChecksumDeployment
+	}
 
-func getPortForwards(wg *sync.WaitGroup, errChan chan<- error, connectionSeconds, port int) {
-	errCh := make(chan error, 1)
-	config, err := k8s.GetRestConfig()
+	d, err := createDeployment()
 	if err != nil {
-		errChan <- fmt.Errorf("getting rest config: %v", err)
-		wg.Done()
+		return err
 	}
 
-	cs, err := k8s.GetK8sClientset()
-	if err != nil {
-		errChan <- fmt.Errorf("getting clientset, %v", err)
-		wg.Done()
+	rec := metrics.NewRecorder()
+	selector := metav1.FormatLabelSelector(d.Spec.Selector)
+	switch {
+	case c.Load != nil:
+		err = c.runLoad(rec, selector)
+	case len(c.ConnectionMatrix) > 0:
+		// runTunnels tears down the tunnels of a shape before it returns, so
+		// the next shape starts on free ports and without traffic of the
+		// previous one.
+		for _, shape := range c.ConnectionMatrix {
+			fmt.Printf("Running %d tunnels with %d connections each\n", shape.Tunnels, shape.Connections)
+			if err = c.runTunnels(shape.Tunnels, selector, c.shapeWork(rec, shape)); err != nil {
+				break
+			}
+		}
+	default:
+		err = c.runTunnels(c.NumberOfConcurrentPortForwards, selector, c.work(rec))
+	}
+
+	if err := k8s.DeleteDeployment(d); err != nil {
+		return err
 	}
 
-	stopCh := make(chan struct{}, 1)
-	readyCh := make(chan struct{}, 1)
+	if c.Payload != nil || len(c.TrafficProfiles) > 0 || len(c.ConnectionMatrix) > 0 || c.Load != nil {
+		rec.Report(os.Stdout)
+	}
 
-	stream := genericclioptions.IOStreams{
-		In:     os.Stdin,
-		Out:    os.Stdout,
-		ErrOut: os.Stderr,
+	return err
+}
+
+// work returns what every tunnel does once it is ready. A nil work keeps
+// polling nginx until keep_connected_for_seconds.
+func (c *ConcurrentPortForwards) work(rec *metrics.Recorder) func(port int) {
+	timeout := time.Second * time.Duration(c.KeepConnectedForSeconds)
+
+	switch {
+	case c.Payload != nil:
+		return func(port int) {
+			c.Payload.transfer(rec, c.group(port), port)
+		}
+	case len(c.TrafficProfiles) > 0:
+		return func(port int) {
+			profile := c.TrafficProfiles[(port-c.StartPort)%len(c.TrafficProfiles)]
+			group := c.group(port)
+			if profile.Name != "" {
+				group = fmt.Sprintf("%s/%s", group, profile.Name)
+			}
+			profile.generate(rec, group, port, timeout)
+		}
+	default:
+		return nil
 	}
+}
+
+// transport returns the transport of the tunnel forwarding port.
+func (c *ConcurrentPortForwards) transport(port int) string {
+	// The option was checked by Run.
+	transports, _ := k8s.Transports(c.Transport)
+	return transports[(port-c.StartPort)%len(transports)]
+}
+
+// group returns the group the results of the tunnel forwarding port are
+// reported under.
+func (c *ConcurrentPortForwards) group(port int) string {
+	return fmt.Sprintf("%s/tunnel-%d", c.transport(port), port)
+}
+
+// runTunnels runs count tunnels from start_port and waits for every one of
+// them to be torn down, so that none outlives the run into the report or
+// the next shape. It returns the first error of the tunnels.
+func (c *ConcurrentPortForwards) runTunnels(count int, selector string, work func(port int)) error {
+	interrupted := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		errCh <- fmt.Errorf("interrupt recevied")
-	}()
+	defer signal.Stop(sigs)
 
 	go func() {
-		err := <-errCh
-		close(stopCh)
-		errChan <- err
-		wg.Done()
+		select {
+		case <-sigs:
+			close(interrupted)
+		case <-done:
+		}
 	}()
 
-	pods, err := cs.CoreV1().Pods("default").List(context.TODO(), metav1.ListOptions{
-		LabelSelector: "app=nginx",
-	})
+	var wg sync.WaitGroup
+	errChan := make(chan error, count)
+
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		go func(port int) {
+			defer wg.Done()
+			errChan <- c.getPortForwards(selector, port, work, interrupted)
+		}(c.StartPort + i)
+	}
 
+	wg.Wait()
+	close(errChan)
+
+	var err error
+	for e := range errChan {
+		if e == nil {
+			continue
+		}
+
+		fmt.Println(e)
+		if err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// getPortForwards forwards port to a random pod of the selector and runs
+// work through the tunnel, or polls nginx through it for
+// keep_connected_for_seconds if work is nil. The tunnel is closed and its
+// port released before it returns.
+func (c *ConcurrentPortForwards) getPortForwards(selector string, port int, work func(port int), interrupted <-chan struct{}) error {
+	config, err := k8s.GetRestConfig()
 	if err != nil {
-		errCh <- fmt.Errorf("retreiving all pods in the cluster: %q", err)
+		return fmt.Errorf("getting rest config: %v", err)
 	}
 
-	if len(pods.Items) == 0 {
-		errCh <- fmt.Errorf("No pods found in the cluster")
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	pod, err := k8s.RandomPod(cs, selector)
+	if err != nil {
+		return err
 	}
 
-	pod := pods.Items[getRandomIndex(len(pods.Items))]
+	stopCh := make(chan struct{})
+	readyCh := make(chan struct{})
+
+	stream := genericclioptions.IOStreams{
+		In:     os.Stdin,
+		Out:    os.Stdout,
+		ErrOut: os.Stderr,
+	}
 
+	var forwardErr error
+	forwarded := make(chan struct{})
 	go func() {
-		err = PortForwardAPod(PortForwardAPodRequest{
+		defer close(forwarded)
+		forwardErr = k8s.PortForwardAPod(k8s.PortForwardAPodRequest{
 			RestConfig: config,
 			Pod:        pod,
 			LocalPort:  port,
@@ -169,67 +257,55 @@ func getPortForwards(wg *sync.WaitGroup, errChan chan<- error, connectionSeconds
 			Streams:    stream,
 			StopCh:     stopCh,
 			ReadyCh:    readyCh,
+			Transport:  c.transport(port),
 		})
-		if err != nil {
-			errCh <- fmt.Errorf("could not port forward: %v", err)
-		}
 	}()
 
-	timeout := time.Second * time.Duration(connectionSeconds)
-	isDone := false
-	timer := time.NewTimer(timeout)
+	defer func() {
+		close(stopCh)
+		<-forwarded
+	}()
+
+	select {
+	case <-readyCh:
+	case <-forwarded:
+		return fmt.Errorf("could not port forward: %v", forwardErr)
+	case <-interrupted:
+		return fmt.Errorf("interrupt recevied")
+	}
+
+	if work != nil {
+		work(port)
+		return nil
+	}
+
+	timer := time.NewTimer(time.Second * time.Duration(c.KeepConnectedForSeconds))
+	defer timer.Stop()
+
+	uri := fmt.Sprintf("http://localhost:%d", port)
 	for {
-		if isDone {
-			break
-		}
 		select {
 		case <-timer.C:
 			fmt.Println("Reached timeout of keep_connected_for_seconds; stopping")
-			errCh <- nil
-			isDone = true
-			timer.Stop()
-		default:
-			time.Sleep(3 * time.Second)
-			uri := fmt.Sprintf("http://localhost:%d", port)
-			resp, err := http.Get(uri)
-			if err != nil {
-				errCh <- err
-				isDone = true
-			} else {
-				io.Copy(ioutil.Discard, resp.Body)
-				resp.Body.Close()
-			}
-			fmt.Println("I'm curling ....")
+			return nil
+		case <-forwarded:
+			return fmt.Errorf("could not port forward: %v", forwardErr)
+		case <-interrupted:
+			return fmt.Errorf("interrupt recevied")
+		case <-time.After(3 * time.Second):
 		}
-	}
-}
 
-func PortForwardAPod(req PortForwardAPodRequest) error {
-	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/portforward",
-		req.Pod.Namespace, req.Pod.Name)
-	hostIP := strings.TrimPrefix(req.RestConfig.Host, "https://")
-	hostIP = strings.TrimSuffix(hostIP, "/")
-
-	transport, upgrader, err := spdy.RoundTripperFor(req.RestConfig)
-	if err != nil {
-		return err
-	}
-
-	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, &url.URL{Scheme: "https", Path: path, Host: hostIP})
-	fw, err := portforward.New(dialer, []string{fmt.Sprintf("%d:%d", req.LocalPort, req.PodPort)}, req.StopCh, req.ReadyCh, req.Streams.Out, req.Streams.ErrOut)
-	if err != nil {
-		return err
+		resp, err := http.Get(uri)
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		fmt.Println("I'm curling ....")
 	}
-	return fw.ForwardPorts()
 }
 
 func (c *ConcurrentPortForwards) Cleanup() error {
 
 	return nil
 }
-
-func getRandomIndex(max int) int {
-	rand.Seed(time.Now().UnixNano())
-
-	return rand.Intn(max)
-}
@@ -0,0 +1,110 @@
+package concurrentportforwards
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const pollInterval = 3 * time.Second
+
+// runLoad runs a tunnel per user of the load profile. Every tunnel polls
+// nginx until its user is stopped and is reopened when opening it or a poll
+// fails. Opening the tunnels is reported under setup and the polls under
+// poll, per load level.
+//
+// Tunnels listen on random free local ports rather than from start_port, so
+// that users coming and going do not use up the port range.
+func (c *ConcurrentPortForwards) runLoad(rec *metrics.Recorder, selector string) error {
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	// The option was checked by Run.
+	transports, _ := k8s.Transports(c.Transport)
+	client := &http.Client{Timeout: contextTimeout * time.Second}
+
+	r := load.NewRunner(c.Load)
+	r.Run(func(id int, stop <-chan struct{}) {
+		transport := transports[id%len(transports)]
+		for loadTunnel(rec, r, client, config, cs, selector, transport, stop) {
+		}
+	})
+
+	return nil
+}
+
+// loadTunnel opens a tunnel over the transport and polls nginx through it
+// until stop is closed or the tunnel or a poll fails, and reports whether
+// it failed.
+func loadTunnel(rec *metrics.Recorder, r *load.Runner, client *http.Client, config *rest.Config, cs kubernetes.Interface, selector, transport string, stop <-chan struct{}) bool {
+	setup := metrics.Sample{Group: r.Group(transport + "/setup"), Start: time.Now()}
+
+	pod, err := k8s.RandomPod(cs, selector)
+	if err != nil {
+		setup.Latency = time.Since(setup.Start)
+		setup.Err = err
+		rec.Record(setup)
+		return wait(pollInterval, stop)
+	}
+
+	pf, err := k8s.OpenPortForward(config, transport, pod, 0, 8080, contextTimeout*time.Second)
+	setup.Latency = time.Since(setup.Start)
+	if err != nil {
+		setup.Err = fmt.Errorf("could not port forward: %v", err)
+		rec.Record(setup)
+		return wait(pollInterval, stop)
+	}
+	defer pf.Close()
+	rec.Record(setup)
+
+	uri := fmt.Sprintf("http://localhost:%d", pf.LocalPort())
+	for {
+		select {
+		case <-time.After(pollInterval):
+		case <-pf.Done():
+			return true
+		case <-stop:
+			return false
+		}
+
+		s := metrics.Sample{Group: r.Group(transport + "/poll"), Start: time.Now()}
+		resp, err := client.Get(uri)
+		if err == nil {
+			s.Status = resp.StatusCode
+			s.Bytes, err = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		s.Latency = time.Since(s.Start)
+		s.Err = err
+		rec.Record(s)
+
+		if err != nil {
+			return true
+		}
+	}
+}
+
+// wait waits for d and reports whether stop was not closed meanwhile.
+func wait(d time.Duration, stop <-chan struct{}) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-stop:
+		return false
+	}
+}
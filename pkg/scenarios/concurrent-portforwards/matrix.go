@@ -0,0 +1,47 @@
+package concurrentportforwards
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ipochi/konnscen/pkg/metrics"
+)
+
+// Shape is a cell of the connection matrix: Tunnels port-forwards, each one
+// serving Connections parallel TCP connections. Every TCP connection is a
+// separate stream multiplexed over the SPDY connection of its tunnel, so
+// comparing 1x10 to 10x1 shows the cost of sharing a single connection. Over
+// WebSockets every TCP connection gets a WebSocket of its own instead.
+type Shape struct {
+	Tunnels     int `yaml:"tunnels"`
+	Connections int `yaml:"connections"`
+}
+
+func (s Shape) String() string {
+	return fmt.Sprintf("%dx%d", s.Tunnels, s.Connections)
+}
+
+// shapeWork generates keep-alive traffic over Connections connections of
+// every tunnel. The request mix of the first traffic profile is used, if any.
+// Its requests_per_second is the total over all the tunnels of the shape,
+// so that the shapes are offered the same load.
+func (c *ConcurrentPortForwards) shapeWork(rec *metrics.Recorder, shape Shape) func(port int) {
+	t := Traffic{}
+	if len(c.TrafficProfiles) > 0 {
+		t = *c.TrafficProfiles[0]
+	}
+
+	if t.RequestsPerSecond > 0 && shape.Tunnels > 0 {
+		fmt.Printf("Offering %.2f requests per second in total, %.2f per tunnel\n", t.RequestsPerSecond, t.RequestsPerSecond/float64(shape.Tunnels))
+		t.RequestsPerSecond /= float64(shape.Tunnels)
+	}
+
+	t.Concurrency = shape.Connections
+	t.KeepAlive = true
+
+	timeout := time.Second * time.Duration(c.KeepConnectedForSeconds)
+
+	return func(port int) {
+		t.generate(rec, fmt.Sprintf("%s/shape-%s", c.transport(port), shape), port, timeout)
+	}
+}
@@ -0,0 +1,66 @@
+package concurrentportforwards
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ipochi/konnscen/pkg/checksum"
+	"github.com/ipochi/konnscen/pkg/metrics"
+)
+
+const (
+	payloadSizeBytes = 1 << 20
+	payloadTransfers = 1
+)
+
+// Payload configures transfers of large payloads through every tunnel. Each
+// transfer is verified with SHA-256 on both sides of the tunnel. Direction is
+// one of upload, download or both, the default.
+type Payload struct {
+	SizeBytes int64  `yaml:"size_bytes"`
+	Direction string `yaml:"direction"`
+	Transfers int    `yaml:"transfers"`
+}
+
+func (p *Payload) transfer(rec *metrics.Recorder, group string, port int) {
+	size := p.SizeBytes
+	if size <= 0 {
+		size = payloadSizeBytes
+	}
+
+	transfers := p.Transfers
+	if transfers <= 0 {
+		transfers = payloadTransfers
+	}
+
+	uri := fmt.Sprintf("http://localhost:%d", port)
+	for i := 0; i < transfers; i++ {
+		for _, direction := range checksum.Directions(p.Direction) {
+			start := time.Now()
+
+			var n int64
+			var err error
+			if direction == checksum.DirectionUpload {
+				n, err = checksum.Upload(http.DefaultClient, uri, size)
+			} else {
+				n, err = checksum.Download(http.DefaultClient, uri, size)
+			}
+
+			s := metrics.Sample{
+				Group:   fmt.Sprintf("%s/%s", group, direction),
+				Start:   start,
+				Latency: time.Since(start),
+				Bytes:   n,
+				Class:   checksum.Class(err),
+				Err:     err,
+			}
+
+			if err != nil {
+				fmt.Printf("%s through port %d: %v\n", direction, port, err)
+			}
+
+			rec.Record(s)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package concurrentportforwards
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ipochi/konnscen/pkg/metrics"
+)
+
+const classUnexpectedStatus = "unexpected-status"
+
+// Traffic is an HTTP traffic profile generated through a single tunnel for
+// keep_connected_for_seconds.
+type Traffic struct {
+	Name string `yaml:"name"`
+	// RequestsPerSecond limits the rate of requests through the tunnel, zero
+	// sends requests as fast as Concurrency allows.
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	// Concurrency is the number of requests in flight through the tunnel.
+	Concurrency int `yaml:"concurrency"`
+	// KeepAlive reuses TCP connections, and so SPDY streams, between
+	// requests. Otherwise every request opens a new connection.
+	KeepAlive bool `yaml:"keep_alive"`
+	// Requests are sent in order, round-robin.
+	Requests []TrafficRequest `yaml:"requests"`
+}
+
+type TrafficRequest struct {
+	Method         string `yaml:"method"`
+	Path           string `yaml:"path"`
+	BodyBytes      int    `yaml:"body_bytes"`
+	ExpectedStatus []int  `yaml:"expected_status"`
+}
+
+func (t *Traffic) validate() error {
+	if t.RequestsPerSecond < 0 {
+		return fmt.Errorf("traffic profile %q: requests_per_second must not be negative", t.Name)
+	}
+
+	if t.RequestsPerSecond > 0 && t.interval() <= 0 {
+		return fmt.Errorf("traffic profile %q: requests_per_second %v is too high to pace", t.Name, t.RequestsPerSecond)
+	}
+
+	return nil
+}
+
+// interval is the time between requests at RequestsPerSecond.
+func (t *Traffic) interval() time.Duration {
+	return time.Duration(float64(time.Second) / t.RequestsPerSecond)
+}
+
+func (t *Traffic) generate(rec *metrics.Recorder, group string, port int, duration time.Duration) {
+	concurrency := t.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	requests := t.Requests
+	if len(requests) == 0 {
+		requests = []TrafficRequest{{Method: http.MethodGet, Path: "/"}}
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives:   !t.KeepAlive,
+			MaxIdleConnsPerHost: concurrency,
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	var ticks <-chan time.Time
+	if t.RequestsPerSecond > 0 {
+		ticker := time.NewTicker(t.interval())
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	deadline := time.Now().Add(duration)
+
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for w := 0; w < concurrency; w++ {
+		go func(w int) {
+			defer wg.Done()
+			for i := w; time.Now().Before(deadline); i += concurrency {
+				if ticks != nil {
+					<-ticks
+				}
+
+				rec.Record(send(client, port, group, requests[i%len(requests)]))
+			}
+		}(w)
+	}
+
+	wg.Wait()
+}
+
+func send(client *http.Client, port int, group string, r TrafficRequest) metrics.Sample {
+	method := r.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	var body io.Reader
+	if r.BodyBytes > 0 {
+		body = bytes.NewReader(make([]byte, r.BodyBytes))
+	}
+
+	s := metrics.Sample{Group: group, Start: time.Now()}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", port, r.Path), body)
+	if err != nil {
+		s.Err = err
+		return s
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		s.Latency = time.Since(s.Start)
+		s.Err = err
+		return s
+	}
+
+	s.Bytes, s.Err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	s.Latency = time.Since(s.Start)
+	s.Status = resp.StatusCode
+
+	if s.Err == nil && !r.expected(resp.StatusCode) {
+		s.Class = classUnexpectedStatus
+		s.Err = fmt.Errorf("%s %s returned %d", method, r.Path, resp.StatusCode)
+	}
+
+	return s
+}
+
+func (r TrafficRequest) expected(status int) bool {
+	if len(r.ExpectedStatus) == 0 {
+		return status < http.StatusBadRequest
+	}
+
+	for _, code := range r.ExpectedStatus {
+		if code == status {
+			return true
+		}
+	}
+
+	return false
+}
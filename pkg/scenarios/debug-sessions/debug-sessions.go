@@ -0,0 +1,353 @@
+package debugsessions
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	sessions       = 5
+	probes         = 5
+	image          = "busybox:1.34"
+	timeoutSeconds = 60
+	Name           = "debug-sessions"
+
+	phaseAdd     = "add"
+	phaseRunning = "running"
+	phaseAttach  = "attach"
+	phaseProbe   = "probe"
+)
+
+var errSessionEnded = errors.New("attach session ended")
+
+// DebugSessions does what kubectl debug does: it adds an ephemeral container
+// running a shell to a pod, waits for it to run, attaches to it with a TTY
+// and runs probe commands in it. The latency of each phase is reported
+// separately, the attach phase covering the first probe. The attach and
+// probe phases are reported under the transport, as <transport>/attach.
+//
+// Ephemeral containers stay in the pod until it is deleted and need the
+// EphemeralContainers feature gate on clusters older than 1.23.
+type DebugSessions struct {
+	// Sessions is the number of concurrent debug sessions.
+	Sessions int `yaml:"sessions"`
+	// Selector chooses the pods of the default namespace to debug. By
+	// default an nginx Deployment is created and debugged.
+	Selector string `yaml:"selector"`
+	Image    string `yaml:"image"`
+	// TargetContainer shares its process namespace with the debug container.
+	TargetContainer string `yaml:"target_container"`
+	// Probes is the number of probe commands run after the first one.
+	Probes         int `yaml:"probes"`
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+	// Transport is spdy, websocket or both, in which case the sessions
+	// alternate between them.
+	Transport string `yaml:"transport"`
+	// Load replaces sessions with users started and stopped following the
+	// profile, each running debug sessions one after the other until it is
+	// stopped. A stopped user stops probing and exits its session. Results
+	// are reported per load level.
+	Load *load.Profile `yaml:"load,omitempty"`
+}
+
+func NewDebugSessions() *DebugSessions {
+	return &DebugSessions{
+		Sessions:       sessions,
+		Image:          image,
+		Probes:         probes,
+		TimeoutSeconds: timeoutSeconds,
+	}
+}
+
+func (d *DebugSessions) Run() error {
+	if d.Load != nil {
+		if err := d.Load.Validate(); err != nil {
+			return err
+		}
+	}
+
+	transports, err := k8s.Transports(d.Transport)
+	if err != nil {
+		return err
+	}
+
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	selector := d.Selector
+	if selector == "" {
+		deployment, err := k8s.CreateNginxDeployment()
+		if err != nil {
+			return err
+		}
+		defer k8s.DeleteDeployment(deployment)
+
+		selector = metav1.FormatLabelSelector(deployment.Spec.Selector)
+	}
+
+	rec := metrics.NewRecorder()
+
+	if d.Load != nil {
+		r := load.NewRunner(d.Load)
+		r.Run(func(id int, stop <-chan struct{}) {
+			for load.Wait(nil, stop) {
+				d.session(config, cs, rec, r.Group, selector, transports[id%len(transports)], id, stop)
+			}
+		})
+	} else {
+		var wg sync.WaitGroup
+		wg.Add(d.Sessions)
+		for i := 0; i < d.Sessions; i++ {
+			go func(i int) {
+				defer wg.Done()
+				d.session(config, cs, rec, load.Untagged, selector, transports[i%len(transports)], i, nil)
+			}(i)
+		}
+
+		wg.Wait()
+	}
+
+	rec.Report(os.Stdout)
+
+	return nil
+}
+
+// session runs a single debug session, recording every phase until the
+// first one failing under the groups returned by tag. Probing stops early
+// when stop is closed.
+func (d *DebugSessions) session(config *rest.Config, cs kubernetes.Interface, rec *metrics.Recorder, tag func(group string) string, selector, transport string, i int, stop <-chan struct{}) {
+	timeout := time.Duration(d.TimeoutSeconds) * time.Second
+
+	pod, err := k8s.RandomPod(cs, selector)
+	if err != nil {
+		rec.Record(metrics.Sample{Group: tag(phaseAdd), Start: time.Now(), Err: err})
+		return
+	}
+
+	name := fmt.Sprintf("konnscen-debug-%d-%s", i, strconv.FormatInt(time.Now().UnixNano(), 36))
+
+	start := time.Now()
+	err = d.addContainer(cs, pod, name)
+	rec.Record(metrics.Sample{Group: tag(phaseAdd), Start: start, Latency: time.Since(start), Err: err})
+	if err != nil {
+		return
+	}
+
+	start = time.Now()
+	err = waitForRunning(cs, pod, name, timeout)
+	rec.Record(metrics.Sample{Group: tag(phaseRunning), Start: start, Latency: time.Since(start), Err: err})
+	if err != nil {
+		return
+	}
+
+	s := attach(config, transport, pod, name)
+	defer s.close(timeout)
+
+	start = time.Now()
+	err = s.probe(0, timeout)
+	rec.Record(metrics.Sample{Group: tag(transport + "/" + phaseAttach), Start: start, Latency: time.Since(start), Err: err})
+	if err != nil {
+		return
+	}
+
+	for n := 1; n <= d.Probes && load.Wait(nil, stop); n++ {
+		start = time.Now()
+		err = s.probe(n, timeout)
+		rec.Record(metrics.Sample{Group: tag(transport + "/" + phaseProbe), Start: start, Latency: time.Since(start), Err: err})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// addContainer adds a debug container running a shell to the pod through
+// the ephemeralcontainers subresource, retrying when a concurrent session
+// updated the same pod.
+func (d *DebugSessions) addContainer(cs kubernetes.Interface, pod corev1.Pod, name string) error {
+	for {
+		current, err := cs.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		current.Spec.EphemeralContainers = append(current.Spec.EphemeralContainers, corev1.EphemeralContainer{
+			EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+				Name:    name,
+				Image:   d.Image,
+				Command: []string{"sh"},
+				Stdin:   true,
+				TTY:     true,
+			},
+			TargetContainerName: d.TargetContainer,
+		})
+
+		_, err = cs.CoreV1().Pods(pod.Namespace).UpdateEphemeralContainers(context.TODO(), pod.Name, current, metav1.UpdateOptions{})
+		if !apierrors.IsConflict(err) {
+			return err
+		}
+	}
+}
+
+func waitForRunning(cs kubernetes.Interface, pod corev1.Pod, name string, timeout time.Duration) error {
+	end := time.Now().Add(timeout)
+
+	for {
+		current, err := cs.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{})
+		if err == nil {
+			for _, status := range current.Status.EphemeralContainerStatuses {
+				if status.Name != name {
+					continue
+				}
+
+				if status.State.Running != nil {
+					return nil
+				}
+
+				if t := status.State.Terminated; t != nil {
+					return fmt.Errorf("debug container %s terminated: %s", name, t.Reason)
+				}
+			}
+		}
+
+		if time.Now().After(end) {
+			return fmt.Errorf("debug container %s not running after %v", name, timeout)
+		}
+
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// session is a shell attached to with a TTY.
+type session struct {
+	stdin *io.PipeWriter
+	lines chan string
+	// err is what the attach ended with, set before lines is closed.
+	err error
+}
+
+func attach(config *rest.Config, transport string, pod corev1.Pod, container string) *session {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+
+	s := &session{stdin: stdinW, lines: make(chan string, 16)}
+
+	go func() {
+		s.err = k8s.AttachToPod(k8s.AttachToPodRequest{
+			RestConfig: config,
+			Pod:        pod,
+			Container:  container,
+			Stdin:      stdinR,
+			Stdout:     stdoutW,
+			TTY:        true,
+			Transport:  transport,
+		})
+		stdinR.CloseWithError(errSessionEnded)
+		stdoutW.Close()
+	}()
+
+	go func() {
+		scanner := bufio.NewScanner(stdoutR)
+		for scanner.Scan() {
+			s.lines <- scanner.Text()
+		}
+		io.Copy(ioutil.Discard, stdoutR)
+		close(s.lines)
+	}()
+
+	return s
+}
+
+// probe runs echo in the shell and waits for its output. The TTY echoes the
+// command itself back, so the quotes keep it from matching the output.
+func (s *session) probe(n int, timeout time.Duration) error {
+	token := fmt.Sprintf("probe-%d", n)
+
+	deadline := time.After(timeout)
+	if err := s.write(fmt.Sprintf("echo \"probe-\"\"%d\"", n), deadline); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				if s.err != nil {
+					return fmt.Errorf("%w: %v", errSessionEnded, s.err)
+				}
+				return errSessionEnded
+			}
+
+			if strings.Contains(line, token) {
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("probe %d not answered after %v", n, timeout)
+		}
+	}
+}
+
+// write types a line, which blocks until the attach reads it, or until the
+// deadline. A write left blocked fails once the session is closed.
+func (s *session) write(line string, deadline <-chan time.Time) error {
+	written := make(chan error, 1)
+	go func() {
+		_, err := fmt.Fprintln(s.stdin, line)
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		return err
+	case <-deadline:
+		return fmt.Errorf("writing %q: timed out", line)
+	}
+}
+
+// close exits the shell, which ends the debug container, and waits for the
+// attach to end.
+func (s *session) close(timeout time.Duration) {
+	deadline := time.After(timeout)
+	s.write("exit", deadline)
+	s.stdin.Close()
+
+	for {
+		select {
+		case _, ok := <-s.lines:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+func (d *DebugSessions) Cleanup() error {
+
+	return nil
+}
@@ -0,0 +1,239 @@
+package dialstorm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	pauseSeconds   = 10
+	timeoutSeconds = 30
+	Name           = "dial-storm"
+
+	kindLogs        = "logs"
+	kindExec        = "exec"
+	kindPortForward = "portforward"
+	kindProxy       = "proxy"
+
+	// transportHTTP is what logs and proxy requests go over, whatever the
+	// transport.
+	transportHTTP = "http"
+
+	classTimeout = "timeout"
+)
+
+// DialStorm releases bursts of kubelet-bound requests at the same instant,
+// each of which makes the Konnectivity Server dial a new backend connection.
+//
+// Requests are reported under burst-<size>/<transport>/<kind>, or
+// users-<level>/<transport>/<kind> when run with a load profile.
+type DialStorm struct {
+	// BurstSizes are the number of simultaneous requests of every burst.
+	BurstSizes []int `yaml:"burst_sizes"`
+	// Kinds of requests in a burst, round-robin: logs, exec, portforward and proxy.
+	Kinds          []string `yaml:"kinds"`
+	PauseSeconds   int      `yaml:"pause_seconds"`
+	TimeoutSeconds int      `yaml:"timeout_seconds"`
+	// Transport is spdy, websocket or both, in which case the exec and
+	// portforward requests of a burst alternate between them.
+	Transport string `yaml:"transport"`
+	// Load replaces burst_sizes with users started and stopped following
+	// the profile, each sending requests of one kind one after the other
+	// until it is stopped.
+	Load *load.Profile `yaml:"load,omitempty"`
+}
+
+func NewDialStorm() *DialStorm {
+	return &DialStorm{
+		BurstSizes:     []int{10, 50, 100},
+		Kinds:          []string{kindLogs, kindExec, kindPortForward, kindProxy},
+		PauseSeconds:   pauseSeconds,
+		TimeoutSeconds: timeoutSeconds,
+	}
+}
+
+func (d *DialStorm) Run() error {
+	if len(d.Kinds) == 0 {
+		return fmt.Errorf("kinds must be set")
+	}
+
+	if d.Load != nil {
+		if err := d.Load.Validate(); err != nil {
+			return err
+		}
+	}
+
+	transports, err := k8s.Transports(d.Transport)
+	if err != nil {
+		return err
+	}
+
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	deploy, err := k8s.CreateNginxDeployment()
+	if err != nil {
+		return err
+	}
+	defer k8s.DeleteDeployment(deploy)
+
+	pods, err := k8s.DeploymentPods(cs, deploy)
+	if err != nil {
+		return err
+	}
+
+	rec := metrics.NewRecorder()
+
+	if d.Load != nil {
+		r := load.NewRunner(d.Load)
+		r.Run(func(id int, stop <-chan struct{}) {
+			kind := d.Kinds[id%len(d.Kinds)]
+			transport := transports[(id/len(d.Kinds))%len(transports)]
+
+			for n := 0; load.Wait(nil, stop); n++ {
+				d.request(rec, r.Group, config, cs, transport, kind, pods[n%len(pods)])
+			}
+		})
+
+		rec.Report(os.Stdout)
+
+		return nil
+	}
+
+	for i, k := range d.BurstSizes {
+		if i > 0 {
+			time.Sleep(time.Duration(d.PauseSeconds) * time.Second)
+		}
+
+		fmt.Printf("Releasing burst of %d requests\n", k)
+		d.burst(rec, config, cs, transports, pods, k)
+	}
+
+	rec.Report(os.Stdout)
+
+	return nil
+}
+
+// burst starts k requests and holds them on a barrier until all of them are
+// ready to go, so that the dials hit the Konnectivity Server at once.
+func (d *DialStorm) burst(rec *metrics.Recorder, config *rest.Config, cs kubernetes.Interface, transports []string, pods []corev1.Pod, k int) {
+	var ready, done sync.WaitGroup
+	barrier := make(chan struct{})
+
+	ready.Add(k)
+	done.Add(k)
+	for i := 0; i < k; i++ {
+		kind := d.Kinds[i%len(d.Kinds)]
+		transport := transports[(i/len(d.Kinds))%len(transports)]
+		pod := pods[i%len(pods)]
+
+		go func() {
+			defer done.Done()
+
+			ready.Done()
+			<-barrier
+
+			d.request(rec, func(group string) string {
+				return fmt.Sprintf("burst-%04d/%s", k, group)
+			}, config, cs, transport, kind, pod)
+		}()
+	}
+
+	ready.Wait()
+	close(barrier)
+	done.Wait()
+}
+
+// request sends a request of the kind to the pod and records it under
+// <transport>/<kind> as tagged by tag.
+func (d *DialStorm) request(rec *metrics.Recorder, tag func(group string) string, config *rest.Config, cs kubernetes.Interface, transport, kind string, pod corev1.Pod) {
+	group := transport
+	if kind == kindLogs || kind == kindProxy {
+		group = transportHTTP
+	}
+
+	s := metrics.Sample{Group: tag(group + "/" + kind), Start: time.Now()}
+	s.Err = d.dial(config, cs, transport, kind, pod)
+	s.Latency = time.Since(s.Start)
+	if errors.Is(s.Err, context.DeadlineExceeded) || errors.Is(s.Err, k8s.ErrPortForwardNotReady) {
+		s.Class = classTimeout
+	}
+
+	rec.Record(s)
+}
+
+func (d *DialStorm) dial(config *rest.Config, cs kubernetes.Interface, transport, kind string, pod corev1.Pod) error {
+	timeout := time.Duration(d.TimeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch kind {
+	case kindLogs:
+		tail := int64(1)
+		logs, err := cs.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{TailLines: &tail}).Stream(ctx)
+		if err != nil {
+			return err
+		}
+		defer logs.Close()
+
+		_, err = io.Copy(ioutil.Discard, logs)
+		return err
+	case kindExec:
+		// Execs take no context, so the burst stops waiting for a stuck one
+		// at the deadline and leaves it behind.
+		result := make(chan error, 1)
+		go func() {
+			result <- k8s.ExecInPod(k8s.ExecInPodRequest{
+				RestConfig: config,
+				Pod:        pod,
+				Command:    []string{"true"},
+				Transport:  transport,
+			})
+		}()
+
+		select {
+		case err := <-result:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	case kindPortForward:
+		pf, err := k8s.OpenPortForward(config, transport, pod, 0, 8080, timeout)
+		if err != nil {
+			return err
+		}
+
+		pf.Close()
+		return nil
+	case kindProxy:
+		_, err := cs.CoreV1().Pods(pod.Namespace).ProxyGet("http", pod.Name, "8080", "/", nil).DoRaw(ctx)
+		return err
+	default:
+		return fmt.Errorf("unknown kind %q", kind)
+	}
+}
+
+func (d *DialStorm) Cleanup() error {
+
+	return nil
+}
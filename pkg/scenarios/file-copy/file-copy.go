@@ -0,0 +1,362 @@
+package filecopy
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	fileSizeBytes = 1 << 20
+	files         = 10
+	concurrency   = 6
+	transfers     = 3
+	Name          = "file-copy"
+
+	directionUpload   = "upload"
+	directionDownload = "download"
+
+	classCorrupted = "corrupted"
+	classTruncated = "truncated"
+)
+
+// FileCopy copies generated files into and out of the echo pods the way
+// kubectl cp does, by piping tar streams through exec sessions running the
+// tar of the pod. Every file is verified with SHA-256 after each copy.
+//
+// Each transfer uploads the files to a new directory of the pod, downloads
+// them back and removes them. Copies are reported per transport, node and
+// direction.
+type FileCopy struct {
+	FileSizeBytes int64 `yaml:"file_size_bytes"`
+	Files         int   `yaml:"files"`
+	// Concurrency is the number of copies running at once, spread over the
+	// pods.
+	Concurrency int `yaml:"concurrency"`
+	// Transfers is the number of transfers each of the concurrent copiers
+	// runs.
+	Transfers int `yaml:"transfers"`
+	// Transport is spdy, websocket or both, in which case the copiers
+	// alternate between them.
+	Transport string `yaml:"transport"`
+	// Load replaces concurrency and transfers with copiers started and
+	// stopped following the profile, each running transfers one after the
+	// other until it is stopped. Copies are reported per load level.
+	Load *load.Profile `yaml:"load,omitempty"`
+}
+
+func NewFileCopy() *FileCopy {
+	return &FileCopy{
+		FileSizeBytes: fileSizeBytes,
+		Files:         files,
+		Concurrency:   concurrency,
+		Transfers:     transfers,
+	}
+}
+
+func (f *FileCopy) Run() error {
+	if f.Load != nil {
+		if err := f.Load.Validate(); err != nil {
+			return err
+		}
+	}
+
+	transports, err := k8s.Transports(f.Transport)
+	if err != nil {
+		return err
+	}
+
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	echo, err := k8s.CreateEchoDeployment()
+	if err != nil {
+		return err
+	}
+	defer k8s.DeleteDeployment(echo)
+
+	pods, err := k8s.DeploymentPods(cs, echo)
+	if err != nil {
+		return err
+	}
+
+	rec := metrics.NewRecorder()
+
+	if f.Load != nil {
+		r := load.NewRunner(f.Load)
+		r.Run(func(w int, stop <-chan struct{}) {
+			for i := 0; load.Wait(nil, stop); i++ {
+				f.transfer(config, rec, r.Group, transports[w%len(transports)], pods[w%len(pods)], fmt.Sprintf("/tmp/konnscen-%d-%d", w, i))
+			}
+		})
+	} else {
+		var wg sync.WaitGroup
+		wg.Add(f.Concurrency)
+		for w := 0; w < f.Concurrency; w++ {
+			go func(w int, pod corev1.Pod, transport string) {
+				defer wg.Done()
+				for i := 0; i < f.Transfers; i++ {
+					f.transfer(config, rec, load.Untagged, transport, pod, fmt.Sprintf("/tmp/konnscen-%d-%d", w, i))
+				}
+			}(w, pods[w%len(pods)], transports[w%len(transports)])
+		}
+
+		wg.Wait()
+	}
+
+	rec.Report(os.Stdout)
+
+	return nil
+}
+
+// transfer uploads the files to dir in the pod, downloads them back and
+// removes dir again.
+func (f *FileCopy) transfer(config *rest.Config, rec *metrics.Recorder, tag func(group string) string, transport string, pod corev1.Pod, dir string) {
+	sums := map[string]string{}
+	for i := 0; i < f.Files; i++ {
+		sums[fmt.Sprintf("file-%d", i)] = ""
+	}
+
+	record := func(direction string, start time.Time, n int64, err error) {
+		s := metrics.Sample{
+			Group:   tag(fmt.Sprintf("%s/node/%s/%s", transport, pod.Spec.NodeName, direction)),
+			Start:   start,
+			Latency: time.Since(start),
+			Bytes:   n,
+			Err:     err,
+		}
+
+		var cerr *copyError
+		if errors.As(err, &cerr) {
+			s.Class = cerr.class
+		}
+
+		if err != nil {
+			fmt.Printf("%s of %s in %s: %v\n", direction, dir, pod.Name, err)
+		}
+
+		rec.Record(s)
+	}
+
+	defer k8s.ExecInPod(k8s.ExecInPodRequest{
+		RestConfig: config,
+		Pod:        pod,
+		Command:    []string{"rm", "-rf", dir},
+		Transport:  transport,
+	})
+
+	start := time.Now()
+	n, err := f.upload(config, transport, pod, dir, sums)
+	if err == nil {
+		err = verify(config, transport, pod, dir, f.FileSizeBytes, sums)
+	}
+	record(directionUpload, start, n, err)
+	if err != nil {
+		return
+	}
+
+	start = time.Now()
+	n, err = f.download(config, transport, pod, dir, sums)
+	record(directionDownload, start, n, err)
+}
+
+// copyError is returned when files were copied, but not intact.
+type copyError struct {
+	class string
+	msg   string
+}
+
+func (e *copyError) Error() string {
+	return fmt.Sprintf("%s copy: %s", e.class, e.msg)
+}
+
+// upload streams a tar of generated files into tar -x in the pod, filling
+// in the checksum of every file in sums.
+func (f *FileCopy) upload(config *rest.Config, transport string, pod corev1.Pod, dir string, sums map[string]string) (int64, error) {
+	pr, pw := io.Pipe()
+
+	var written int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tw := tar.NewWriter(pw)
+		data := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+		for name := range sums {
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: f.FileSizeBytes, ModTime: time.Now()}); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			sum := sha256.New()
+			n, err := io.Copy(io.MultiWriter(tw, sum), io.LimitReader(data, f.FileSizeBytes))
+			written += n
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			sums[name] = hex.EncodeToString(sum.Sum(nil))
+		}
+
+		pw.CloseWithError(tw.Close())
+	}()
+
+	var stderr bytes.Buffer
+	err := k8s.ExecInPod(k8s.ExecInPodRequest{
+		RestConfig: config,
+		Pod:        pod,
+		Command:    []string{"sh", "-c", fmt.Sprintf("mkdir -p %s && tar -xmf - -C %s", dir, dir)},
+		Stdin:      pr,
+		Stderr:     &stderr,
+		Transport:  transport,
+	})
+	// Unblock the tar writer when the exec ended before reading everything.
+	pr.Close()
+	<-done
+
+	if err != nil {
+		return written, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return written, nil
+}
+
+// verify checks the size and checksum of the uploaded files in the pod.
+func verify(config *rest.Config, transport string, pod corev1.Pod, dir string, size int64, sums map[string]string) error {
+	var stdout bytes.Buffer
+	if err := k8s.ExecInPod(k8s.ExecInPodRequest{
+		RestConfig: config,
+		Pod:        pod,
+		Command: []string{"sh", "-c", fmt.Sprintf(
+			`cd %s && for f in *; do echo "$f $(stat -c %%s "$f") $(sha256sum < "$f" | cut -d " " -f 1)"; done`, dir)},
+		Stdout:    &stdout,
+		Transport: transport,
+	}); err != nil {
+		return fmt.Errorf("verifying upload: %v", err)
+	}
+
+	remote := map[string]string{}
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		var name, sum string
+		var n int64
+		if _, err := fmt.Sscan(scanner.Text(), &name, &n, &sum); err != nil {
+			return fmt.Errorf("parsing checksums %q: %v", scanner.Text(), err)
+		}
+
+		if n != size {
+			return &copyError{classTruncated, fmt.Sprintf("%s has %d bytes in the pod, sent %d", name, n, size)}
+		}
+
+		remote[name] = sum
+	}
+
+	for name, sum := range sums {
+		got, ok := remote[name]
+		if !ok {
+			return &copyError{classTruncated, fmt.Sprintf("%s missing in the pod", name)}
+		}
+
+		if got != sum {
+			return &copyError{classCorrupted, fmt.Sprintf("%s has sha256 %s in the pod, sent %s", name, got, sum)}
+		}
+	}
+
+	return nil
+}
+
+// download reads a tar of dir produced by tar -c in the pod and checks every
+// file against sums.
+func (f *FileCopy) download(config *rest.Config, transport string, pod corev1.Pod, dir string, sums map[string]string) (int64, error) {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(k8s.ExecInPod(k8s.ExecInPodRequest{
+			RestConfig: config,
+			Pod:        pod,
+			Command:    []string{"tar", "-cf", "-", "-C", dir, "."},
+			Stdout:     pw,
+			Transport:  transport,
+		}))
+	}()
+	defer pr.Close()
+
+	var received int64
+	seen := map[string]bool{}
+	tr := tar.NewReader(pr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return received, &copyError{classTruncated, fmt.Sprintf("tar stream ended early: %v", err)}
+			}
+			return received, err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		sum := sha256.New()
+		n, err := io.Copy(sum, tr)
+		received += n
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return received, &copyError{classTruncated, fmt.Sprintf("%s ended after %d bytes", hdr.Name, n)}
+			}
+			return received, err
+		}
+
+		name := path.Clean(hdr.Name)
+		expected, ok := sums[name]
+		if !ok {
+			continue
+		}
+		seen[name] = true
+
+		if got := hex.EncodeToString(sum.Sum(nil)); got != expected {
+			return received, &copyError{classCorrupted, fmt.Sprintf("%s has sha256 %s, expected %s", name, got, expected)}
+		}
+	}
+
+	for name := range sums {
+		if !seen[name] {
+			return received, &copyError{classTruncated, fmt.Sprintf("%s missing in the tar stream", name)}
+		}
+	}
+
+	return received, nil
+}
+
+func (f *FileCopy) Cleanup() error {
+
+	return nil
+}
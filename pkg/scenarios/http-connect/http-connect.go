@@ -0,0 +1,310 @@
+package httpconnect
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipochi/konnscen/pkg/checksum"
+	"github.com/ipochi/konnscen/pkg/konnectivity"
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	concurrency       = 10
+	durationSeconds   = 60
+	requestsPerTunnel = 1
+	timeoutSeconds    = 30
+	Name              = "http-connect"
+
+	groupConnect = "connect"
+
+	classDialFailed = "dial-failed"
+	classRejected   = "rejected"
+	classTimeout    = "timeout"
+)
+
+var errTunnelUsed = errors.New("tunnel already used")
+
+// HTTPConnect talks to the http-connect frontend of the Konnectivity Server
+// directly, the way the kube-apiserver does as its egress, leaving the
+// kube-apiserver out of the numbers. Every tunnel is a CONNECT request to a
+// target followed by HTTP requests through the tunnel.
+//
+// Opening tunnels is reported under connect. Requests through the tunnels
+// are reported under upload and download, and speak the protocol of the
+// checksum pods, verifying every payload with SHA-256.
+type HTTPConnect struct {
+	Egress konnectivity.Egress `yaml:"egress"`
+	// Targets are the host:port addresses to CONNECT to, round-robin. By
+	// default the checksum pods are deployed and their pod IPs used.
+	Targets []string `yaml:"targets"`
+	// NodePort adds the InternalIP of every node with this port to the
+	// targets.
+	NodePort    int `yaml:"node_port"`
+	Concurrency int `yaml:"concurrency"`
+	// TunnelsPerSecond is shared by all workers, 0 means no limit.
+	TunnelsPerSecond float64 `yaml:"tunnels_per_second"`
+	DurationSeconds  int     `yaml:"duration_seconds"`
+	// RequestsPerTunnel is the number of requests sent through every tunnel
+	// in each direction, 0 only opens and closes the tunnels.
+	RequestsPerTunnel int   `yaml:"requests_per_tunnel"`
+	PayloadBytes      int64 `yaml:"payload_bytes"`
+	// Direction is one of upload, download or both, the default.
+	Direction      string `yaml:"direction"`
+	TimeoutSeconds int    `yaml:"timeout_seconds"`
+	// Load replaces concurrency and duration_seconds with workers started
+	// and stopped following the profile. Results are reported per load
+	// level.
+	Load *load.Profile `yaml:"load,omitempty"`
+}
+
+func NewHTTPConnect() *HTTPConnect {
+	return &HTTPConnect{
+		Egress: konnectivity.Egress{
+			UDSName: "/etc/kubernetes/konnectivity-server/konnectivity-server.socket",
+		},
+		Concurrency:       concurrency,
+		DurationSeconds:   durationSeconds,
+		RequestsPerTunnel: requestsPerTunnel,
+		TimeoutSeconds:    timeoutSeconds,
+	}
+}
+
+func (h *HTTPConnect) Run() error {
+	if h.Load != nil {
+		if err := h.Load.Validate(); err != nil {
+			return err
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if h.Egress.UDSName == "" {
+		var err error
+		if tlsConfig, err = h.Egress.TLSConfig(); err != nil {
+			return err
+		}
+	}
+
+	targets := h.Targets
+	if len(targets) == 0 || h.NodePort > 0 {
+		cs, err := k8s.GetK8sClientset()
+		if err != nil {
+			return fmt.Errorf("getting clientset, %v", err)
+		}
+
+		if len(targets) == 0 {
+			d, err := k8s.CreateChecksumDeployment()
+			if err != nil {
+				return err
+			}
+			defer k8s.DeleteDeployment(d)
+
+			pods, err := k8s.DeploymentPods(cs, d)
+			if err != nil {
+				return err
+			}
+
+			for _, pod := range pods {
+				targets = append(targets, net.JoinHostPort(pod.Status.PodIP, "8080"))
+			}
+		}
+
+		if h.NodePort > 0 {
+			nodes, err := nodeTargets(cs, h.NodePort)
+			if err != nil {
+				return err
+			}
+
+			targets = append(targets, nodes...)
+		}
+	}
+
+	if len(targets) == 0 {
+		return fmt.Errorf("no targets to connect to")
+	}
+
+	var ticks <-chan time.Time
+	if h.TunnelsPerSecond > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / h.TunnelsPerSecond))
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	rec := metrics.NewRecorder()
+
+	if h.Load != nil {
+		r := load.NewRunner(h.Load)
+		r.Run(func(w int, stop <-chan struct{}) {
+			for i := w; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				if ticks != nil {
+					select {
+					case <-ticks:
+					case <-stop:
+						return
+					}
+				}
+
+				h.tunnel(rec, r.Group, tlsConfig, targets[i%len(targets)])
+			}
+		})
+	} else {
+		deadline := time.Now().Add(time.Duration(h.DurationSeconds) * time.Second)
+
+		var wg sync.WaitGroup
+		wg.Add(h.Concurrency)
+		for w := 0; w < h.Concurrency; w++ {
+			go func(w int) {
+				defer wg.Done()
+				for i := w; time.Now().Before(deadline); i += h.Concurrency {
+					if ticks != nil {
+						<-ticks
+					}
+
+					h.tunnel(rec, load.Untagged, tlsConfig, targets[i%len(targets)])
+				}
+			}(w)
+		}
+
+		wg.Wait()
+	}
+
+	rec.Report(os.Stdout)
+
+	return nil
+}
+
+// nodeTargets returns the InternalIP of every node with the port.
+func nodeTargets(cs kubernetes.Interface, port int) ([]string, error) {
+	nodes, err := cs.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes: %v", err)
+	}
+
+	var targets []string
+	for _, node := range nodes.Items {
+		for _, addr := range node.Status.Addresses {
+			if addr.Type == corev1.NodeInternalIP {
+				targets = append(targets, net.JoinHostPort(addr.Address, strconv.Itoa(port)))
+				break
+			}
+		}
+	}
+
+	return targets, nil
+}
+
+// tunnel opens a tunnel to the target, sends the requests through it and
+// closes it again. Results are reported under the groups returned by tag.
+func (h *HTTPConnect) tunnel(rec *metrics.Recorder, tag func(group string) string, tlsConfig *tls.Config, target string) {
+	timeout := time.Duration(h.TimeoutSeconds) * time.Second
+	s := metrics.Sample{Group: tag(groupConnect), Start: time.Now()}
+
+	conn, err := h.Egress.Dial(tlsConfig, timeout)
+	if err != nil {
+		s.Latency = time.Since(s.Start)
+		s.Err = err
+		s.Class = classDialFailed
+		rec.Record(s)
+		return
+	}
+	defer conn.Close()
+
+	tun, status, err := konnectivity.Connect(conn, target, timeout)
+	s.Latency = time.Since(s.Start)
+	s.Status = status
+	s.Err = err
+	s.Class = class(err)
+	rec.Record(s)
+	if err != nil {
+		fmt.Printf("CONNECT to %s: %v\n", target, err)
+		return
+	}
+
+	// The client sends every request through the tunnel, it is never dialed
+	// again.
+	dialed := false
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if dialed {
+					return nil, errTunnelUsed
+				}
+
+				dialed = true
+				return tun, nil
+			},
+			MaxConnsPerHost: 1,
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	uri := "http://" + target
+	for i := 0; i < h.RequestsPerTunnel; i++ {
+		for _, direction := range checksum.Directions(h.Direction) {
+			start := time.Now()
+
+			var n int64
+			var err error
+			if direction == checksum.DirectionUpload {
+				n, err = checksum.Upload(client, uri, h.PayloadBytes)
+			} else {
+				n, err = checksum.Download(client, uri, h.PayloadBytes)
+			}
+
+			rec.Record(metrics.Sample{
+				Group:   tag(direction),
+				Start:   start,
+				Latency: time.Since(start),
+				Bytes:   n,
+				Class:   class(err),
+				Err:     err,
+			})
+
+			if err != nil {
+				fmt.Printf("%s through tunnel to %s: %v\n", direction, target, err)
+				return
+			}
+		}
+	}
+}
+
+func class(err error) string {
+	var nerr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case checksum.Class(err) != "":
+		return checksum.Class(err)
+	case errors.Is(err, konnectivity.ErrConnectRejected):
+		return classRejected
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return classTimeout
+	default:
+		return ""
+	}
+}
+
+func (h *HTTPConnect) Cleanup() error {
+
+	return nil
+}
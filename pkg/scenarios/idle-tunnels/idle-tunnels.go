@@ -0,0 +1,206 @@
+package idletunnels
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	"github.com/ipochi/konnscen/pkg/tunnels"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	tunnelsPerKind      = 2
+	probeTimeoutSeconds = 30
+	Name                = "idle-tunnels"
+
+	kindPortForward = "portforward"
+	kindExec        = "exec"
+	kindLogs        = "logs"
+
+	classOpenFailed   = "open-failed"
+	classDiedIdle     = "died-idle"
+	classProbeFailed  = "probe-failed"
+	classProbeTimeout = "probe-timeout"
+)
+
+// IdleTunnels opens port-forwards, exec sessions and follow-log streams,
+// leaves them idle and then probes whether they still carry traffic.
+//
+// Samples of tunnels that died while idle have the time into the idle period
+// at which the client noticed as latency. Failed probes have the time it took
+// for the probe to fail, i.e. how long a dead tunnel takes to be detected.
+type IdleTunnels struct {
+	IdleSeconds    []int `yaml:"idle_seconds"`
+	TunnelsPerKind int   `yaml:"tunnels_per_kind"`
+	// Kinds of tunnels to open: portforward, exec and logs.
+	Kinds               []string `yaml:"kinds"`
+	ProbeTimeoutSeconds int      `yaml:"probe_timeout_seconds"`
+	// Transport is spdy, websocket or both, in which case the tunnels of
+	// every kind alternate between them.
+	Transport string `yaml:"transport"`
+	// Load replaces tunnels_per_kind with users started and stopped
+	// following the profile, each opening tunnels of one kind and idle
+	// period one after the other until it is stopped. A stopped user closes
+	// its idle tunnel without probing it. Results are reported per load
+	// level.
+	Load *load.Profile `yaml:"load,omitempty"`
+}
+
+func NewIdleTunnels() *IdleTunnels {
+	return &IdleTunnels{
+		IdleSeconds:         []int{30, 300, 900},
+		TunnelsPerKind:      tunnelsPerKind,
+		Kinds:               []string{kindPortForward, kindExec, kindLogs},
+		ProbeTimeoutSeconds: probeTimeoutSeconds,
+	}
+}
+
+func (t *IdleTunnels) Run() error {
+	if t.Load != nil {
+		if err := t.Load.Validate(); err != nil {
+			return err
+		}
+
+		if len(t.IdleSeconds) == 0 || len(t.Kinds) == 0 {
+			return fmt.Errorf("idle_seconds and kinds must be set to run a load profile")
+		}
+	}
+
+	transports, err := k8s.Transports(t.Transport)
+	if err != nil {
+		return err
+	}
+
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	nginx, err := k8s.CreateNginxDeployment()
+	if err != nil {
+		return err
+	}
+	defer k8s.DeleteDeployment(nginx)
+
+	echo, err := k8s.CreateEchoDeployment()
+	if err != nil {
+		return err
+	}
+	defer k8s.DeleteDeployment(echo)
+
+	nginxPods, err := k8s.DeploymentPods(cs, nginx)
+	if err != nil {
+		return err
+	}
+
+	echoPods, err := k8s.DeploymentPods(cs, echo)
+	if err != nil {
+		return err
+	}
+
+	rec := metrics.NewRecorder()
+
+	if t.Load != nil {
+		r := load.NewRunner(t.Load)
+		r.Run(func(id int, stop <-chan struct{}) {
+			kind := t.Kinds[id%len(t.Kinds)]
+			idle := time.Duration(t.IdleSeconds[id/len(t.Kinds)%len(t.IdleSeconds)]) * time.Second
+
+			pods := echoPods
+			if kind == kindPortForward {
+				pods = nginxPods
+			}
+
+			for n := 0; load.Wait(nil, stop); n++ {
+				if s, done := t.idle(config, cs, r.Group, transports[id%len(transports)], kind, pods[n%len(pods)], idle, stop); done {
+					rec.Record(s)
+				}
+			}
+		})
+
+		rec.Report(os.Stdout)
+
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for _, idle := range t.IdleSeconds {
+		for _, kind := range t.Kinds {
+			for i := 0; i < t.TunnelsPerKind; i++ {
+				pod := echoPods[i%len(echoPods)]
+				if kind == kindPortForward {
+					pod = nginxPods[i%len(nginxPods)]
+				}
+
+				wg.Add(1)
+				go func(idle int, kind, transport string) {
+					defer wg.Done()
+					s, _ := t.idle(config, cs, load.Untagged, transport, kind, pod, time.Duration(idle)*time.Second, nil)
+					rec.Record(s)
+				}(idle, kind, transports[i%len(transports)])
+			}
+		}
+	}
+
+	wg.Wait()
+	rec.Report(os.Stdout)
+
+	return nil
+}
+
+// idle opens a tunnel, leaves it idle and probes it, and returns the sample
+// under the group returned by tag. It reports false when stop was closed
+// while the tunnel was idle, in which case it was closed without a probe.
+func (t *IdleTunnels) idle(config *rest.Config, cs kubernetes.Interface, tag func(group string) string, transport, kind string, pod corev1.Pod, idle time.Duration, stop <-chan struct{}) (metrics.Sample, bool) {
+	s := metrics.Sample{Group: tag(fmt.Sprintf("%s/idle-%04ds/%s", tunnels.Transport(transport, kind), int(idle.Seconds()), kind))}
+	timeout := time.Duration(t.ProbeTimeoutSeconds) * time.Second
+
+	tun, err := tunnels.Open(config, cs, transport, kind, pod, timeout)
+
+	s.Start = time.Now()
+	if err != nil {
+		s.Err = err
+		s.Class = classOpenFailed
+		return s, true
+	}
+	defer tun.Close()
+
+	select {
+	case <-tun.Dead():
+		s.Latency = time.Since(s.Start)
+		s.Err = fmt.Errorf("%s to %s closed while idle", kind, pod.Name)
+		s.Class = classDiedIdle
+		return s, true
+	case <-stop:
+		return s, false
+	case <-time.After(idle):
+	}
+
+	s.Start = time.Now()
+	s.Err = tun.Probe(timeout)
+	s.Latency = time.Since(s.Start)
+	if s.Err == tunnels.ErrProbeTimeout {
+		s.Class = classProbeTimeout
+	} else if s.Err != nil {
+		s.Class = classProbeFailed
+	}
+
+	return s, true
+}
+
+func (t *IdleTunnels) Cleanup() error {
+
+	return nil
+}
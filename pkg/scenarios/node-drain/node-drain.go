@@ -0,0 +1,377 @@
+package nodedrain
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipochi/konnscen/pkg/konnectivity"
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	"github.com/ipochi/konnscen/pkg/tunnels"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	tunnelsPerKind      = 2
+	probeIntervalMillis = 500
+	probeTimeoutSeconds = 5
+	warmupSeconds       = 30
+	settleSeconds       = 120
+	drainTimeoutSeconds = 300
+	readyTimeoutSeconds = 30
+	Name                = "node-drain"
+
+	kindPortForward = "portforward"
+	kindExec        = "exec"
+	kindLogs        = "logs"
+
+	phaseBefore   = "1-before"
+	phaseDraining = "2-draining"
+	phaseAfter    = "3-after"
+
+	groupAgentsReady = "agents-ready"
+
+	classOpenFailed = "open-failed"
+)
+
+// NodeDrain cordons and drains a node running a Konnectivity Agent while
+// tunnels to pods on the other nodes are probed, and uncordons it afterwards.
+// None of the probes are expected to fail.
+//
+// Drains skip DaemonSet pods like kubectl drain does, so an agent run by a
+// DaemonSet keeps running on the cordoned node and the drain only disrupts
+// agents run by a Deployment. agents-ready then only measures those.
+//
+// Probes are reported under <phase>/<transport>/<kind>.
+type NodeDrain struct {
+	// Node to drain, defaults to the node of a Konnectivity Agent.
+	Node           string `yaml:"node"`
+	TunnelsPerKind int    `yaml:"tunnels_per_kind"`
+	// Kinds of tunnels to probe: portforward, exec and logs.
+	Kinds               []string            `yaml:"kinds"`
+	ProbeIntervalMillis int                 `yaml:"probe_interval_millis"`
+	ProbeTimeoutSeconds int                 `yaml:"probe_timeout_seconds"`
+	WarmupSeconds       int                 `yaml:"warmup_seconds"`
+	SettleSeconds       int                 `yaml:"settle_seconds"`
+	DrainTimeoutSeconds int                 `yaml:"drain_timeout_seconds"`
+	Konnectivity        konnectivity.Config `yaml:"konnectivity"`
+	// Transport is spdy, websocket or both, in which case the tunnels of
+	// every kind alternate between them.
+	Transport string `yaml:"transport"`
+	// Load replaces tunnels_per_kind with users started and stopped
+	// following the profile from the start of the warmup, each probing
+	// tunnels of one kind. The profile ends with the settle period at the
+	// latest. Probes are reported per load level.
+	Load *load.Profile `yaml:"load,omitempty"`
+
+	mu sync.Mutex
+	// cordoned is the node cordoned by the drain, until it is uncordoned.
+	cordoned string
+}
+
+func NewNodeDrain() *NodeDrain {
+	return &NodeDrain{
+		TunnelsPerKind:      tunnelsPerKind,
+		Kinds:               []string{kindPortForward, kindExec, kindLogs},
+		ProbeIntervalMillis: probeIntervalMillis,
+		ProbeTimeoutSeconds: probeTimeoutSeconds,
+		WarmupSeconds:       warmupSeconds,
+		SettleSeconds:       settleSeconds,
+		DrainTimeoutSeconds: drainTimeoutSeconds,
+		Konnectivity:        konnectivity.NewConfig(),
+	}
+}
+
+func (n *NodeDrain) Run() error {
+	if n.Load != nil {
+		if err := n.Load.Validate(); err != nil {
+			return err
+		}
+
+		if len(n.Kinds) == 0 {
+			return fmt.Errorf("kinds must be set to run a load profile")
+		}
+	}
+
+	transports, err := k8s.Transports(n.Transport)
+	if err != nil {
+		return err
+	}
+
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	agents, err := n.Konnectivity.AgentPods(cs)
+	if err != nil {
+		return err
+	}
+
+	node := n.Node
+	if node == "" {
+		for _, agent := range agents {
+			if agent.Status.Phase == corev1.PodRunning {
+				node = agent.Spec.NodeName
+				break
+			}
+		}
+	}
+
+	if node == "" {
+		return fmt.Errorf("no node running a Konnectivity Agent found")
+	}
+
+	nginx, err := k8s.CreateNginxDeployment()
+	if err != nil {
+		return err
+	}
+	defer k8s.DeleteDeployment(nginx)
+
+	echo, err := k8s.CreateEchoDeployment()
+	if err != nil {
+		return err
+	}
+	defer k8s.DeleteDeployment(echo)
+
+	nginxPods, err := k8s.DeploymentPods(cs, nginx)
+	if err != nil {
+		return err
+	}
+
+	echoPods, err := k8s.DeploymentPods(cs, echo)
+	if err != nil {
+		return err
+	}
+
+	nginxPods, echoPods = elsewhere(nginxPods, node), elsewhere(echoPods, node)
+	if len(nginxPods) == 0 || len(echoPods) == 0 {
+		return fmt.Errorf("no pods to send traffic to outside of node %s", node)
+	}
+
+	rec := metrics.NewRecorder()
+	var phase atomic.Value
+	phase.Store(phaseBefore)
+
+	pod := func(kind string, i int) corev1.Pod {
+		if kind == kindLogs {
+			return echoPods[i%len(echoPods)]
+		}
+
+		return nginxPods[i%len(nginxPods)]
+	}
+
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	var r *load.Runner
+	if n.Load != nil {
+		r = load.NewRunner(n.Load)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Run(func(id int, stop <-chan struct{}) {
+				kind, i := n.Kinds[id%len(n.Kinds)], id/len(n.Kinds)
+				n.traffic(config, cs, r.Group, transports[i%len(transports)], kind, pod(kind, i), rec, &phase, stop)
+			})
+		}()
+	} else {
+		for _, kind := range n.Kinds {
+			for i := 0; i < n.TunnelsPerKind; i++ {
+				wg.Add(1)
+				go func(kind string, i int) {
+					defer wg.Done()
+					n.traffic(config, cs, load.Untagged, transports[i%len(transports)], kind, pod(kind, i), rec, &phase, stopCh)
+				}(kind, i)
+			}
+		}
+	}
+
+	time.Sleep(time.Duration(n.WarmupSeconds) * time.Second)
+
+	readyAgents := k8s.ReadyPods(agents)
+	phase.Store(phaseDraining)
+
+	err = n.drain(cs, node)
+	drainedAt := time.Now()
+	phase.Store(phaseAfter)
+
+	if err == nil {
+		n.waitForAgents(cs, rec, readyAgents, drainedAt)
+		time.Sleep(time.Until(drainedAt.Add(time.Duration(n.SettleSeconds) * time.Second)))
+	}
+
+	close(stopCh)
+	if r != nil {
+		r.Stop()
+	}
+	wg.Wait()
+
+	if uerr := n.uncordon(cs); uerr != nil {
+		fmt.Println(uerr)
+	}
+
+	rec.Report(os.Stdout)
+
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, s := range rec.Samples() {
+		if s.Class != "" && s.Group != groupAgentsReady {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d probes to pods outside of node %s failed", failed, node)
+	}
+
+	return nil
+}
+
+func (n *NodeDrain) drain(cs kubernetes.Interface, node string) error {
+	if err := k8s.CordonNode(cs, node, true); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.cordoned = node
+	n.mu.Unlock()
+
+	fmt.Printf("Node %s cordoned, draining\n", node)
+	start := time.Now()
+
+	if err := k8s.DrainNode(cs, node, time.Duration(n.DrainTimeoutSeconds)*time.Second); err != nil {
+		return err
+	}
+
+	fmt.Printf("Node %s drained in %v\n", node, time.Since(start))
+
+	return nil
+}
+
+// traffic probes a tunnel to the pod until stopCh is closed, opening a new
+// one whenever it fails. Probes are reported under the groups returned by
+// tag.
+func (n *NodeDrain) traffic(config *rest.Config, cs kubernetes.Interface, tag func(group string) string, transport, kind string, pod corev1.Pod, rec *metrics.Recorder, phase *atomic.Value, stopCh <-chan struct{}) {
+	interval := time.Duration(n.ProbeIntervalMillis) * time.Millisecond
+	timeout := time.Duration(n.ProbeTimeoutSeconds) * time.Second
+
+	var tun tunnels.Tunnel
+	defer func() {
+		if tun != nil {
+			tun.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(interval):
+		}
+
+		s := metrics.Sample{Group: tag(fmt.Sprintf("%s/%s/%s", phase.Load(), tunnels.Transport(transport, kind), kind)), Start: time.Now()}
+
+		if tun == nil {
+			var err error
+			tun, err = tunnels.Open(config, cs, transport, kind, pod, readyTimeoutSeconds*time.Second)
+			if err != nil {
+				s.Latency = time.Since(s.Start)
+				s.Err = err
+				s.Class = classOpenFailed
+				rec.Record(s)
+				continue
+			}
+		}
+
+		s.Err = tun.Probe(timeout)
+		s.Latency = time.Since(s.Start)
+		rec.Record(s)
+
+		if s.Err != nil {
+			fmt.Printf("Probing %s to %s: %v\n", kind, pod.Name, s.Err)
+			tun.Close()
+			tun = nil
+		}
+	}
+}
+
+// waitForAgents records how long after the drain as many agents as before
+// were ready, e.g. after an agent Deployment rescheduled the evicted one.
+func (n *NodeDrain) waitForAgents(cs kubernetes.Interface, rec *metrics.Recorder, ready int, drainedAt time.Time) {
+	s := metrics.Sample{Group: groupAgentsReady, Start: drainedAt}
+	end := drainedAt.Add(time.Duration(n.SettleSeconds) * time.Second)
+
+	for time.Now().Before(end) {
+		agents, err := n.Konnectivity.AgentPods(cs)
+		if err == nil && k8s.ReadyPods(agents) >= ready {
+			s.Latency = time.Since(drainedAt)
+			fmt.Printf("%d agents ready %v after drain\n", ready, s.Latency)
+			rec.Record(s)
+			return
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	s.Latency = time.Since(drainedAt)
+	s.Err = fmt.Errorf("fewer than %d agents ready %v after drain", ready, s.Latency)
+	fmt.Println(s.Err)
+	rec.Record(s)
+}
+
+// elsewhere returns the pods not running on the node.
+func elsewhere(pods []corev1.Pod, node string) []corev1.Pod {
+	var out []corev1.Pod
+	for _, pod := range pods {
+		if pod.Spec.NodeName != node {
+			out = append(out, pod)
+		}
+	}
+
+	return out
+}
+
+// uncordon uncordons the node cordoned by the drain, if any.
+func (n *NodeDrain) uncordon(cs kubernetes.Interface) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.cordoned == "" {
+		return nil
+	}
+
+	if err := k8s.CordonNode(cs, n.cordoned, false); err != nil {
+		return err
+	}
+
+	fmt.Printf("Node %s uncordoned\n", n.cordoned)
+	n.cordoned = ""
+
+	return nil
+}
+
+// Cleanup uncordons the drained node when the scenario was interrupted
+// before it did.
+func (n *NodeDrain) Cleanup() error {
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	return n.uncordon(cs)
+}
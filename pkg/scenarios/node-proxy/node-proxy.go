@@ -0,0 +1,119 @@
+package nodeproxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	"github.com/ipochi/konnscen/pkg/proxy"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	requestsPerSecond = 20
+	concurrency       = 10
+	durationSeconds   = 60
+	timeoutSeconds    = 30
+	Name              = "node-proxy"
+)
+
+// NodeProxy requests kubelet endpoints of every node through the
+// nodes/proxy subresource, the way metrics collectors do. Results are
+// reported per node and path so an unhealthy agent or node stands out.
+type NodeProxy struct {
+	// NodeSelector limits the nodes requested, all nodes by default.
+	NodeSelector      string   `yaml:"node_selector"`
+	Paths             []string `yaml:"paths"`
+	RequestsPerSecond float64  `yaml:"requests_per_second"`
+	Concurrency       int      `yaml:"concurrency"`
+	DurationSeconds   int      `yaml:"duration_seconds"`
+	TimeoutSeconds    int      `yaml:"timeout_seconds"`
+	// Load replaces concurrency and duration_seconds with workers started
+	// and stopped following the profile. Requests are reported per load
+	// level.
+	Load *load.Profile `yaml:"load,omitempty"`
+}
+
+func NewNodeProxy() *NodeProxy {
+	return &NodeProxy{
+		Paths:             []string{"metrics", "stats/summary", "healthz"},
+		RequestsPerSecond: requestsPerSecond,
+		Concurrency:       concurrency,
+		DurationSeconds:   durationSeconds,
+		TimeoutSeconds:    timeoutSeconds,
+	}
+}
+
+func (n *NodeProxy) Run() error {
+	if n.Load != nil {
+		if err := n.Load.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if len(n.Paths) == 0 {
+		return fmt.Errorf("paths must be set")
+	}
+
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+	config.Timeout = time.Duration(n.TimeoutSeconds) * time.Second
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	nodes, err := cs.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{LabelSelector: n.NodeSelector})
+	if err != nil {
+		return fmt.Errorf("listing nodes: %v", err)
+	}
+
+	if len(nodes.Items) == 0 {
+		return fmt.Errorf("no nodes match %q", n.NodeSelector)
+	}
+
+	client, err := k8s.HTTPClientFor(config)
+	if err != nil {
+		return fmt.Errorf("building HTTP client: %v", err)
+	}
+
+	host := strings.TrimSuffix(config.Host, "/")
+
+	var targets []proxy.Target
+	for _, path := range n.Paths {
+		path = strings.TrimPrefix(path, "/")
+		for _, node := range nodes.Items {
+			targets = append(targets, proxy.Target{
+				Group: fmt.Sprintf("node/%s/%s", node.Name, path),
+				URL:   fmt.Sprintf("%s/api/v1/nodes/%s/proxy/%s", host, node.Name, path),
+			})
+		}
+	}
+
+	rec := metrics.NewRecorder()
+	proxy.Run(rec, proxy.Request{
+		Client:            client,
+		Targets:           targets,
+		RequestsPerSecond: n.RequestsPerSecond,
+		Concurrency:       n.Concurrency,
+		Duration:          time.Duration(n.DurationSeconds) * time.Second,
+		Load:              n.Load,
+	})
+
+	rec.Report(os.Stdout)
+
+	return nil
+}
+
+func (n *NodeProxy) Cleanup() error {
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package podproxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	"github.com/ipochi/konnscen/pkg/proxy"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	requestsPerSecond = 20
+	concurrency       = 10
+	durationSeconds   = 60
+	timeoutSeconds    = 30
+	Name              = "pod-proxy"
+)
+
+// PodProxy requests pods through the pods/proxy subresource. Results are
+// reported per node the pods run on.
+type PodProxy struct {
+	// Namespace and Selector choose the pods to request. By default the
+	// whoami pods are deployed and used.
+	Namespace string `yaml:"namespace"`
+	Selector  string `yaml:"selector"`
+	// Port is the name or number of the pod port to request.
+	Port              string  `yaml:"port"`
+	Path              string  `yaml:"path"`
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Concurrency       int     `yaml:"concurrency"`
+	DurationSeconds   int     `yaml:"duration_seconds"`
+	TimeoutSeconds    int     `yaml:"timeout_seconds"`
+	// Load replaces concurrency and duration_seconds with workers started
+	// and stopped following the profile. Requests are reported per load
+	// level.
+	Load *load.Profile `yaml:"load,omitempty"`
+}
+
+func NewPodProxy() *PodProxy {
+	return &PodProxy{
+		Path:              "/",
+		RequestsPerSecond: requestsPerSecond,
+		Concurrency:       concurrency,
+		DurationSeconds:   durationSeconds,
+		TimeoutSeconds:    timeoutSeconds,
+	}
+}
+
+func (p *PodProxy) Run() error {
+	if p.Load != nil {
+		if err := p.Load.Validate(); err != nil {
+			return err
+		}
+	}
+
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+	config.Timeout = time.Duration(p.TimeoutSeconds) * time.Second
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	namespace, port := p.Namespace, p.Port
+
+	var pods []corev1.Pod
+	if p.Selector == "" {
+		d, svc, err := k8s.CreateWhoamiDeployment()
+		if d != nil {
+			defer k8s.DeleteDeployment(d)
+		}
+		if svc != nil {
+			defer k8s.DeleteService(svc)
+		}
+		if err != nil {
+			return err
+		}
+
+		if pods, err = k8s.DeploymentPods(cs, d); err != nil {
+			return err
+		}
+
+		namespace, port = d.Namespace, "8080"
+	} else {
+		list, err := cs.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: p.Selector})
+		if err != nil {
+			return fmt.Errorf("listing pods: %v", err)
+		}
+
+		pods = list.Items
+	}
+
+	if len(pods) == 0 {
+		return fmt.Errorf("no pods match %q in namespace %q", p.Selector, namespace)
+	}
+
+	client, err := k8s.HTTPClientFor(config)
+	if err != nil {
+		return fmt.Errorf("building HTTP client: %v", err)
+	}
+
+	host := strings.TrimSuffix(config.Host, "/")
+	name := func(pod corev1.Pod) string {
+		if port == "" {
+			return pod.Name
+		}
+
+		return pod.Name + ":" + port
+	}
+
+	targets := make([]proxy.Target, 0, len(pods))
+	for _, pod := range pods {
+		targets = append(targets, proxy.Target{
+			Group: "node/" + pod.Spec.NodeName,
+			URL:   fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s/proxy/%s", host, namespace, name(pod), strings.TrimPrefix(p.Path, "/")),
+		})
+	}
+
+	rec := metrics.NewRecorder()
+	proxy.Run(rec, proxy.Request{
+		Client:            client,
+		Targets:           targets,
+		RequestsPerSecond: p.RequestsPerSecond,
+		Concurrency:       p.Concurrency,
+		Duration:          time.Duration(p.DurationSeconds) * time.Second,
+		Load:              p.Load,
+	})
+
+	rec.Report(os.Stdout)
+
+	return nil
+}
+
+func (p *PodProxy) Cleanup() error {
+
+	return nil
+}
@@ -2,10 +2,30 @@ package scenarios
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/ipochi/konnscen/pkg/config"
+	"github.com/ipochi/konnscen/pkg/faultproxy"
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	aggregatedapi "github.com/ipochi/konnscen/pkg/scenarios/aggregated-api"
+	attachsessions "github.com/ipochi/konnscen/pkg/scenarios/attach-sessions"
+	backenddeletion "github.com/ipochi/konnscen/pkg/scenarios/backend-deletion"
 	concon "github.com/ipochi/konnscen/pkg/scenarios/concurrent-connections"
 	conportforwards "github.com/ipochi/konnscen/pkg/scenarios/concurrent-portforwards"
+	debugsessions "github.com/ipochi/konnscen/pkg/scenarios/debug-sessions"
+	dialstorm "github.com/ipochi/konnscen/pkg/scenarios/dial-storm"
+	filecopy "github.com/ipochi/konnscen/pkg/scenarios/file-copy"
+	httpconnect "github.com/ipochi/konnscen/pkg/scenarios/http-connect"
+	idletunnels "github.com/ipochi/konnscen/pkg/scenarios/idle-tunnels"
+	nodedrain "github.com/ipochi/konnscen/pkg/scenarios/node-drain"
+	nodeproxy "github.com/ipochi/konnscen/pkg/scenarios/node-proxy"
+	podproxy "github.com/ipochi/konnscen/pkg/scenarios/pod-proxy"
+	serviceproxy "github.com/ipochi/konnscen/pkg/scenarios/service-proxy"
+	ttyexec "github.com/ipochi/konnscen/pkg/scenarios/tty-exec"
+	tunnelchurn "github.com/ipochi/konnscen/pkg/scenarios/tunnel-churn"
+	webhookadmission "github.com/ipochi/konnscen/pkg/scenarios/webhook-admission"
 )
 
 var (
@@ -22,17 +42,93 @@ func initializeMap(cfg *config.Config) {
 
 	scenariosMap[concon.Name] = cfg.ConcurrentConnections
 	scenariosMap[conportforwards.Name] = cfg.ConcurrentPortForwards
+	scenariosMap[tunnelchurn.Name] = cfg.TunnelChurn
+	scenariosMap[dialstorm.Name] = cfg.DialStorm
+	scenariosMap[idletunnels.Name] = cfg.IdleTunnels
+	scenariosMap[backenddeletion.Name] = cfg.BackendDeletion
+	scenariosMap[nodedrain.Name] = cfg.NodeDrain
+	scenariosMap[serviceproxy.Name] = cfg.ServiceProxy
+	scenariosMap[podproxy.Name] = cfg.PodProxy
+	scenariosMap[nodeproxy.Name] = cfg.NodeProxy
+	scenariosMap[aggregatedapi.Name] = cfg.AggregatedAPI
+	scenariosMap[webhookadmission.Name] = cfg.WebhookAdmission
+	scenariosMap[debugsessions.Name] = cfg.DebugSessions
+	scenariosMap[attachsessions.Name] = cfg.AttachSessions
+	scenariosMap[filecopy.Name] = cfg.FileCopy
+	scenariosMap[httpconnect.Name] = cfg.HTTPConnect
+	scenariosMap[ttyexec.Name] = cfg.TTYExec
 }
 
 func Run(cfg *config.Config, sc []string) error {
 	initializeMap(cfg)
 
-	for _, s := range sc {
-		err := scenariosMap[s].Run()
+	if err := cfg.ClientRateLimit.Validate(); err != nil {
+		return err
+	}
+	k8s.UseRateLimit(*cfg.ClientRateLimit)
+
+	if cfg.FaultProxy.Enabled {
+		target, err := k8s.APIServerAddress()
 		if err != nil {
+			return fmt.Errorf("getting apiserver address: %w", err)
+		}
+
+		proxy, err := faultproxy.Start(cfg.FaultProxy, target)
+		if err != nil {
+			return fmt.Errorf("starting fault proxy: %w", err)
+		}
+		defer proxy.Close()
+
+		fmt.Printf("Connecting to apiserver %s through fault proxy %s\n", target, proxy.Addr())
+		k8s.UseProxy(proxy.Addr())
+	}
+
+	for _, s := range sc {
+		if err := run(cfg, scenariosMap[s]); err != nil {
 			return fmt.Errorf("running scenario %q: %w", s, err)
 		}
 	}
 
 	return nil
 }
+
+// run runs the scenario alongside the chaos and cleans both up afterwards,
+// also when interrupted.
+func run(cfg *config.Config, s Scenario) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	go func() {
+		select {
+		case <-sigs:
+			fmt.Println("Interrupted, cleaning up")
+			cleanup(cfg, s)
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+
+	defer cleanup(cfg, s)
+
+	stopChaos, err := cfg.Chaos.Start()
+	if err != nil {
+		return fmt.Errorf("starting chaos: %w", err)
+	}
+	defer stopChaos()
+
+	return s.Run()
+}
+
+func cleanup(cfg *config.Config, s Scenario) {
+	if err := s.Cleanup(); err != nil {
+		fmt.Printf("Cleaning up scenario: %v\n", err)
+	}
+
+	if err := cfg.Chaos.Cleanup(); err != nil {
+		fmt.Printf("Cleaning up chaos: %v\n", err)
+	}
+}
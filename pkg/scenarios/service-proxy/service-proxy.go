@@ -0,0 +1,168 @@
+package serviceproxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	"github.com/ipochi/konnscen/pkg/proxy"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	requestsPerSecond = 20
+	concurrency       = 5
+	durationSeconds   = 60
+	timeoutSeconds    = 30
+	endpointsTimeout  = 60 * time.Second
+	Name              = "service-proxy"
+)
+
+// ServiceProxy sends requests to a Service through the services/proxy
+// subresource of the apiserver, which reaches the endpoints through
+// Konnectivity. Results are reported per endpoint pod, as told by the
+// X-Pod-Name response header of the whoami pods. The pods of a configured
+// Service rarely set it, so all its requests end up under endpoint/unknown.
+type ServiceProxy struct {
+	// Service is namespace/name:port of the Service to send requests to.
+	// By default the whoami Service is deployed and used.
+	Service           string   `yaml:"service"`
+	Paths             []string `yaml:"paths"`
+	RequestsPerSecond float64  `yaml:"requests_per_second"`
+	Concurrency       int      `yaml:"concurrency"`
+	DurationSeconds   int      `yaml:"duration_seconds"`
+	TimeoutSeconds    int      `yaml:"timeout_seconds"`
+	// Load replaces concurrency and duration_seconds with workers started
+	// and stopped following the profile. Requests are reported per load
+	// level.
+	Load *load.Profile `yaml:"load,omitempty"`
+}
+
+func NewServiceProxy() *ServiceProxy {
+	return &ServiceProxy{
+		Paths:             []string{"/"},
+		RequestsPerSecond: requestsPerSecond,
+		Concurrency:       concurrency,
+		DurationSeconds:   durationSeconds,
+		TimeoutSeconds:    timeoutSeconds,
+	}
+}
+
+func (s *ServiceProxy) Run() error {
+	if s.Load != nil {
+		if err := s.Load.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if len(s.Paths) == 0 {
+		return fmt.Errorf("paths must be set")
+	}
+
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+	config.Timeout = time.Duration(s.TimeoutSeconds) * time.Second
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	target := s.Service
+	if target == "" {
+		d, svc, err := k8s.CreateWhoamiDeployment()
+		if d != nil {
+			defer k8s.DeleteDeployment(d)
+		}
+		if svc != nil {
+			defer k8s.DeleteService(svc)
+		}
+		if err != nil {
+			return err
+		}
+
+		target = fmt.Sprintf("%s/%s:http", svc.Namespace, svc.Name)
+	}
+
+	namespace, name, err := parseService(target)
+	if err != nil {
+		return err
+	}
+
+	if err := waitForEndpoints(cs, namespace, strings.Split(name, ":")[0]); err != nil {
+		return err
+	}
+
+	client, err := k8s.HTTPClientFor(config)
+	if err != nil {
+		return fmt.Errorf("building HTTP client: %v", err)
+	}
+
+	base := fmt.Sprintf("%s/api/v1/namespaces/%s/services/%s/proxy", strings.TrimSuffix(config.Host, "/"), namespace, name)
+
+	targets := make([]proxy.Target, 0, len(s.Paths))
+	for _, path := range s.Paths {
+		targets = append(targets, proxy.Target{
+			Group: "endpoint/unknown",
+			URL:   base + path,
+			ByPod: true,
+		})
+	}
+
+	rec := metrics.NewRecorder()
+	proxy.Run(rec, proxy.Request{
+		Client:            client,
+		Targets:           targets,
+		RequestsPerSecond: s.RequestsPerSecond,
+		Concurrency:       s.Concurrency,
+		Duration:          time.Duration(s.DurationSeconds) * time.Second,
+		Load:              s.Load,
+	})
+	rec.Report(os.Stdout)
+
+	return nil
+}
+
+// parseService splits namespace/name:port into the namespace and name:port.
+func parseService(service string) (string, string, error) {
+	parts := strings.SplitN(service, "/", 2)
+	if len(parts) != 2 || !strings.Contains(parts[1], ":") {
+		return "", "", fmt.Errorf("service %q is not namespace/name:port", service)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+func waitForEndpoints(cs kubernetes.Interface, namespace, name string) error {
+	end := time.Now().Add(endpointsTimeout)
+
+	for {
+		ep, err := cs.CoreV1().Endpoints(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err == nil {
+			for _, subset := range ep.Subsets {
+				if len(subset.Addresses) > 0 {
+					return nil
+				}
+			}
+		}
+
+		if time.Now().After(end) {
+			return fmt.Errorf("no ready endpoints for service %s/%s", namespace, name)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+func (s *ServiceProxy) Cleanup() error {
+
+	return nil
+}
@@ -0,0 +1,452 @@
+package ttyexec
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	sessions           = 5
+	lines              = 100
+	lineBytes          = 64
+	lineIntervalMillis = 50
+	resizesPerSecond   = 50
+	timeoutSeconds     = 30
+	Name               = "tty-exec"
+
+	groupSetup    = "tty/setup"
+	groupLine     = "tty/line"
+	groupResize   = "tty/resize"
+	groupTeardown = "tty/teardown"
+
+	classCorrupted       = "corrupted"
+	classTimeout         = "timeout"
+	classResizeLost      = "resize-lost"
+	classTeardownFailed  = "teardown-failed"
+	classTeardownTimeout = "teardown-timeout"
+
+	alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+var (
+	errSessionEnded = errors.New("exec session ended")
+	errTimeout      = errors.New("timed out")
+
+	// finalSize is set after the resize storm and checked with stty.
+	finalSize = remotecommand.TerminalSize{Width: 123, Height: 45}
+)
+
+// TTYExec runs interactive shells in the echo pods with exec and a TTY,
+// typing lines into them while resizing their terminal continuously.
+//
+// Results are reported under <transport>/tty/: setup is the time until the
+// shell answered, line the round trip of every typed line, which fails when
+// its output is not intact, resize the time until the last terminal size
+// was seen by stty after the storm, and teardown the time until the session
+// ended after exiting the shell.
+type TTYExec struct {
+	// Sessions is the number of concurrent shells.
+	Sessions           int `yaml:"sessions"`
+	Lines              int `yaml:"lines"`
+	LineBytes          int `yaml:"line_bytes"`
+	LineIntervalMillis int `yaml:"line_interval_millis"`
+	// ResizesPerSecond is the rate of terminal resizes of every session
+	// while typing, 0 disables the storm.
+	ResizesPerSecond float64 `yaml:"resizes_per_second"`
+	TimeoutSeconds   int     `yaml:"timeout_seconds"`
+	// Transport is spdy, websocket or both, in which case the sessions
+	// alternate between them.
+	Transport string `yaml:"transport"`
+	// Load replaces sessions with users started and stopped following the
+	// profile, each opening shells one after the other until it is stopped.
+	// A stopped user stops typing and exits its shell. Results are reported
+	// per load level.
+	Load *load.Profile `yaml:"load,omitempty"`
+}
+
+func NewTTYExec() *TTYExec {
+	return &TTYExec{
+		Sessions:           sessions,
+		Lines:              lines,
+		LineBytes:          lineBytes,
+		LineIntervalMillis: lineIntervalMillis,
+		ResizesPerSecond:   resizesPerSecond,
+		TimeoutSeconds:     timeoutSeconds,
+	}
+}
+
+func (t *TTYExec) Run() error {
+	if t.Load != nil {
+		if err := t.Load.Validate(); err != nil {
+			return err
+		}
+	}
+
+	transports, err := k8s.Transports(t.Transport)
+	if err != nil {
+		return err
+	}
+
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	echo, err := k8s.CreateEchoDeployment()
+	if err != nil {
+		return err
+	}
+	defer k8s.DeleteDeployment(echo)
+
+	pods, err := k8s.DeploymentPods(cs, echo)
+	if err != nil {
+		return err
+	}
+
+	rec := metrics.NewRecorder()
+
+	if t.Load != nil {
+		r := load.NewRunner(t.Load)
+		r.Run(func(id int, stop <-chan struct{}) {
+			for load.Wait(nil, stop) {
+				t.session(config, rec, r.Group, transports[id%len(transports)], pods[id%len(pods)], stop)
+			}
+		})
+	} else {
+		var wg sync.WaitGroup
+		wg.Add(t.Sessions)
+		for i := 0; i < t.Sessions; i++ {
+			go func(pod corev1.Pod, transport string) {
+				defer wg.Done()
+				t.session(config, rec, load.Untagged, transport, pod, nil)
+			}(pods[i%len(pods)], transports[i%len(transports)])
+		}
+
+		wg.Wait()
+	}
+
+	rec.Report(os.Stdout)
+
+	return nil
+}
+
+// session types the lines into a shell, stopping early when stop is closed,
+// and exits it. Results are reported under the groups returned by tag.
+func (t *TTYExec) session(config *rest.Config, rec *metrics.Recorder, tag func(group string) string, transport string, pod corev1.Pod, stop <-chan struct{}) {
+	timeout := time.Duration(t.TimeoutSeconds) * time.Second
+
+	start := time.Now()
+	s := openShell(config, transport, pod)
+	err := s.run("echo \"ready-\"\"0\"", "ready-0", timeout)
+	rec.Record(sample(tag, transport, groupSetup, start, 0, err))
+	if err != nil {
+		s.exit(timeout)
+		return
+	}
+
+	stopStorm := make(chan struct{})
+	stormDone := make(chan struct{})
+	go func() {
+		defer close(stormDone)
+		t.storm(s, stopStorm)
+	}()
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	payload := make([]byte, t.LineBytes)
+	for n := 0; n < t.Lines && load.Wait(nil, stop); n++ {
+		for i := range payload {
+			payload[i] = alphabet[random.Intn(len(alphabet))]
+		}
+
+		start = time.Now()
+		line := fmt.Sprintf("line-%d-%s", n, payload)
+		err = s.run(fmt.Sprintf("echo \"line-\"\"%d-%s\"", n, payload), line, timeout)
+		rec.Record(sample(tag, transport, groupLine, start, int64(len(line)), err))
+		if errors.Is(err, errSessionEnded) {
+			break
+		}
+
+		select {
+		case <-time.After(time.Duration(t.LineIntervalMillis) * time.Millisecond):
+		case <-stop:
+		}
+	}
+
+	close(stopStorm)
+	<-stormDone
+
+	if !errors.Is(err, errSessionEnded) {
+		start = time.Now()
+		err = s.checkSize(timeout)
+		rec.Record(sample(tag, transport, groupResize, start, 0, err))
+	}
+
+	start = time.Now()
+	err = s.exit(timeout)
+	rec.Record(sample(tag, transport, groupTeardown, start, 0, err))
+}
+
+// storm resizes the terminal to random sizes until stopped, ending with
+// finalSize.
+func (t *TTYExec) storm(s *shell, stop <-chan struct{}) {
+	defer s.resize(finalSize, nil)
+
+	if t.ResizesPerSecond <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / t.ResizesPerSecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.resize(remotecommand.TerminalSize{
+			Width:  uint16(20 + rand.Intn(200)),
+			Height: uint16(10 + rand.Intn(60)),
+		}, stop)
+	}
+}
+
+func sample(tag func(group string) string, transport, group string, start time.Time, bytes int64, err error) metrics.Sample {
+	s := metrics.Sample{Group: tag(transport + "/" + group), Start: start, Latency: time.Since(start), Err: err}
+	if err == nil {
+		s.Bytes = bytes
+		return s
+	}
+
+	var cerr *corruptedError
+	switch {
+	case errors.As(err, &cerr):
+		s.Class = classCorrupted
+	case group == groupTeardown && errors.Is(err, errTimeout):
+		s.Class = classTeardownTimeout
+	case group == groupTeardown:
+		s.Class = classTeardownFailed
+	case group == groupResize:
+		s.Class = classResizeLost
+	case errors.Is(err, errTimeout):
+		s.Class = classTimeout
+	}
+
+	return s
+}
+
+// corruptedError is returned when output of a command arrived, but not intact.
+type corruptedError struct {
+	expected string
+	got      string
+}
+
+func (e *corruptedError) Error() string {
+	return fmt.Sprintf("expected %q, got %q", e.expected, e.got)
+}
+
+// shell is a sh running in a pod with a TTY.
+type shell struct {
+	stdin *io.PipeWriter
+	sizes chan remotecommand.TerminalSize
+	lines chan string
+	// done is closed when the exec ended.
+	done chan struct{}
+	// err is what the exec ended with, set before lines and done are closed.
+	err error
+}
+
+func openShell(config *rest.Config, transport string, pod corev1.Pod) *shell {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+
+	s := &shell{
+		stdin: stdinW,
+		sizes: make(chan remotecommand.TerminalSize),
+		lines: make(chan string, 16),
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		s.err = k8s.ExecInPod(k8s.ExecInPodRequest{
+			RestConfig:        config,
+			Pod:               pod,
+			Command:           []string{"sh"},
+			Stdin:             stdinR,
+			Stdout:            stdoutW,
+			TTY:               true,
+			TerminalSizeQueue: sizeQueue(s.sizes),
+			Transport:         transport,
+		})
+		stdinR.CloseWithError(errSessionEnded)
+		stdoutW.Close()
+		close(s.done)
+	}()
+
+	go func() {
+		scanner := bufio.NewScanner(stdoutR)
+		for scanner.Scan() {
+			s.lines <- strings.TrimRight(scanner.Text(), "\r")
+		}
+		io.Copy(ioutil.Discard, stdoutR)
+		close(s.lines)
+	}()
+
+	return s
+}
+
+// run types the command and waits for a line of output starting like
+// expected. The TTY echoes the command itself back, so commands quote their
+// output to keep the echo from matching.
+func (s *shell) run(command, expected string, timeout time.Duration) error {
+	if err := s.write(command, timeout); err != nil {
+		return err
+	}
+
+	prefix := expected
+	if i := strings.LastIndex(expected, "-"); i >= 0 {
+		prefix = expected[:i+1]
+	}
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				return s.ended()
+			}
+
+			if line == expected {
+				return nil
+			}
+
+			if strings.HasPrefix(line, prefix) {
+				return &corruptedError{expected, line}
+			}
+		case <-deadline:
+			return errTimeout
+		}
+	}
+}
+
+// resize sends the size to the exec unless the exec ended or stop is closed.
+func (s *shell) resize(size remotecommand.TerminalSize, stop <-chan struct{}) {
+	select {
+	case s.sizes <- size:
+	case <-s.done:
+	case <-stop:
+	}
+}
+
+// checkSize runs stty until it reports finalSize. Resizes travel on their
+// own stream, so the last one may still be on its way.
+func (s *shell) checkSize(timeout time.Duration) error {
+	expected := fmt.Sprintf("size-%d-%d", finalSize.Height, finalSize.Width)
+	deadline := time.After(timeout)
+
+	for {
+		if err := s.write("echo \"size-\"$(stty size | tr \" \" -)", timeout); err != nil {
+			return err
+		}
+
+		for answered := false; !answered; {
+			select {
+			case line, ok := <-s.lines:
+				if !ok {
+					return s.ended()
+				}
+
+				if line == expected {
+					return nil
+				}
+
+				answered = strings.HasPrefix(line, "size-")
+			case <-deadline:
+				return fmt.Errorf("terminal size %dx%d not applied: %w", finalSize.Width, finalSize.Height, errTimeout)
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// exit exits the shell and waits for the session to end cleanly.
+func (s *shell) exit(timeout time.Duration) error {
+	close(s.sizes)
+	s.write("exit", timeout)
+	s.stdin.Close()
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, ok := <-s.lines:
+			if !ok {
+				return s.err
+			}
+		case <-deadline:
+			return errTimeout
+		}
+	}
+}
+
+// write types a line, which blocks until the exec reads it.
+func (s *shell) write(line string, timeout time.Duration) error {
+	written := make(chan error, 1)
+	go func() {
+		_, err := fmt.Fprintln(s.stdin, line)
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		return err
+	case <-time.After(timeout):
+		return errTimeout
+	}
+}
+
+func (s *shell) ended() error {
+	if s.err != nil {
+		return fmt.Errorf("%w: %v", errSessionEnded, s.err)
+	}
+
+	return errSessionEnded
+}
+
+// sizeQueue feeds terminal sizes to the exec until it is closed.
+type sizeQueue chan remotecommand.TerminalSize
+
+func (q sizeQueue) Next() *remotecommand.TerminalSize {
+	size, ok := <-q
+	if !ok {
+		return nil
+	}
+
+	return &size
+}
+
+func (t *TTYExec) Cleanup() error {
+
+	return nil
+}
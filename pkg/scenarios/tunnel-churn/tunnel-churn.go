@@ -0,0 +1,254 @@
+package tunnelchurn
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipochi/konnscen/pkg/konnectivity"
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	"github.com/ipochi/konnscen/pkg/tunnels"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	tunnelsPerSecond    = 5
+	durationSeconds     = 60
+	readyTimeoutSeconds = 10
+	settleSeconds       = 60
+	Name                = "tunnel-churn"
+
+	classDialFailed   = "dial-failed"
+	classReadyTimeout = "ready-timeout"
+)
+
+// TunnelChurn opens and tears down short-lived port-forwards and exec
+// sessions at a fixed rate and checks that the number of connections on the
+// Konnectivity Server returns to where it was before the churn.
+//
+// Tunnels are reported under <transport>/<kind>.
+type TunnelChurn struct {
+	TunnelsPerSecond    float64 `yaml:"tunnels_per_second"`
+	DurationSeconds     int     `yaml:"duration_seconds"`
+	HoldSeconds         int     `yaml:"hold_seconds"`
+	ReadyTimeoutSeconds int     `yaml:"ready_timeout_seconds"`
+	// SettleSeconds is how long the server connections may take to return
+	// to the baseline after the churn stopped.
+	SettleSeconds int `yaml:"settle_seconds"`
+	// Kinds of tunnels to churn, round-robin: portforward and exec.
+	Kinds []string `yaml:"kinds"`
+	// ConnectionMetrics are summed over the Konnectivity Server pods to get
+	// the server-side connection count.
+	ConnectionMetrics []string            `yaml:"connection_metrics"`
+	Konnectivity      konnectivity.Config `yaml:"konnectivity"`
+	// Transport is spdy, websocket or both, in which case the tunnels of
+	// every kind alternate between them.
+	Transport string `yaml:"transport"`
+	// Load replaces tunnels_per_second and duration_seconds with users
+	// started and stopped following the profile, each opening and tearing
+	// down tunnels of one kind one after the other until it is stopped.
+	// Tunnels are reported per load level.
+	Load *load.Profile `yaml:"load,omitempty"`
+}
+
+func NewTunnelChurn() *TunnelChurn {
+	return &TunnelChurn{
+		TunnelsPerSecond:    tunnelsPerSecond,
+		DurationSeconds:     durationSeconds,
+		ReadyTimeoutSeconds: readyTimeoutSeconds,
+		SettleSeconds:       settleSeconds,
+		Kinds:               []string{tunnels.KindPortForward, tunnels.KindExec},
+		ConnectionMetrics: []string{
+			"konnectivity_network_proxy_server_grpc_connections",
+			"konnectivity_network_proxy_server_http_connections",
+		},
+		Konnectivity: konnectivity.NewConfig(),
+	}
+}
+
+func (t *TunnelChurn) Run() error {
+	if t.ReadyTimeoutSeconds <= 0 || len(t.Kinds) == 0 {
+		return fmt.Errorf("ready_timeout_seconds and kinds must be set")
+	}
+
+	if t.Load != nil {
+		if err := t.Load.Validate(); err != nil {
+			return err
+		}
+	} else if t.TunnelsPerSecond <= 0 {
+		return fmt.Errorf("tunnels_per_second must be set")
+	}
+
+	transports, err := k8s.Transports(t.Transport)
+	if err != nil {
+		return err
+	}
+
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+
+	cs, err := k8s.GetK8sClientset()
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	d, err := k8s.CreateNginxDeployment()
+	if err != nil {
+		return err
+	}
+	defer k8s.DeleteDeployment(d)
+
+	pods, err := k8s.DeploymentPods(cs, d)
+	if err != nil {
+		return err
+	}
+
+	baseline, err := t.Konnectivity.ServerMetric(cs, t.ConnectionMetrics...)
+	if err != nil {
+		fmt.Printf("Not checking server connections, getting baseline: %v\n", err)
+	}
+	hasBaseline := err == nil
+
+	rec := metrics.NewRecorder()
+
+	if t.Load != nil {
+		r := load.NewRunner(t.Load)
+		r.Run(func(id int, stop <-chan struct{}) {
+			kind := t.Kinds[id%len(t.Kinds)]
+			transport := transports[(id/len(t.Kinds))%len(transports)]
+
+			for n := 0; load.Wait(nil, stop); n++ {
+				rec.Record(t.open(config, r.Group, transport, kind, pods[n%len(pods)]))
+			}
+		})
+	} else {
+		t.churn(rec, config, transports, pods)
+	}
+
+	rec.Report(os.Stdout)
+
+	if !hasBaseline {
+		return nil
+	}
+
+	return t.waitForBaseline(cs, baseline)
+}
+
+// churn opens a tunnel every 1/tunnels_per_second until duration_seconds
+// are over and waits for all of them to be torn down.
+func (t *TunnelChurn) churn(rec *metrics.Recorder, config *rest.Config, transports []string, pods []corev1.Pod) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / t.TunnelsPerSecond))
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(time.Duration(t.DurationSeconds) * time.Second)
+	for i := 0; time.Now().Before(deadline); i++ {
+		<-ticker.C
+
+		kind := t.Kinds[i%len(t.Kinds)]
+		transport := transports[(i/len(t.Kinds))%len(transports)]
+		pod := pods[i%len(pods)]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec.Record(t.open(config, load.Untagged, transport, kind, pod))
+		}()
+	}
+
+	wg.Wait()
+}
+
+// open opens a tunnel, holds it for hold_seconds and tears it down again.
+// It is reported under the group returned by tag.
+func (t *TunnelChurn) open(config *rest.Config, tag func(group string) string, transport, kind string, pod corev1.Pod) metrics.Sample {
+	hold := time.Duration(t.HoldSeconds) * time.Second
+	s := metrics.Sample{Group: tag(transport + "/" + kind), Start: time.Now()}
+
+	if kind == tunnels.KindExec {
+		command := []string{"true"}
+		if t.HoldSeconds > 0 {
+			command = []string{"sleep", strconv.Itoa(t.HoldSeconds)}
+		}
+
+		// Execs take no context, so the churn stops waiting for a stuck one
+		// after ready_timeout_seconds past the hold and leaves it behind.
+		result := make(chan error, 1)
+		go func() {
+			result <- k8s.ExecInPod(k8s.ExecInPodRequest{
+				RestConfig: config,
+				Pod:        pod,
+				Command:    command,
+				Transport:  transport,
+			})
+		}()
+
+		timeout := time.Duration(t.ReadyTimeoutSeconds) * time.Second
+		select {
+		case s.Err = <-result:
+			if s.Err != nil {
+				s.Class = classDialFailed
+			}
+		case <-time.After(hold + timeout):
+			s.Err = fmt.Errorf("exec did not finish within %v of its hold", timeout)
+			s.Class = classReadyTimeout
+		}
+		s.Latency = time.Since(s.Start) - hold
+
+		return s
+	}
+
+	pf, err := k8s.OpenPortForward(config, transport, pod, 0, 8080, time.Duration(t.ReadyTimeoutSeconds)*time.Second)
+	s.Latency = time.Since(s.Start)
+	if err != nil {
+		s.Err = err
+		s.Class = classDialFailed
+		if errors.Is(err, k8s.ErrPortForwardNotReady) {
+			s.Class = classReadyTimeout
+		}
+
+		return s
+	}
+
+	time.Sleep(hold)
+	pf.Close()
+
+	return s
+}
+
+func (t *TunnelChurn) waitForBaseline(cs kubernetes.Interface, baseline float64) error {
+	start := time.Now()
+	end := start.Add(time.Duration(t.SettleSeconds) * time.Second)
+
+	for {
+		current, err := t.Konnectivity.ServerMetric(cs, t.ConnectionMetrics...)
+		if err == nil && current <= baseline {
+			fmt.Printf("Server connections back to baseline of %v after %v\n", baseline, time.Since(start))
+			return nil
+		}
+
+		if time.Now().After(end) {
+			if err != nil {
+				return fmt.Errorf("getting server connections: %v", err)
+			}
+
+			return fmt.Errorf("server connections at %v, did not return to baseline of %v within %ds", current, baseline, t.SettleSeconds)
+		}
+
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (t *TunnelChurn) Cleanup() error {
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package webhookadmission
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	"github.com/ipochi/konnscen/pkg/load"
+	"github.com/ipochi/konnscen/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	operationsPerSecond   = 10
+	concurrency           = 5
+	durationSeconds       = 60
+	webhookTimeoutSeconds = 10
+	timeoutSeconds        = 30
+	warmUpTimeout         = 60 * time.Second
+	Name                  = "webhook-admission"
+
+	classWebhookTimeout = "webhook-timeout"
+	classWebhookError   = "webhook-error"
+	classTimeout        = "timeout"
+)
+
+// WebhookAdmission creates and deletes ConfigMaps in a namespace guarded by
+// a validating webhook, which the apiserver calls through Konnectivity.
+// Results are reported per operation, the latency being dominated by the
+// admission round-trip.
+type WebhookAdmission struct {
+	// OperationsPerSecond is the rate of ConfigMaps created, each of which
+	// is deleted right after.
+	OperationsPerSecond   float64 `yaml:"operations_per_second"`
+	Concurrency           int     `yaml:"concurrency"`
+	DurationSeconds       int     `yaml:"duration_seconds"`
+	WebhookTimeoutSeconds int32   `yaml:"webhook_timeout_seconds"`
+	TimeoutSeconds        int     `yaml:"timeout_seconds"`
+	// Load replaces concurrency and duration_seconds with workers started
+	// and stopped following the profile. Results are reported per load
+	// level.
+	Load *load.Profile `yaml:"load,omitempty"`
+
+	mu      sync.Mutex
+	created bool
+}
+
+func NewWebhookAdmission() *WebhookAdmission {
+	return &WebhookAdmission{
+		OperationsPerSecond:   operationsPerSecond,
+		Concurrency:           concurrency,
+		DurationSeconds:       durationSeconds,
+		WebhookTimeoutSeconds: webhookTimeoutSeconds,
+		TimeoutSeconds:        timeoutSeconds,
+	}
+}
+
+func (w *WebhookAdmission) Run() error {
+	if w.Load != nil {
+		if err := w.Load.Validate(); err != nil {
+			return err
+		}
+	}
+
+	config, err := k8s.GetRestConfig()
+	if err != nil {
+		return fmt.Errorf("getting rest config: %v", err)
+	}
+	config.Timeout = time.Duration(w.TimeoutSeconds) * time.Second
+
+	cs, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("getting clientset, %v", err)
+	}
+
+	defer w.Cleanup()
+
+	w.mu.Lock()
+	w.created = true
+	w.mu.Unlock()
+
+	if err := k8s.CreateWebhook(w.WebhookTimeoutSeconds); err != nil {
+		return err
+	}
+
+	if err := warmUp(cs); err != nil {
+		return err
+	}
+
+	var ticks <-chan time.Time
+	if w.OperationsPerSecond > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / w.OperationsPerSecond))
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	rec := metrics.NewRecorder()
+	work := func(tag func(group string) string, stop <-chan struct{}) {
+		for load.Wait(ticks, stop) {
+			roundTrip(cs, rec, tag)
+		}
+	}
+
+	if w.Load != nil {
+		r := load.NewRunner(w.Load)
+		r.Run(func(_ int, stop <-chan struct{}) { work(r.Group, stop) })
+	} else {
+		load.Users(w.Concurrency, time.Duration(w.DurationSeconds)*time.Second, func(_ int, stop <-chan struct{}) { work(load.Untagged, stop) })
+	}
+
+	rec.Report(os.Stdout)
+
+	return nil
+}
+
+// roundTrip creates a ConfigMap and deletes it again, both operations being
+// admitted by the webhook. Results are reported under the groups returned by
+// tag.
+func roundTrip(cs kubernetes.Interface, rec *metrics.Recorder, tag func(group string) string) {
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{GenerateName: "konnscen-"}}
+
+	start := time.Now()
+	created, err := cs.CoreV1().ConfigMaps(k8s.WebhookNamespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+	rec.Record(sample(tag("create"), start, err))
+	if err != nil {
+		return
+	}
+
+	start = time.Now()
+	err = cs.CoreV1().ConfigMaps(k8s.WebhookNamespace).Delete(context.TODO(), created.Name, metav1.DeleteOptions{})
+	rec.Record(sample(tag("delete"), start, err))
+}
+
+func sample(group string, start time.Time, err error) metrics.Sample {
+	s := metrics.Sample{Group: group, Start: start, Latency: time.Since(start), Err: err}
+
+	if err == nil {
+		return s
+	}
+
+	if status, ok := err.(apierrors.APIStatus); ok {
+		s.Status = int(status.Status().Code)
+	}
+
+	// The apiserver reports webhook failures as internal errors whose
+	// message names the webhook call.
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "failed calling webhook") && strings.Contains(msg, "deadline exceeded"):
+		s.Class = classWebhookTimeout
+	case strings.Contains(msg, "failed calling webhook"):
+		s.Class = classWebhookError
+	case apierrors.IsTimeout(err) || apierrors.IsServerTimeout(err) || strings.Contains(msg, "deadline exceeded"):
+		s.Class = classTimeout
+	}
+
+	return s
+}
+
+// warmUp waits for the webhook to admit requests, its Service endpoints
+// trailing the pods becoming ready.
+func warmUp(cs kubernetes.Interface) error {
+	end := time.Now().Add(warmUpTimeout)
+
+	for {
+		cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{GenerateName: "konnscen-"}}
+
+		created, err := cs.CoreV1().ConfigMaps(k8s.WebhookNamespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+		if err == nil {
+			return cs.CoreV1().ConfigMaps(k8s.WebhookNamespace).Delete(context.TODO(), created.Name, metav1.DeleteOptions{})
+		}
+
+		if time.Now().After(end) {
+			return fmt.Errorf("webhook did not admit requests: %v", err)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// Cleanup removes the webhook, if it was created. A leftover webhook
+// configuration whose backend is gone rejects every request it matches.
+func (w *WebhookAdmission) Cleanup() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.created {
+		return nil
+	}
+
+	if err := k8s.DeleteWebhook(); err != nil {
+		return err
+	}
+
+	w.created = false
+
+	return nil
+}
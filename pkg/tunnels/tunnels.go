@@ -0,0 +1,321 @@
+package tunnels
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	k8s "github.com/ipochi/konnscen/pkg/kubernetes"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// ErrProbeTimeout is returned when a probe did not make it through the tunnel in time.
+var ErrProbeTimeout = errors.New("probe timed out")
+
+const (
+	KindPortForward = "portforward"
+	KindExec        = "exec"
+	KindAttach      = "attach"
+	KindLogs        = "logs"
+
+	// transportHTTP is what logs are streamed over, whatever the transport.
+	transportHTTP = "http"
+)
+
+// Tunnel is an open port-forward, exec session or log stream.
+type Tunnel interface {
+	// Probe sends traffic through the tunnel and waits for it to come back.
+	Probe(timeout time.Duration) error
+	// Dead is closed once the client noticed the tunnel is gone.
+	Dead() <-chan struct{}
+	Close()
+}
+
+// Open opens a tunnel of the kind over the transport. Port-forwards go to
+// port 8080, which the nginx and checksum pods listen on, and attaches need
+// the echo pods.
+func Open(config *rest.Config, cs kubernetes.Interface, transport, kind string, pod corev1.Pod, timeout time.Duration) (Tunnel, error) {
+	switch kind {
+	case KindPortForward:
+		return OpenPortForward(config, transport, pod, 8080, timeout)
+	case KindExec:
+		return OpenExec(config, transport, pod, timeout)
+	case KindAttach:
+		return OpenAttach(config, transport, pod, timeout)
+	case KindLogs:
+		return OpenLogs(config, cs, pod, timeout)
+	default:
+		return nil, fmt.Errorf("unknown kind %q", kind)
+	}
+}
+
+// Transport returns what a tunnel of the kind opened over the transport is
+// streamed over, for reporting.
+func Transport(transport, kind string) string {
+	if kind == KindLogs {
+		return transportHTTP
+	}
+
+	if transport == "" {
+		return k8s.TransportSPDY
+	}
+
+	return transport
+}
+
+type portForwardTunnel struct {
+	pf     *k8s.PortForward
+	deadCh chan struct{}
+}
+
+// OpenPortForward opens a tunnel to an HTTP server listening on podPort.
+func OpenPortForward(config *rest.Config, transport string, pod corev1.Pod, podPort int, timeout time.Duration) (Tunnel, error) {
+	pf, err := k8s.OpenPortForward(config, transport, pod, 0, podPort, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &portForwardTunnel{pf: pf, deadCh: make(chan struct{})}
+	go func() {
+		<-pf.Done()
+		close(t.deadCh)
+	}()
+
+	return t, nil
+}
+
+func (t *portForwardTunnel) Probe(timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%d", t.pf.LocalPort()))
+	if err != nil {
+		var netErr interface{ Timeout() bool }
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return ErrProbeTimeout
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
+
+func (t *portForwardTunnel) Dead() <-chan struct{} {
+	return t.deadCh
+}
+
+func (t *portForwardTunnel) Close() {
+	t.pf.Close()
+}
+
+// lines reads lines from a stream until it ends. When nobody keeps up with
+// the lines the oldest are dropped, so the stream is never stalled by lines
+// nobody waits for, e.g. probes of other clients attached to the same pod.
+type lines struct {
+	ch     chan string
+	deadCh chan struct{}
+}
+
+func readLines(r io.Reader) *lines {
+	l := &lines{ch: make(chan string, 16), deadCh: make(chan struct{})}
+
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := scanner.Text()
+			select {
+			case l.ch <- line:
+			default:
+				select {
+				case <-l.ch:
+				default:
+				}
+				l.ch <- line
+			}
+		}
+		close(l.deadCh)
+	}()
+
+	return l
+}
+
+// waitFor waits until a line containing token was read.
+func (l *lines) waitFor(token string, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case line := <-l.ch:
+			if strings.Contains(line, token) {
+				return nil
+			}
+		case <-l.deadCh:
+			return fmt.Errorf("stream closed before %q was read", token)
+		case <-timer.C:
+			return ErrProbeTimeout
+		}
+	}
+}
+
+func newToken() string {
+	return fmt.Sprintf("konnscen-probe-%d", time.Now().UnixNano())
+}
+
+// catTunnel is a cat in the pod echoing the probes back, either run by an
+// exec or the main process of an echo pod attached to.
+type catTunnel struct {
+	stdin *io.PipeWriter
+	out   *lines
+}
+
+// OpenExec starts an exec session running cat in the pod.
+func OpenExec(config *rest.Config, transport string, pod corev1.Pod, timeout time.Duration) (Tunnel, error) {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+
+	go func() {
+		err := k8s.ExecInPod(k8s.ExecInPodRequest{
+			RestConfig: config,
+			Pod:        pod,
+			Command:    []string{"cat"},
+			Stdin:      stdinR,
+			Stdout:     stdoutW,
+			Transport:  transport,
+		})
+		stdoutW.CloseWithError(err)
+	}()
+
+	t := &catTunnel{stdin: stdinW, out: readLines(stdoutR)}
+	if err := t.Probe(timeout); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("starting exec session in %s: %v", pod.Name, err)
+	}
+
+	return t, nil
+}
+
+// OpenAttach attaches to the main process of the pod, which must be a cat
+// reading its stdin like in the echo pods. Every client attached to the same
+// pod reads the probes of the others too.
+func OpenAttach(config *rest.Config, transport string, pod corev1.Pod, timeout time.Duration) (Tunnel, error) {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+
+	go func() {
+		err := k8s.AttachToPod(k8s.AttachToPodRequest{
+			RestConfig: config,
+			Pod:        pod,
+			Stdin:      stdinR,
+			Stdout:     stdoutW,
+			Transport:  transport,
+		})
+		stdoutW.CloseWithError(err)
+	}()
+
+	t := &catTunnel{stdin: stdinW, out: readLines(stdoutR)}
+	if err := t.Probe(timeout); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("attaching to %s: %v", pod.Name, err)
+	}
+
+	return t, nil
+}
+
+func (t *catTunnel) Probe(timeout time.Duration) error {
+	token := newToken()
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := fmt.Fprintln(t.stdin, token)
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		if err != nil {
+			return err
+		}
+	case <-time.After(timeout):
+		return ErrProbeTimeout
+	}
+
+	return t.out.waitFor(token, timeout)
+}
+
+func (t *catTunnel) Dead() <-chan struct{} {
+	return t.out.deadCh
+}
+
+func (t *catTunnel) Close() {
+	t.stdin.Close()
+}
+
+// logsTunnel follows the logs of a pod. It is probed by writing to the
+// stdout of the main process of the pod from an exec.
+type logsTunnel struct {
+	config *rest.Config
+	pod    corev1.Pod
+	cancel context.CancelFunc
+	out    *lines
+}
+
+// OpenLogs follows the logs of the pod, which needs a shell and to allow
+// writing to the stdout of its main process, like the echo pods.
+func OpenLogs(config *rest.Config, cs kubernetes.Interface, pod corev1.Pod, timeout time.Duration) (Tunnel, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	since := int64(1)
+	stream, err := cs.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Follow:       true,
+		SinceSeconds: &since,
+	}).Stream(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	t := &logsTunnel{config: config, pod: pod, cancel: cancel, out: readLines(stream)}
+	go func() {
+		<-ctx.Done()
+		stream.Close()
+	}()
+
+	if err := t.Probe(timeout); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("following logs of %s: %v", pod.Name, err)
+	}
+
+	return t, nil
+}
+
+func (t *logsTunnel) Probe(timeout time.Duration) error {
+	token := newToken()
+
+	if err := k8s.ExecInPod(k8s.ExecInPodRequest{
+		RestConfig: t.config,
+		Pod:        t.pod,
+		Command:    []string{"sh", "-c", fmt.Sprintf("echo %s > /proc/1/fd/1", token)},
+	}); err != nil {
+		return fmt.Errorf("writing probe to logs: %v", err)
+	}
+
+	return t.out.waitFor(token, timeout)
+}
+
+func (t *logsTunnel) Dead() <-chan struct{} {
+	return t.out.deadCh
+}
+
+func (t *logsTunnel) Close() {
+	t.cancel()
+}